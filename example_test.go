@@ -0,0 +1,37 @@
+package traefik_umami_plugin_test
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	traefik_umami_plugin "github.com/1cedsoda/traefik-umami-plugin"
+)
+
+func ExampleWrap() {
+	site := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		io.WriteString(rw, "<html><body><h1>Hello</h1></body></html>")
+	})
+
+	config := traefik_umami_plugin.CreateConfig()
+	config.UmamiHost = "http://umami:3000"
+	config.WebsiteId = "d4617504-241c-4797-8eab-5939b367b3ad"
+	config.LogLevel = "error"
+	server := httptest.NewServer(traefik_umami_plugin.Wrap(site, config))
+	defer server.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+	req.Header.Set("Accept", "text/html")
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	defer res.Body.Close()
+	body, _ := io.ReadAll(res.Body)
+	fmt.Println(string(body))
+	// Output:
+	// <html><body><h1>Hello</h1><script async defer data-host-url='/_umami' src='/_umami/script.js' data-website-id='d4617504-241c-4797-8eab-5939b367b3ad' data-auto-track='true'></script></body></html>
+}
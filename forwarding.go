@@ -25,6 +25,7 @@ const (
 	proxyAuthenticate  = "proxy-authenticate"
 	proxyAuthorization = "proxy-authorization"
 	te                 = "te" // canonicalized version of "TE"
+	trailer            = "trailer"
 	trailers           = "trailers"
 	transferEncoding   = "transfer-Encoding"
 	upgrade            = "upgrade"
@@ -36,6 +37,7 @@ var hopHeaders = []string{
 	proxyAuthenticate,
 	proxyAuthorization,
 	te, // canonicalized version of "TE"
+	trailer,
 	trailers,
 	transferEncoding,
 	upgrade,
@@ -2,67 +2,319 @@
 package traefik_umami_plugin
 
 import (
+	"bufio"
 	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"mime"
+	"net"
 	"net/http"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Config the plugin configuration.
 type Config struct {
-	ForwardPath            string   `json:"forwardPath"`
-	UmamiHost              string   `json:"umamiHost"`
-	WebsiteId              string   `json:"websiteId"`
-	AutoTrack              bool     `json:"autoTrack"`
-	DoNotTrack             bool     `json:"doNotTrack"`
-	Cache                  bool     `json:"cache"`
-	Domains                []string `json:"domains"`
-	EvadeGoogleTagManager  bool     `json:"evadeGoogleTagManager"`
-	ScriptInjection        bool     `json:"scriptInjection"`
-	ScriptInjectionMode    string   `json:"scriptInjectionMode"`
-	ServerSideTracking     bool     `json:"serverSideTracking"`
-	ServerSideTrackingMode string   `json:"serverSideTrackingMode"`
+	ForwardPath              string            `json:"forwardPath"`
+	UmamiHost                string            `json:"umamiHost"`
+	WebsiteId                string            `json:"websiteId"`
+	AutoTrack                bool              `json:"autoTrack"`
+	DoNotTrack               bool              `json:"doNotTrack"`
+	Cache                    bool              `json:"cache"`
+	Domains                  []string          `json:"domains"`
+	EvadeGoogleTagManager    bool              `json:"evadeGoogleTagManager"`
+	ScriptInjection          bool              `json:"scriptInjection"`
+	ScriptInjectionMode      string            `json:"scriptInjectionMode"`
+	ServerSideTracking       bool              `json:"serverSideTracking"`
+	ServerSideTrackingMode   string            `json:"serverSideTrackingMode"`
+	PrecompressedFallback    string            `json:"precompressedFallback"`
+	InjectMethods            []string          `json:"injectMethods"`
+	TrackMethods             []string          `json:"trackMethods"`
+	BeforeSend               string            `json:"beforeSend"`
+	BeforeSendScript         string            `json:"beforeSendScript"`
+	ScreenFromHeader         string            `json:"screenFromHeader"`
+	OutboundLinks            bool              `json:"outboundLinks"`
+	ConsentMode              bool              `json:"consentMode"`
+	ConsentCookie            string            `json:"consentCookie"`
+	OnMissingAnchor          string            `json:"onMissingAnchor"`
+	TrackErrorsAsEvents      bool              `json:"trackErrorsAsEvents"`
+	ForwardCookies           bool              `json:"forwardCookies"`
+	SkipFramedRequests       bool              `json:"skipFramedRequests"`
+	InjectDeadline           string            `json:"injectDeadline"`
+	EnvironmentTag           string            `json:"environmentTag"`
+	TrackingSinkType         string            `json:"trackingSinkType"`
+	TrackingSinkPath         string            `json:"trackingSinkPath"`
+	HonorNoTransform         bool              `json:"honorNoTransform"`
+	ResponseHeaderAllowlist  []string          `json:"responseHeaderAllowlist"`
+	Injections               []Injection       `json:"injections"`
+	LogRatePerSec            int               `json:"logRatePerSec"`
+	ScriptType               string            `json:"scriptType"`
+	Diagnostics              bool              `json:"diagnostics"`
+	HydrationMarker          string            `json:"hydrationMarker"`
+	DropInternalReferrer     bool              `json:"dropInternalReferrer"`
+	ScriptVersionQuery       string            `json:"scriptVersionQuery"`
+	TrackingMethod           string            `json:"trackingMethod"`
+	InjectLoadStrategy       string            `json:"injectLoadStrategy"`
+	EnvWebsiteMap            map[string]string `json:"envWebsiteMap"`
+	EnvHeader                string            `json:"envHeader"`
+	CircuitThreshold         int               `json:"circuitThreshold"`
+	CircuitCooldown          string            `json:"circuitCooldown"`
+	TrackUrlHeader           string            `json:"trackUrlHeader"`
+	OptOutParam              string            `json:"optOutParam"`
+	FirstVisitOnly           bool              `json:"firstVisitOnly"`
+	DNSCacheTTL              string            `json:"dnsCacheTTL"`
+	ReplaceTagSelector       string            `json:"replaceTagSelector"`
+	CorsOrigins              []string          `json:"corsOrigins"`
+	PatchCSP                 bool              `json:"patchCSP"`
+	TrustForwardedFor        bool              `json:"trustForwardedFor"`
+	TrustedProxies           []string          `json:"trustedProxies"`
+	StatusEventMap           map[int]string    `json:"statusEventMap"`
+	ExtractTitle             bool              `json:"extractTitle"`
+	MinInjectBodyBytes       int               `json:"minInjectBodyBytes"`
+	CaptureUTM               bool              `json:"captureUTM"`
+	LogPrefix                string            `json:"logPrefix"`
+	TrackingBatchSize        int               `json:"trackingBatchSize"`
+	TrackingBatchInterval    string            `json:"trackingBatchInterval"`
+	ForceChunkedOutput       bool              `json:"forceChunkedOutput"`
+	UmamiHosts               []string          `json:"umamiHosts"`
+	UmamiHostStrategy        string            `json:"umamiHostStrategy"`
+	StripQueryParams         []string          `json:"stripQueryParams"`
+	InjectErrorPages         bool              `json:"injectErrorPages"`
+	WebsiteIdOutHeader       string            `json:"websiteIdOutHeader"`
+	MaxInjectionsPerResponse int               `json:"maxInjectionsPerResponse"`
+	TrackDownloads           bool              `json:"trackDownloads"`
+	DownloadExtensions       []string          `json:"downloadExtensions"`
+	CollectContentType       string            `json:"collectContentType"`
+	SSTModeByPath            map[string]string `json:"sstModeByPath"`
+	VerifyInjection          bool              `json:"verifyInjection"`
+	GenerateCSPNonce         bool              `json:"generateCSPNonce"`
+	StatsInterval            string            `json:"statsInterval"`
+	TrackNavigationsOnly     bool              `json:"trackNavigationsOnly"`
+	NormalizeReferrer        bool              `json:"normalizeReferrer"`
+	SniffContentType         bool              `json:"sniffContentType"`
+	ForwardTrackingHeaders   []string          `json:"forwardTrackingHeaders"`
+	TrackingHeaderDenylist   []string          `json:"trackingHeaderDenylist"`
+	SkipInjectUserAgents     []string          `json:"skipInjectUserAgents"`
+	SkipUserAgentsTracking   bool              `json:"skipUserAgentsTracking"`
+	StreamThresholdBytes     int               `json:"streamThresholdBytes"`
+	ForwardAllowedPaths      []string          `json:"forwardAllowedPaths"`
+	EventHeader              string            `json:"eventHeader"`
+	InjectPagePathAttr       bool              `json:"injectPagePathAttr"`
+	SyncTracking             bool              `json:"syncTracking"`
+	SyncTrackingTimeout      string            `json:"syncTrackingTimeout"`
+	ReencodeAfterInject      bool              `json:"reencodeAfterInject"`
+	MaxConcurrentInjections  int               `json:"maxConcurrentInjections"`
+	PathEventRules           []PathEventRule   `json:"pathEventRules"`
+	LogLevel                 string            `json:"logLevel"`
+	SPARouteEvent            string            `json:"spaRouteEvent"`
+	LocaleFromHeader         bool              `json:"localeFromHeader"`
+	LocaleFromPath           bool              `json:"localeFromPath"`
+	AnonymizeIP              bool              `json:"anonymizeIP"`
+}
+
+// ConfigIssue is an invalid option found by New.
+type ConfigIssue struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// Injection inserts html before the first match of the anchor regex.
+// An empty html inserts the umami script.
+type Injection struct {
+	Anchor string `json:"anchor"`
+	Html   string `json:"html"`
+}
+
+// PathEventRule tracks requests to paths matching the template, eg.
+// /product/{id}, as the event with the params as event data.
+type PathEventRule struct {
+	Pattern string `json:"pattern"`
+	Event   string `json:"event"`
 }
 
 // CreateConfig creates the default plugin configuration.
 func CreateConfig() *Config {
 	return &Config{
-		ForwardPath:            "_umami",
-		UmamiHost:              "",
-		WebsiteId:              "",
-		AutoTrack:              true,
-		DoNotTrack:             false,
-		Cache:                  false,
-		Domains:                []string{},
-		EvadeGoogleTagManager:  false,
-		ScriptInjection:        true,
-		ScriptInjectionMode:    SIModeTag,
-		ServerSideTracking:     false,
-		ServerSideTrackingMode: SSTModeAll,
+		ForwardPath:              "_umami",
+		UmamiHost:                "",
+		WebsiteId:                "",
+		AutoTrack:                true,
+		DoNotTrack:               false,
+		Cache:                    false,
+		Domains:                  []string{},
+		EvadeGoogleTagManager:    false,
+		ScriptInjection:          true,
+		ScriptInjectionMode:      SIModeTag,
+		ServerSideTracking:       false,
+		ServerSideTrackingMode:   SSTModeAll,
+		PrecompressedFallback:    PCFallbackSkip,
+		InjectMethods:            []string{http.MethodGet},
+		TrackMethods:             []string{http.MethodGet},
+		BeforeSend:               "",
+		BeforeSendScript:         "",
+		ScreenFromHeader:         "",
+		OutboundLinks:            false,
+		ConsentMode:              false,
+		ConsentCookie:            "umami-consent",
+		OnMissingAnchor:          MAModePassthrough,
+		TrackErrorsAsEvents:      false,
+		ForwardCookies:           true,
+		SkipFramedRequests:       false,
+		InjectDeadline:           "",
+		EnvironmentTag:           "",
+		TrackingSinkType:         TSTypeHttp,
+		TrackingSinkPath:         "",
+		HonorNoTransform:         true,
+		ResponseHeaderAllowlist:  []string{},
+		Injections:               []Injection{},
+		LogRatePerSec:            0,
+		ScriptType:               "",
+		Diagnostics:              false,
+		HydrationMarker:          "",
+		DropInternalReferrer:     false,
+		ScriptVersionQuery:       "",
+		TrackingMethod:           http.MethodPost,
+		InjectLoadStrategy:       ILStrategyImmediate,
+		EnvWebsiteMap:            map[string]string{},
+		EnvHeader:                "",
+		CircuitThreshold:         0,
+		CircuitCooldown:          "30s",
+		TrackUrlHeader:           "",
+		OptOutParam:              "",
+		FirstVisitOnly:           false,
+		DNSCacheTTL:              "",
+		ReplaceTagSelector:       "",
+		CorsOrigins:              []string{},
+		PatchCSP:                 false,
+		TrustForwardedFor:        false,
+		TrustedProxies:           []string{},
+		StatusEventMap:           map[int]string{},
+		ExtractTitle:             false,
+		MinInjectBodyBytes:       0,
+		CaptureUTM:               false,
+		LogPrefix:                "",
+		TrackingBatchSize:        0,
+		TrackingBatchInterval:    "5s",
+		ForceChunkedOutput:       false,
+		UmamiHosts:               []string{},
+		UmamiHostStrategy:        UHStrategyFailover,
+		StripQueryParams:         []string{"token", "auth", "session"},
+		InjectErrorPages:         false,
+		WebsiteIdOutHeader:       "",
+		MaxInjectionsPerResponse: 1,
+		TrackDownloads:           false,
+		DownloadExtensions:       []string{"pdf", "zip", "dmg", "exe", "msi", "csv", "docx", "xlsx", "pptx", "mp3", "mp4"},
+		CollectContentType:       "application/json",
+		SSTModeByPath:            map[string]string{},
+		VerifyInjection:          false,
+		GenerateCSPNonce:         false,
+		StatsInterval:            "",
+		TrackNavigationsOnly:     false,
+		NormalizeReferrer:        false,
+		SniffContentType:         true,
+		ForwardTrackingHeaders:   []string{},
+		TrackingHeaderDenylist:   []string{},
+		SkipInjectUserAgents:     []string{},
+		SkipUserAgentsTracking:   false,
+		StreamThresholdBytes:     0,
+		ForwardAllowedPaths:      []string{"script.js", "api/send"},
+		EventHeader:              "",
+		InjectPagePathAttr:       false,
+		SyncTracking:             false,
+		SyncTrackingTimeout:      "5s",
+		ReencodeAfterInject:      true,
+		MaxConcurrentInjections:  0,
+		PathEventRules:           []PathEventRule{},
+		LogLevel:                 "info",
+		SPARouteEvent:            "",
+		LocaleFromHeader:         false,
+		LocaleFromPath:           false,
+		AnonymizeIP:              false,
 	}
 }
 
+// CreateConfigPreset creates the default configuration adjusted by a preset
+// for Go code embedding the plugin, umamiHost and websiteId are left to set.
+func CreateConfigPreset(preset string) (*Config, error) {
+	config := CreateConfig()
+	switch preset {
+	case PresetMinimal:
+	case PresetPrivacy:
+		config.DoNotTrack = true
+		config.ForwardCookies = false
+		config.DropInternalReferrer = true
+		config.AnonymizeIP = true
+		config.ServerSideTracking = false
+	case PresetServerSideOnly:
+		config.ScriptInjection = false
+		config.ServerSideTracking = true
+		config.ServerSideTrackingMode = SSTModeAll
+		config.TrackNavigationsOnly = true
+	default:
+		return nil, fmt.Errorf("unknown config preset %s", preset)
+	}
+	return config, nil
+}
+
 const (
-	SIModeTag          string = "tag"
-	SIModeSource       string = "source"
-	SSTModeAll         string = "all"
-	SSTModeNotinjected string = "notinjected"
+	SIModeTag            string = "tag"
+	SIModeSource         string = "source"
+	SSTModeAll           string = "all"
+	SSTModeNotinjected   string = "notinjected"
+	PCFallbackSkip       string = "skip"
+	PCFallbackClientOnly string = "client-only"
+	PCFallbackSibling    string = "sibling"
+	MAModePassthrough    string = "passthrough"
+	MAModeAppend         string = "append"
+	MAModeWarn           string = "warn"
+	MAModeError          string = "error"
+	TSTypeHttp           string = "http"
+	TSTypeFile           string = "file"
+	STypeModule          string = "module"
+	SVQueryAuto          string = "auto"
+	ILStrategyImmediate  string = "immediate"
+	ILStrategyOnload     string = "onload"
+	ILStrategyIdle       string = "idle"
+	UHStrategyFailover   string = "failover"
+	UHStrategyRoundrobin string = "roundrobin"
+	PresetMinimal        string = "minimal"
+	PresetPrivacy        string = "privacy"
+	PresetServerSideOnly string = "server-side-only"
 )
 
 // PluginHandler a PluginHandler plugin.
 type PluginHandler struct {
-	next          http.Handler
-	name          string
-	config        Config
-	configIsValid bool
-	scriptHtml    string
-	LogHandler    *log.Logger
+	droppedEvents  uint64 // atomic, first for 64-bit alignment on 32-bit platforms
+	counters       statsCounters
+	next           http.Handler
+	name           string
+	config         Config
+	configIsValid  bool
+	configIssues   []ConfigIssue
+	scriptHtml     string
+	envScriptHtml  map[string]string
+	scriptMu       sync.RWMutex
+	injectDeadline time.Duration
+	syncTimeout    time.Duration
+	skipUserAgents []*regexp.Regexp
+	injectSlots    chan struct{} // nil without maxConcurrentInjections
+	injections     []injectionRule
+	pathEvents     []pathEventRule
+	sink           TrackingSink
+	bodyTransform  func([]byte) []byte
+	stats          injectionStats
+	umamiClient    *http.Client
+	umamiHosts     *umamiHostPool
+	circuit        *circuitBreaker
+	logLimiter     *logLimiter
+	LogHandler     *log.Logger
 }
 
 // New created a new Demo plugin.
@@ -76,38 +328,292 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		scriptHtml:    "",
 		LogHandler:    log.New(os.Stdout, "", 0),
 	}
+	if config.LogRatePerSec > 0 {
+		h.logLimiter = &logLimiter{rate: config.LogRatePerSec}
+	}
+
+	// resolve ${ENV_VAR} references, checks below use the resolved config
+	rawConfig := *config
+	h.interpolateEnv()
+	config = &h.config
+
+	// forwardPath may be configured with slashes, eg. /_umami/
+	h.config.ForwardPath = strings.Trim(h.config.ForwardPath, "/")
+
+	// check if logLevel is valid
+	if _, ok := logLevels[config.LogLevel]; !ok {
+		h.addConfigIssue("logLevel", "is not valid")
+		h.config.LogLevel = "info"
+	}
 
 	// check if the umami host is set
-	if config.UmamiHost == "" {
-		h.log("umamiHost is not set!")
-		h.configIsValid = false
+	if len(umamiHostList(config)) == 0 {
+		h.addConfigIssue("umamiHost", "is not set")
+	}
+	// check if umamiHostStrategy is valid
+	if config.UmamiHostStrategy != UHStrategyFailover && config.UmamiHostStrategy != UHStrategyRoundrobin {
+		h.addConfigIssue("umamiHostStrategy", "is not valid")
 	}
+	h.umamiHosts = newUmamiHostPool(config)
 	// check if the website id is set
 	if config.WebsiteId == "" {
-		h.log("websiteId is not set!")
-		h.configIsValid = false
+		h.addConfigIssue("websiteId", "is not set")
 	}
 	// check if scriptInjectionMode is valid
-	if config.ScriptInjectionMode != SIModeTag && config.ScriptInjectionMode != SIModeSource {
-		h.log("scriptInjectionMode is not valid!")
+	if config.ScriptInjection && config.ScriptInjectionMode != SIModeTag && config.ScriptInjectionMode != SIModeSource {
+		h.addConfigIssue("scriptInjectionMode", "is not valid")
 		h.config.ScriptInjection = false
-		h.configIsValid = false
 	}
 	// check if serverSideTrackingMode is valid
-	if config.ServerSideTrackingMode != SSTModeAll && config.ServerSideTrackingMode != SSTModeNotinjected {
-		h.log("serverSideTrackingMode is not valid!")
+	if config.ServerSideTracking && config.ServerSideTrackingMode != SSTModeAll && config.ServerSideTrackingMode != SSTModeNotinjected {
+		h.addConfigIssue("serverSideTrackingMode", "is not valid")
+		h.config.ServerSideTracking = false
+	}
+	// check if the sstModeByPath modes are valid
+	for prefix, mode := range config.SSTModeByPath {
+		if mode != SSTModeAll && mode != SSTModeNotinjected {
+			h.addConfigIssue("sstModeByPath", fmt.Sprintf("mode of %s is not valid", prefix))
+			h.config.ServerSideTracking = false
+		}
+	}
+	// check if precompressedFallback is valid
+	if config.PrecompressedFallback != PCFallbackSkip && config.PrecompressedFallback != PCFallbackClientOnly && config.PrecompressedFallback != PCFallbackSibling {
+		h.addConfigIssue("precompressedFallback", "is not valid")
+	}
+	// check if onMissingAnchor is valid
+	switch config.OnMissingAnchor {
+	case MAModePassthrough, MAModeAppend, MAModeWarn, MAModeError:
+	default:
+		h.addConfigIssue("onMissingAnchor", "is not valid")
+	}
+
+	// check if injectDeadline is a valid duration
+	if config.InjectDeadline != "" {
+		injectDeadline, err := time.ParseDuration(config.InjectDeadline)
+		if err != nil || injectDeadline <= 0 {
+			h.addConfigIssue("injectDeadline", "is not valid")
+		}
+		h.injectDeadline = injectDeadline
+	}
+
+	// check if trackingSinkType is valid
+	if config.ServerSideTracking && config.TrackingSinkType != TSTypeHttp && config.TrackingSinkType != TSTypeFile {
+		h.addConfigIssue("trackingSinkType", "is not valid")
+		h.config.ServerSideTracking = false
+	}
+	// check if the file sink has a path
+	if config.ServerSideTracking && config.TrackingSinkType == TSTypeFile && config.TrackingSinkPath == "" {
+		h.addConfigIssue("trackingSinkPath", "is not set")
+		h.config.ServerSideTracking = false
+	}
+	// check if trackingMethod is valid
+	if config.ServerSideTracking && config.TrackingMethod != http.MethodPost && config.TrackingMethod != http.MethodGet {
+		h.addConfigIssue("trackingMethod", "is not valid")
 		h.config.ServerSideTracking = false
-		h.configIsValid = false
+	}
+	// check if collectContentType is valid
+	if config.ServerSideTracking && config.TrackingMethod == http.MethodPost {
+		if _, _, err := mime.ParseMediaType(config.CollectContentType); err != nil {
+			h.addConfigIssue("collectContentType", "is not valid")
+			h.config.ServerSideTracking = false
+		}
+	}
+	// check if circuitCooldown is valid
+	if config.CircuitThreshold > 0 {
+		circuitCooldown, err := time.ParseDuration(config.CircuitCooldown)
+		if err != nil || circuitCooldown <= 0 {
+			h.addConfigIssue("circuitCooldown", "is not valid")
+		} else {
+			h.circuit = &circuitBreaker{threshold: config.CircuitThreshold, cooldown: circuitCooldown}
+		}
+	}
+	// check if syncTrackingTimeout is valid
+	if config.SyncTracking {
+		syncTimeout, err := time.ParseDuration(config.SyncTrackingTimeout)
+		if err != nil || syncTimeout <= 0 {
+			h.addConfigIssue("syncTrackingTimeout", "is not valid")
+			h.config.SyncTracking = false
+		}
+		h.syncTimeout = syncTimeout
+	}
+	// check if dnsCacheTTL is valid
+	h.umamiClient = &http.Client{}
+	if config.DNSCacheTTL != "" {
+		dnsCacheTTL, err := time.ParseDuration(config.DNSCacheTTL)
+		if err != nil || dnsCacheTTL <= 0 {
+			h.addConfigIssue("dnsCacheTTL", "is not valid")
+		} else {
+			h.umamiClient.Transport = newDNSCacheTransport(newDNSCache(dnsCacheTTL))
+		}
+	}
+	h.sink = newTrackingSink(&h.config, h.umamiClient, h.umamiHosts, h.circuit, h.dropTrackingEvent)
+	fileSink, _ := h.sink.(*FileSink)
+
+	// check if trackingBatchInterval is valid
+	var batching *batchingSink
+	if config.TrackingBatchSize > 1 {
+		batchInterval, err := time.ParseDuration(config.TrackingBatchInterval)
+		if err != nil || batchInterval <= 0 {
+			h.addConfigIssue("trackingBatchInterval", "is not valid")
+		} else {
+			batching = &batchingSink{inner: h.sink, size: config.TrackingBatchSize, interval: batchInterval, onError: h.dropTrackingEvent}
+			h.sink = batching
+		}
+	}
+	if fileSink != nil || batching != nil {
+		// the file stays open while the middleware lives
+		// the pending batch is flushed into it before it is closed
+		go func() {
+			<-ctx.Done()
+			if batching != nil {
+				batching.close()
+			}
+			if fileSink != nil {
+				fileSink.Close()
+			}
+		}()
+	}
+
+	// check if statsInterval is valid
+	var statsInterval time.Duration
+	if config.StatsInterval != "" {
+		interval, err := time.ParseDuration(config.StatsInterval)
+		if err != nil || interval <= 0 {
+			h.addConfigIssue("statsInterval", "is not valid")
+		} else {
+			statsInterval = interval
+		}
+	}
+
+	// check if scriptType is valid
+	if config.ScriptType != "" && config.ScriptType != STypeModule {
+		h.addConfigIssue("scriptType", "is not valid")
+		h.config.ScriptInjection = false
+	}
+
+	// check if the env header is set for the env website ids
+	if len(config.EnvWebsiteMap) > 0 && config.EnvHeader == "" {
+		h.addConfigIssue("envHeader", "is not set")
+	}
+
+	// check if injectLoadStrategy is valid
+	if config.InjectLoadStrategy != ILStrategyImmediate && config.InjectLoadStrategy != ILStrategyOnload && config.InjectLoadStrategy != ILStrategyIdle {
+		h.addConfigIssue("injectLoadStrategy", "is not valid")
+		h.config.ScriptInjection = false
+	}
+
+	// check if scriptVersionQuery is valid
+	if config.ScriptVersionQuery != "" && !tokenRegex.MatchString(config.ScriptVersionQuery) {
+		h.addConfigIssue("scriptVersionQuery", "is not valid")
+		h.config.ScriptInjection = false
+	}
+
+	// check if beforeSend is a valid function name
+	if config.BeforeSend != "" && !jsIdentifierRegex.MatchString(config.BeforeSend) {
+		h.addConfigIssue("beforeSend", "is not a valid function name")
+		h.config.ScriptInjection = false
+	}
+
+	// check if consentCookie is a valid cookie name
+	if config.ConsentMode && !tokenRegex.MatchString(config.ConsentCookie) {
+		h.addConfigIssue("consentCookie", "is not a valid cookie name")
+		h.config.ScriptInjection = false
+	}
+
+	// check if optOutParam is valid, it names the cookie as well
+	if config.OptOutParam != "" && !tokenRegex.MatchString(config.OptOutParam) {
+		h.addConfigIssue("optOutParam", "is not valid")
+	}
+
+	// check if the download extensions are valid
+	if config.TrackDownloads {
+		for _, extension := range config.DownloadExtensions {
+			if !tokenRegex.MatchString(extension) {
+				h.addConfigIssue("downloadExtensions", fmt.Sprintf("entry %s is not valid", extension))
+				h.config.TrackDownloads = false
+			}
+		}
+	}
+
+	// check if spaRouteEvent is safe in the helper
+	if config.SPARouteEvent != "" && !attributeNameRegex.MatchString(config.SPARouteEvent) {
+		h.addConfigIssue("spaRouteEvent", "is not valid")
+	}
+
+	// check if the trusted proxies are valid
+	for _, proxy := range config.TrustedProxies {
+		if _, err := parseTrustedProxy(proxy); err != nil {
+			h.addConfigIssue("trustedProxies", fmt.Sprintf("entry %s is not a valid CIDR", proxy))
+		}
+	}
+
+	// check if environmentTag is valid
+	if config.EnvironmentTag != "" && !tokenRegex.MatchString(config.EnvironmentTag) {
+		h.addConfigIssue("environmentTag", "is not valid")
+	}
+
+	// check if replaceTagSelector is an attribute name
+	if config.ReplaceTagSelector != "" && !attributeNameRegex.MatchString(config.ReplaceTagSelector) {
+		h.addConfigIssue("replaceTagSelector", "is not a valid attribute name")
+		h.config.ScriptInjection = false
+	}
+
+	// check if streamThresholdBytes is valid
+	if config.StreamThresholdBytes < 0 {
+		h.addConfigIssue("streamThresholdBytes", "is not valid")
+		h.config.StreamThresholdBytes = 0
+	}
+
+	// check if maxInjectionsPerResponse is valid
+	if config.MaxInjectionsPerResponse < 1 {
+		h.addConfigIssue("maxInjectionsPerResponse", "is not valid")
+		h.config.ScriptInjection = false
+	}
+
+	// compile the path event templates
+	for _, rule := range config.PathEventRules {
+		pathEvent, err := compilePathEventRule(rule)
+		if err != nil {
+			h.addConfigIssue("pathEventRules", fmt.Sprintf("entry %s is not valid: %s", rule.Pattern, err.Error()))
+			continue
+		}
+		h.pathEvents = append(h.pathEvents, pathEvent)
+	}
+
+	// check if maxConcurrentInjections is valid
+	if config.MaxConcurrentInjections < 0 {
+		h.addConfigIssue("maxConcurrentInjections", "is not valid")
+	} else if config.MaxConcurrentInjections > 0 {
+		h.injectSlots = make(chan struct{}, config.MaxConcurrentInjections)
+	}
+
+	// compile the user agents skipped by injection
+	for _, pattern := range config.SkipInjectUserAgents {
+		userAgent, err := regexp.Compile("(?i)" + pattern)
+		if err != nil {
+			h.addConfigIssue("skipInjectUserAgents", fmt.Sprintf("entry %s is not valid: %s", pattern, err.Error()))
+			h.config.ScriptInjection = false
+			continue
+		}
+		h.skipUserAgents = append(h.skipUserAgents, userAgent)
 	}
 
+	// compile the injection anchors
+	injections, err := buildInjectionRules(config)
+	if err != nil {
+		h.addConfigIssue("injections", fmt.Sprintf("are not valid: %s", err.Error()))
+		h.config.ScriptInjection = false
+	}
+	h.injections = injections
+
 	// build script html
-	scriptHtml, err := buildUmamiScript(&h.config)
-	h.scriptHtml = scriptHtml
+	err = h.rebuildScript()
 	if err != nil {
 		return nil, err
 	}
+	scriptHtml := h.getScriptHtml()
 
-	configJSON, _ := json.Marshal(config)
+	configJSON, _ := json.Marshal(loggedConfig(config, &rawConfig))
 	h.log(fmt.Sprintf("config: %s", configJSON))
 	if config.ScriptInjection {
 		h.log(fmt.Sprintf("script: %s", scriptHtml))
@@ -115,21 +621,308 @@ func New(ctx context.Context, next http.Handler, config *Config, name string) (h
 		h.log("script: scriptInjection is false")
 	}
 
+	// stops with the middleware
+	if statsInterval > 0 {
+		go h.logStatsPeriodically(ctx, statsInterval)
+	}
+
+	// once, requests are passed through silently then
+	if !h.configIsValid {
+		h.logWithLevel("error", fmt.Sprintf("config has %d issues, passing all requests through: %s", len(h.configIssues), summarizeConfigIssues(h.configIssues)))
+	}
+
 	return h, nil
 }
 
+// Wrap wraps next with the plugin outside of traefik, eg. in a test main.
+// A nil config uses the defaults, if New fails next is returned unchanged.
+func Wrap(next http.Handler, config *Config) http.Handler {
+	if config == nil {
+		config = CreateConfig()
+	}
+	h, err := New(context.Background(), next, config, "")
+	if err != nil {
+		(&PluginHandler{LogHandler: log.New(os.Stdout, "", 0)}).log(err.Error())
+		return next
+	}
+	return h
+}
+
+// rebuilds the script html from the config, one per env website id
+// safe to call while requests are being served.
+func (h *PluginHandler) rebuildScript() error {
+	scriptHtml, err := buildUmamiScript(&h.config)
+	if err != nil {
+		return err
+	}
+	envScriptHtml := make(map[string]string, len(h.config.EnvWebsiteMap))
+	for env, websiteId := range h.config.EnvWebsiteMap {
+		envConfig := h.config
+		envConfig.WebsiteId = websiteId
+		envScriptHtml[env], err = buildUmamiScript(&envConfig)
+		if err != nil {
+			return err
+		}
+	}
+	h.scriptMu.Lock()
+	h.scriptHtml = scriptHtml
+	h.envScriptHtml = envScriptHtml
+	h.scriptMu.Unlock()
+	return nil
+}
+
+func (h *PluginHandler) getScriptHtml() string {
+	h.scriptMu.RLock()
+	defer h.scriptMu.RUnlock()
+	return h.scriptHtml
+}
+
+// the script html for the website id selected by the env header.
+func (h *PluginHandler) getScriptHtmlFor(req *http.Request) string {
+	if h.config.EnvHeader != "" {
+		h.scriptMu.RLock()
+		scriptHtml, ok := h.envScriptHtml[req.Header.Get(h.config.EnvHeader)]
+		h.scriptMu.RUnlock()
+		if ok {
+			return scriptHtml
+		}
+	}
+	return h.getScriptHtml()
+}
+
+const envRefPattern = `\$\{([A-Za-z_][A-Za-z0-9_]*)\}`
+
+var envRefRegexp = regexp.MustCompile(envRefPattern)
+
+// replaces ${ENV_VAR} references in the string options with the env value
+// unset variables are left as they are and logged.
+func (h *PluginHandler) interpolateEnv() {
+	// a copy, the config passed to New keeps its references
+	h.config.UmamiHosts = append([]string{}, h.config.UmamiHosts...)
+	for _, field := range envFields(&h.config) {
+		*field = envRefRegexp.ReplaceAllStringFunc(*field, func(ref string) string {
+			name := envRefRegexp.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				h.warn(fmt.Sprintf("env variable %s is not set!", name))
+				return ref
+			}
+			return value
+		})
+	}
+}
+
+// the string options of the config that may reference env variables.
+func envFields(config *Config) []*string {
+	fields := []*string{
+		&config.ForwardPath,
+		&config.UmamiHost,
+		&config.WebsiteId,
+		&config.ScriptInjectionMode,
+		&config.ServerSideTrackingMode,
+		&config.PrecompressedFallback,
+		&config.BeforeSend,
+		&config.BeforeSendScript,
+		&config.ScreenFromHeader,
+		&config.ConsentCookie,
+		&config.OnMissingAnchor,
+		&config.InjectDeadline,
+		&config.EnvironmentTag,
+		&config.TrackingSinkType,
+		&config.TrackingSinkPath,
+		&config.ScriptType,
+		&config.HydrationMarker,
+		&config.ScriptVersionQuery,
+		&config.TrackingMethod,
+		&config.InjectLoadStrategy,
+		&config.EnvHeader,
+		&config.CircuitCooldown,
+		&config.TrackUrlHeader,
+		&config.DNSCacheTTL,
+		&config.TrackingBatchInterval,
+		&config.ReplaceTagSelector,
+		&config.OptOutParam,
+		&config.UmamiHostStrategy,
+		&config.WebsiteIdOutHeader,
+		&config.CollectContentType,
+		&config.StatsInterval,
+		&config.EventHeader,
+		&config.SyncTrackingTimeout,
+		&config.LogLevel,
+		&config.SPARouteEvent,
+		&config.LogPrefix,
+	}
+	for i := range config.UmamiHosts {
+		fields = append(fields, &config.UmamiHosts[i])
+	}
+	return fields
+}
+
+// the config to log, options referencing env variables are logged with the
+// references rather than the values, which may be secrets.
+func loggedConfig(config *Config, raw *Config) *Config {
+	logged := *config
+	logged.UmamiHosts = append([]string{}, config.UmamiHosts...)
+	loggedFields, rawFields := envFields(&logged), envFields(raw)
+	for i := 0; i < len(loggedFields) && i < len(rawFields); i++ {
+		if envRefRegexp.MatchString(*rawFields[i]) {
+			*loggedFields[i] = *rawFields[i]
+		}
+	}
+	return &logged
+}
+
+// logs and records an invalid option, requests are passed through then.
+func (h *PluginHandler) addConfigIssue(field string, message string) {
+	h.log(fmt.Sprintf("%s %s!", field, message))
+	h.configIssues = append(h.configIssues, ConfigIssue{Field: field, Message: message})
+	h.configIsValid = false
+}
+
+// the issues as field message pairs, eg. for the startup error.
+func summarizeConfigIssues(issues []ConfigIssue) string {
+	summary := make([]string, 0, len(issues))
+	for _, issue := range issues {
+		summary = append(summary, fmt.Sprintf("%s %s", issue.Field, issue.Message))
+	}
+	return strings.Join(summary, "; ")
+}
+
+// the logLevel values, messages below the configured one are dropped.
+var logLevels = map[string]int{
+	"debug":   0,
+	"info":    1,
+	"warning": 2,
+	"error":   3,
+}
+
+func (h *PluginHandler) debug(message string) {
+	h.logWithLevel("debug", message)
+}
+
 func (h *PluginHandler) log(message string) {
-	level := "info" // default to info
-	time := time.Now().Format("2006-01-02T15:04:05Z")
+	h.logWithLevel("info", message)
+}
+
+func (h *PluginHandler) warn(message string) {
+	h.logWithLevel("warning", message)
+}
+
+func (h *PluginHandler) logWithLevel(level string, message string) {
+	// an invalid logLevel is replaced by info once it is checked
+	if minLevel, ok := logLevels[h.config.LogLevel]; ok && logLevels[level] < minLevel {
+		return
+	}
+	now := time.Now()
+	if h.logLimiter != nil {
+		allowed, suppressed := h.logLimiter.allow(now)
+		if suppressed > 0 {
+			h.writeLog(now, "info", fmt.Sprintf("suppressed %d log messages above logRatePerSec", suppressed))
+		}
+		if !allowed {
+			return
+		}
+	}
+	h.writeLog(now, level, message)
+}
+
+// the logPrefix, by default the plugin and middleware name
+// eg. traefik-umami-plugin:umami@docker.
+func (h *PluginHandler) getLogPrefix() string {
+	if h.config.LogPrefix != "" {
+		return h.config.LogPrefix
+	}
+	if h.name != "" {
+		return "traefik-umami-plugin:" + h.name
+	}
+	return "traefik-umami-plugin"
+}
+
+func (h *PluginHandler) writeLog(now time.Time, level string, message string) {
+	time := now.Format("2006-01-02T15:04:05Z")
 
 	if h.LogHandler != nil {
-		h.LogHandler.Println(fmt.Sprintf("time=\"%s\" level=%s msg=\"[traefik-umami-plugin] %s\"", time, level, message))
+		h.LogHandler.Println(fmt.Sprintf("time=\"%s\" level=%s msg=\"[%s] %s\"", time, level, h.getLogPrefix(), message))
 	}
 }
 
+// limits log messages to rate per second
+// messages above it are counted to be summarized in the next second.
+type logLimiter struct {
+	mu          sync.Mutex
+	rate        int
+	windowStart time.Time
+	emitted     int
+	suppressed  int
+}
+
+// reports if a message may be logged now
+// and how many were suppressed in the elapsed window, if it just ended.
+func (l *logLimiter) allow(now time.Time) (bool, int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	var suppressed int
+	if now.Sub(l.windowStart) >= time.Second {
+		suppressed = l.suppressed
+		l.windowStart = now
+		l.emitted = 0
+		l.suppressed = 0
+	}
+	if l.emitted >= l.rate {
+		l.suppressed++
+		return false, suppressed
+	}
+	l.emitted++
+	return true, suppressed
+}
+
+// contextKey keeps the context keys of the plugin apart from others.
+type contextKey string
+
+// DisableKey disables the plugin for requests whose context has it set to
+// true, eg. by a middleware of Go code embedding the plugin.
+const DisableKey contextKey = "traefik-umami-plugin-disable"
+
 func (h *PluginHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	// disabled for this request by the embedding code
+	if disabled, _ := req.Context().Value(DisableKey).(bool); disabled {
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+	atomic.AddUint64(&h.counters.requests, 1)
+
+	// health checks assert the config validity, so it is served regardless
+	if isDiagnosticsPath(req, &h.config, "config") {
+		h.serveConfigIssues(rw, req)
+		return
+	}
+
 	// check if config is valid
 	if !h.configIsValid {
+		h.debug(fmt.Sprintf("config is invalid, passing %s through", req.URL.EscapedPath()))
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// diagnostics
+	if isDiagnosticsPath(req, &h.config, "test-inject") {
+		h.serveTestInject(rw, req)
+		return
+	}
+	if isDiagnosticsPath(req, &h.config, "stats") {
+		h.serveStats(rw, req)
+		return
+	}
+
+	// requests sent to umami by the plugin itself came back through traefik
+	// umami's own pages are never injected or tracked, and never forwarded again
+	if req.Header.Get(umamiForwardedHeader) != "" {
+		if isForward, _ := isUmamiForwardPath(req, &h.config); isForward {
+			h.warn("umamiHost routes back to the plugin, check the umamiHost")
+			rw.WriteHeader(http.StatusLoopDetected)
+			return
+		}
 		h.next.ServeHTTP(rw, req)
 		return
 	}
@@ -142,92 +935,629 @@ func (h *PluginHandler) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	// script injection
-	var injected bool = false
-	if h.config.ScriptInjection {
-		// Skip script injection for HTMX requests
-		if req.Header.Get("HX-Request") == "true" {
-			h.next.ServeHTTP(rw, req)
-			return
-		}
+	// previews opted out via ?<optOutParam>=off are neither injected nor tracked
+	if h.config.OptOutParam != "" && isOptedOut(rw, req, h.config.OptOutParam) {
+		h.next.ServeHTTP(rw, req)
+		return
+	}
+
+	// upgrades (eg. websockets) need the original writer, never buffer them
+	if isUpgradeRequest(req) {
+		h.next.ServeHTTP(rw, req)
+		return
+	}
 
-		if !strings.Contains(req.Header.Get("Accept"), "text/html") {
-        	h.next.ServeHTTP(rw, req)
-        	return
-    	}
+	// ask the browser to send the screen client hint
+	if h.config.ServerSideTracking && h.config.ScreenFromHeader != "" {
+		rw.Header().Add("Accept-CH", h.config.ScreenFromHeader)
+	}
 
+	// script injection
+	var injected bool = false
+	var written bool = false
+	var status int = http.StatusOK
+	var resHeader http.Header = rw.Header()
+	var title string
+	var event responseEvent
+	if shouldInjectScript(req, &h.config) && !h.isSkippedUserAgent(req) && h.acquireInjectSlot(req) {
+		defer h.releaseInjectSlot()
 		// intercept body
 		myrw := &responseWriter{
+			header:         http.Header{},
 			buffer:         &bytes.Buffer{},
 			ResponseWriter: rw,
 			statusCode:     200, // default status code
 			headerWritten:  false,
+			eventHeader:    h.config.EventHeader,
+		}
+		// body transforms need the whole body
+		if h.config.StreamThresholdBytes > 0 && h.bodyTransform == nil {
+			myrw.threshold = h.config.StreamThresholdBytes
+			myrw.onThreshold = func() error {
+				return h.streamAtThreshold(rw, req, myrw)
+			}
+		}
+		if h.injectDeadline > 0 {
+			// only used to time the injection, next keeps the request context
+			ctx, cancel := context.WithTimeout(req.Context(), h.injectDeadline)
+			defer cancel()
+			myrw.ctx = ctx
 		}
-		myrw.Header().Set("Accept-Encoding", "identity")
+		// ask the upstream for a body the anchor can be found in
+		req.Header.Set("Accept-Encoding", decodableAcceptEncoding(req.Header.Get("Accept-Encoding")))
 		h.next.ServeHTTP(myrw, req)
+		// headers set without writing anything
+		myrw.takeEvent()
 
-		if strings.HasPrefix(myrw.Header().Get("Content-Type"), "text/html") {
-			origBytes := myrw.buffer.Bytes()
-			newBytes := regexReplaceSingle(origBytes, insertBeforeRegex, h.scriptHtml)
-			
-			if !bytes.Equal(origBytes, newBytes) {
-				// Copy headers from intercepted response to actual response
-				for key, values := range myrw.Header() {
-					// Skip Content-Length as we'll set it manually
-					if strings.ToLower(key) != "content-length" {
-						for _, value := range values {
-							rw.Header().Add(key, value)
-						}
-					}
-				}
-				
-				// Set the correct Content-Length for the modified content
-				rw.Header().Set("Content-Length", strconv.Itoa(len(newBytes)))
-				
-				// Write status code
-				rw.WriteHeader(myrw.statusCode)
-				
-				// Write the modified content
-				_, err := rw.Write(newBytes)
-				if err != nil {
-					h.log(err.Error())
-				}
-				injected = true
+		// handlers relying on net/http to sniff the type of the body, a nil
+		// Content-Type suppresses the sniffing like in net/http
+		if _, hasType := myrw.Header()["Content-Type"]; !hasType && h.config.SniffContentType && contentEncoding(myrw.Header()) == "" && myrw.buffer.Len() > 0 {
+			myrw.Header().Set("Content-Type", http.DetectContentType(myrw.buffer.Bytes()))
+		}
+
+		// 204/304 and empty bodies have nothing to inject into, they are passed
+		// through as they are, regardless of onMissingAnchor
+		// error pages only with injectErrorPages
+		isHtml := strings.HasPrefix(myrw.Header().Get("Content-Type"), "text/html") && statusHasBody(myrw.statusCode) && myrw.buffer.Len() > 0 &&
+			(myrw.statusCode < 400 || h.config.InjectErrorPages)
+		if myrw.thresholdHit {
+			written = true
+			injected = myrw.streamInjected
+		} else if myrw.bypassed {
+			written = true
+		} else if myrw.streaming {
+			h.warn(fmt.Sprintf("injectDeadline exceeded while buffering %s, streamed it through", req.URL.EscapedPath()))
+			written = true
+		} else if isHtml && myrw.deadlineExceeded() {
+			h.warn(fmt.Sprintf("injectDeadline exceeded for %s, passing it through", req.URL.EscapedPath()))
+		} else if isHtml && h.config.HonorNoTransform && hasNoTransform(myrw.Header()) {
+			h.log(fmt.Sprintf("%s is marked no-transform, skipping injection", req.URL.EscapedPath()))
+		} else if isHtml && isPrecompressed(myrw.Header()) && h.config.PrecompressedFallback == PCFallbackSibling && req.Method == http.MethodGet {
+			// otherwise passed through like skip
+			injected, written = h.injectSibling(rw, req)
+		} else if isHtml && isPrecompressed(myrw.Header()) {
+			// the anchor can't be found in an undecodable body, pass it through as is
+			// client-only assumes the page ships its own umami script
+			injected = h.config.PrecompressedFallback == PCFallbackClientOnly
+		} else if isHtml && hasContentLengthMismatch(myrw.Header(), myrw.buffer.Len()) {
+			// truncated or overlong upstream, don't paper over it with a new length
+			h.warn(fmt.Sprintf("body of %s does not match its Content-Length, passing it through", req.URL.EscapedPath()))
+		} else if isHtml {
+			injected, written = h.writeInjected(rw, req, myrw)
+		}
+
+		if isHtml {
+			// client-only responses weren't injected by the plugin
+			h.stats.record(time.Now(), injected && written)
+			h.counters.recordHtml(injected && written)
+		}
+
+		// everything not injected is passed through as it was intercepted
+		if !written {
+			err := myrw.passThrough()
+			if err != nil {
+				h.log(err.Error())
 			}
+			written = true
+		}
+		status = myrw.statusCode
+		event = myrw.event
+		// before responseHeaderAllowlist dropped any
+		resHeader = myrw.Header()
+		if isHtml && h.config.ExtractTitle && h.config.ServerSideTracking {
+			title = extractTitle(myrw.Header(), myrw.buffer.Bytes())
+		}
+	}
+
+	if !written {
+		// h.log(fmt.Sprintf("Continue %s", req.URL.EscapedPath()))
+		if h.config.ServerSideTracking || h.config.EventHeader != "" {
+			// capture the status and event for server side tracking
+			statusRw := &statusWriter{ResponseWriter: rw, statusCode: http.StatusOK, eventHeader: h.config.EventHeader}
+			h.next.ServeHTTP(statusRw, req)
+			statusRw.takeEvent()
+			status = statusRw.statusCode
+			event = statusRw.event
+		} else {
+			h.next.ServeHTTP(rw, req)
 		}
 	}
 
 	// server side tracking
 	shouldServerSideTrack := shouldServerSideTrack(req, &h.config, injected, h)
-	if shouldServerSideTrack {
+	// events set by the upstream are tracked even if the request itself isn't
+	hasEvent := event.name != "" && hostnameInDomains(req, h.config.Domains)
+	if shouldServerSideTrack || hasEvent {
 		// h.log(fmt.Sprintf("Track %s", req.URL.EscapedPath()))
-		go buildAndSendTrackingRequest(req, &h.config)
+		res := trackedResponse{status: status, title: title, event: event.name, locale: responseLocale(req, resHeader, &h.config)}
+		// events of the response take precedence
+		if res.event == "" && shouldServerSideTrack {
+			res.event, res.eventData = h.matchPathEvent(req)
+		}
+		if event.data != "" {
+			err := json.Unmarshal([]byte(event.data), &res.eventData)
+			if err != nil {
+				h.warn(fmt.Sprintf("%s-Data of %s is not a JSON object, tracking the event without it", h.config.EventHeader, req.URL.EscapedPath()))
+			}
+		}
+		if h.config.TrackUrlHeader != "" {
+			res.header = resHeader
+		}
+		// built now, the request can't be read once ServeHTTP returned
+		trackingEvent, ok := h.buildTrackingEvent(req, res)
+		if !ok {
+			return
+		}
+		if h.config.SyncTracking {
+			h.trackWithin(trackingEvent, h.syncTimeout)
+		} else {
+			go h.trackInBackground(trackingEvent)
+		}
 	}
+}
 
-	if !injected {
-		// h.log(fmt.Sprintf("Continue %s", req.URL.EscapedPath()))
-		h.next.ServeHTTP(rw, req)
+// copies the headers of an intercepted response onto the injected one
+// without Content-Length and hop-by-hop headers, restricted to the allowlist if set.
+func copyInjectedHeaders(dst, src http.Header, allowlist []string) {
+	headers := src.Clone()
+	removeHeaders(headers, hopHeaders...)
+	// upstreams may set it bypassing the canonical key, even empty
+	removeHeadersFold(headers, "Content-Length")
+	if len(allowlist) > 0 {
+		allowed := http.Header{}
+		for _, name := range allowlist {
+			for _, value := range headers.Values(name) {
+				allowed.Add(name, value)
+			}
+		}
+		headers = allowed
+	}
+	copyHeaders(dst, headers)
+}
+
+// check if the user agent matches one of the skipInjectUserAgents.
+func (h *PluginHandler) isSkippedUserAgent(req *http.Request) bool {
+	userAgent := req.UserAgent()
+	for _, skipped := range h.skipUserAgents {
+		if skipped.MatchString(userAgent) {
+			return true
+		}
+	}
+	return false
+}
+
+// takes one of the maxConcurrentInjections slots without waiting
+// requests finding none are passed through rather than buffered.
+func (h *PluginHandler) acquireInjectSlot(req *http.Request) bool {
+	if h.injectSlots == nil {
+		return true
+	}
+	select {
+	case h.injectSlots <- struct{}{}:
+		return true
+	default:
+		h.warn(fmt.Sprintf("maxConcurrentInjections reached, passing %s through", req.URL.EscapedPath()))
+		return false
+	}
+}
+
+func (h *PluginHandler) releaseInjectSlot() {
+	if h.injectSlots != nil {
+		<-h.injectSlots
+	}
+}
+
+// removes the headers whatever the case of their keys.
+func removeHeadersFold(headers http.Header, names ...string) {
+	for key := range headers {
+		for _, name := range names {
+			if strings.EqualFold(key, name) {
+				delete(headers, key)
+			}
+		}
+	}
+}
+
+// check if the request opted out of analytics
+// ?<param>=off sets a session cookie keeping the following requests opted
+// out, ?<param>=on removes it again.
+func isOptedOut(rw http.ResponseWriter, req *http.Request, param string) bool {
+	switch req.URL.Query().Get(param) {
+	case "off":
+		http.SetCookie(rw, &http.Cookie{Name: param, Value: "off", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		return true
+	case "on":
+		http.SetCookie(rw, &http.Cookie{Name: param, Value: "", Path: "/", MaxAge: -1, HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		return false
+	}
+	cookie, err := req.Cookie(param)
+	return err == nil && cookie.Value == "off"
+}
+
+// check if the request asks for a protocol upgrade
+// eg. Connection: Upgrade and Upgrade: websocket.
+func isUpgradeRequest(req *http.Request) bool {
+	if req.Header.Get("Upgrade") == "" {
+		return false
 	}
+	for _, value := range req.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SetBodyTransform sets a transform applied to every decoded HTML body
+// after the script was injected, eg. to add meta tags.
+// Meant for Go code embedding the plugin, call it before serving requests.
+func (h *PluginHandler) SetBodyTransform(transform func([]byte) []byte) {
+	h.bodyTransform = transform
+}
+
+// requests the uncompressed sibling of a precompressed page (eg. index.html
+// next to index.html.br) from next again and injects into it
+// returns like writeInjected, nothing is written if there is no sibling.
+func (h *PluginHandler) injectSibling(rw http.ResponseWriter, req *http.Request) (bool, bool) {
+	siblingReq := req.Clone(req.Context())
+	siblingReq.Header.Set("Accept-Encoding", "identity")
+	sibling := &responseWriter{
+		header:         http.Header{},
+		buffer:         &bytes.Buffer{},
+		ResponseWriter: rw,
+		statusCode:     200, // default status code
+		eventHeader:    h.config.EventHeader,
+	}
+	h.next.ServeHTTP(sibling, siblingReq)
+	if sibling.streaming || !strings.HasPrefix(sibling.Header().Get("Content-Type"), "text/html") ||
+		sibling.statusCode < 200 || sibling.statusCode >= 300 || sibling.buffer.Len() == 0 || contentEncoding(sibling.Header()) != "" {
+		h.log(fmt.Sprintf("no uncompressed sibling of %s, passing it through", req.URL.EscapedPath()))
+		return false, false
+	}
+	return h.writeInjected(rw, req, sibling)
+}
+
+// injects into the intercepted html and writes it to rw
+// encoded bodies are decoded before and re-encoded after the injection
+// returns whether the injected body was written and whether anything was
+// written at all, only unwritten responses can still be passed through.
+func (h *PluginHandler) writeInjected(rw http.ResponseWriter, req *http.Request, myrw *responseWriter) (bool, bool) {
+	encoding := contentEncoding(myrw.Header())
+	origBytes, err := decodeBody(encoding, myrw.buffer.Bytes())
+	if err != nil {
+		h.warn(fmt.Sprintf("could not decode %s body of %s: %s", encoding, req.URL.EscapedPath(), err.Error()))
+		return false, false
+	}
+	// stubs like redirect or error bodies aren't real pageviews
+	if len(origBytes) < h.config.MinInjectBodyBytes {
+		return false, false
+	}
+
+	scriptHtml, err := h.responseScriptHtml(req, myrw.Header())
+	if err != nil {
+		h.warn(err.Error())
+		return false, false
+	}
+	newBytes := injectAll(origBytes, h.injections, scriptHtml)
+	if bytes.Equal(origBytes, newBytes) {
+		newBytes = h.handleMissingAnchor(rw, req, origBytes, scriptHtml)
+	}
+	injectedBytes := newBytes
+	if h.bodyTransform != nil {
+		newBytes = h.bodyTransform(newBytes)
+	}
+	// also when a transform stripping the script leaves the body unchanged
+	if h.config.VerifyInjection {
+		h.verifyInjection(req, injectedBytes, newBytes, scriptHtml)
+	}
+	if bytes.Equal(origBytes, newBytes) {
+		return false, false
+	}
+
+	// otherwise the decoded body is sent as identity
+	if h.config.ReencodeAfterInject {
+		newBytes, err = encodeBody(encoding, newBytes)
+		if err != nil {
+			h.warn(fmt.Sprintf("could not encode %s body of %s: %s", encoding, req.URL.EscapedPath(), err.Error()))
+			return false, false
+		}
+	}
+
+	// the buffered body is complete, so a chunked upstream gets a length too
+	h.writeInjectedHeader(rw, myrw, scriptHtml, len(newBytes))
+
+	// Write the modified content
+	// the header and its Content-Length are sent already, so the original
+	// body can't be written instead and the response is left as it is
+	n, err := rw.Write(newBytes)
+	if err != nil {
+		h.warn(fmt.Sprintf("could not write injected body of %s (%d of %d bytes written): %s", req.URL.EscapedPath(), n, len(newBytes), err.Error()))
+		return false, true
+	}
+	if h.config.VerifyInjection && n != len(newBytes) {
+		h.warn(fmt.Sprintf("verifyInjection: wrote %d of %d bytes of %s", n, len(newBytes), req.URL.EscapedPath()))
+	}
+	return true, true
+}
+
+// the script html injected into the response with the intercepted header
+// with generateCSPNonce, its scripts get a nonce of their own if the response
+// has a csp, a page without one runs them anyway.
+func (h *PluginHandler) responseScriptHtml(req *http.Request, header http.Header) (string, error) {
+	scriptHtml := h.getScriptHtmlFor(req)
+	if h.config.InjectPagePathAttr {
+		scriptHtml = withScriptAttribute(scriptHtml, "data-page-path", strings.ReplaceAll(req.URL.EscapedPath(), "'", "%27"))
+	}
+	if locale := responseLocale(req, header, &h.config); locale != "" {
+		scriptHtml = withScriptAttribute(scriptHtml, "data-locale", locale)
+	}
+	if h.config.PatchCSP && h.config.GenerateCSPNonce && hasCSP(header) {
+		nonce, err := newCSPNonce()
+		if err != nil {
+			return "", fmt.Errorf("could not generate a csp nonce for %s: %w", req.URL.EscapedPath(), err)
+		}
+		scriptHtml = withScriptNonce(scriptHtml, nonce)
+	}
+	return scriptHtml, nil
+}
+
+// writes the status and headers of an injected response
+// without Content-Length for a negative length, eg. when streaming.
+func (h *PluginHandler) writeInjectedHeader(rw http.ResponseWriter, myrw *responseWriter, scriptHtml string, length int) {
+	// Copy headers from intercepted response to actual response
+	copyInjectedHeaders(rw.Header(), myrw.Header(), h.config.ResponseHeaderAllowlist)
+	if !h.config.ReencodeAfterInject {
+		// the body was decoded for the injection
+		removeHeadersFold(rw.Header(), "Content-Encoding")
+	}
+
+	// allow the injected script by the csp of the page
+	if h.config.PatchCSP {
+		patchCSP(rw.Header(), scriptHtml)
+	}
+
+	// Set the correct Content-Length for the modified content
+	// or leave the framing to the chunked transfer encoding
+	removeHeadersFold(rw.Header(), "Content-Length", "Transfer-Encoding")
+	if !h.config.ForceChunkedOutput && length >= 0 {
+		rw.Header().Set("Content-Length", strconv.Itoa(length))
+	}
+
+	// the following pages of the visit are not injected again
+	if h.config.FirstVisitOnly {
+		http.SetCookie(rw, &http.Cookie{Name: firstVisitCookie, Value: "1", Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+	}
+
+	// Write status code
+	rw.WriteHeader(myrw.statusCode)
+	if flusher, ok := rw.(http.Flusher); ok && h.config.ForceChunkedOutput {
+		// sends the header before the body, so net/http can't add a length
+		flusher.Flush()
+	}
+}
+
+// called by Write with the lock held once streamThresholdBytes are buffered
+// injects the buffered part if the anchor is in it, otherwise passes it
+// through, the rest of the body is streamed either way.
+func (h *PluginHandler) streamAtThreshold(rw http.ResponseWriter, req *http.Request, myrw *responseWriter) error {
+	isHtml := strings.HasPrefix(myrw.Header().Get("Content-Type"), "text/html") && statusHasBody(myrw.statusCode) &&
+		(myrw.statusCode < 400 || h.config.InjectErrorPages)
+	// encoded bodies can't be injected in parts
+	canInject := isHtml && contentEncoding(myrw.Header()) == "" && !(h.config.HonorNoTransform && hasNoTransform(myrw.Header()))
+	if canInject {
+		scriptHtml, err := h.responseScriptHtml(req, myrw.Header())
+		if err != nil {
+			h.warn(err.Error())
+			return myrw.passThrough()
+		}
+		body := myrw.buffer.Bytes()
+		// the rest of the page may still have its </body>
+		newBytes := injectAll(body, withoutLegacyAnchors(h.injections), scriptHtml)
+		if !bytes.Equal(body, newBytes) {
+			h.writeInjectedHeader(rw, myrw, scriptHtml, -1)
+			_, err := rw.Write(newBytes)
+			myrw.streamInjected = err == nil
+			return err
+		}
+	}
+	if isHtml {
+		h.log(fmt.Sprintf("injection anchor not found in the first %d bytes of %s, streaming it", myrw.buffer.Len(), req.URL.EscapedPath()))
+	}
+	return myrw.passThrough()
+}
+
+// warns if the script was injected but is missing from the body written,
+// eg. because the body transform rewrote it.
+func (h *PluginHandler) verifyInjection(req *http.Request, injectedBytes, writtenBytes []byte, scriptHtml string) {
+	script := []byte(scriptHtml)
+	if len(script) == 0 || !bytes.Contains(injectedBytes, script) || bytes.Contains(writtenBytes, script) {
+		return
+	}
+	h.warn(fmt.Sprintf("verifyInjection: the script is missing from the body written for %s, check the middlewares rewriting it", req.URL.EscapedPath()))
+}
+
+// applies onMissingAnchor to a body without the injection anchor
+// returns the body to write, which is unchanged unless appending.
+func (h *PluginHandler) handleMissingAnchor(rw http.ResponseWriter, req *http.Request, body []byte, scriptHtml string) []byte {
+	switch h.config.OnMissingAnchor {
+	case MAModeAppend:
+		newBytes := make([]byte, 0, len(body)+len(scriptHtml))
+		newBytes = append(newBytes, body...)
+		return append(newBytes, scriptHtml...)
+	case MAModeWarn:
+		h.warn(fmt.Sprintf("injection anchor not found in %s", req.URL.EscapedPath()))
+	case MAModeError:
+		rw.Header().Set("X-Umami-Inject-Error", "anchor not found")
+	}
+	return body
 }
 
 type responseWriter struct {
-	buffer        *bytes.Buffer
-	statusCode    int
-	headerWritten bool
+	header         http.Header // kept apart until it is copied to the response
+	buffer         *bytes.Buffer
+	statusCode     int
+	headerWritten  bool
+	ctx            context.Context // injection deadline, if any
+	streaming      bool            // gave up buffering after the deadline or threshold
+	threshold      int             // streamThresholdBytes, 0 buffers everything
+	onThreshold    func() error    // decides on the buffered part at the threshold
+	thresholdHit   bool
+	streamInjected bool       // the part buffered up to the threshold was injected
+	bypassed       bool       // an event stream, written through from the start
+	mu             sync.Mutex // upstreams may write from several goroutines
+	eventHeader    string
+	event          responseEvent // taken from the headers before they are sent
 	http.ResponseWriter
 }
 
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
 func (w *responseWriter) WriteHeader(statusCode int) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writeHeader(statusCode)
+}
+
+func (w *responseWriter) writeHeader(statusCode int) {
 	if !w.headerWritten {
 		w.statusCode = statusCode
 		w.headerWritten = true
+		w.takeEvent()
+		// event streams never end, they can't be buffered
+		if isEventStream(w.header) {
+			w.streaming = true
+			w.bypassed = true
+			copyHeaders(w.ResponseWriter.Header(), w.header)
+			w.ResponseWriter.WriteHeader(statusCode)
+		}
 		// Don't call the underlying WriteHeader yet - we'll do it later
 	}
 }
 
 func (w *responseWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
 	if !w.headerWritten {
-		w.WriteHeader(200) // default status code
+		w.writeHeader(200) // default status code
+	}
+	if w.streaming {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.deadlineExceeded() {
+		// flush what was buffered so far and stream the rest
+		// streaming even if that failed, it must not be written twice
+		w.streaming = true
+		err := w.passThrough()
+		if err != nil {
+			return 0, err
+		}
+		return w.ResponseWriter.Write(p)
 	}
-	return w.buffer.Write(p)
+	n, err := w.buffer.Write(p)
+	if err == nil && w.threshold > 0 && w.buffer.Len() >= w.threshold {
+		w.streaming = true
+		w.thresholdHit = true
+		err = w.onThreshold()
+	}
+	return n, err
+}
+
+// flushes what is written through, buffered bodies are written later anyway.
+// an event stream gets its header written on the first flush.
+func (w *responseWriter) Flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	// event streams often flush the header before the first event
+	if !w.headerWritten && isEventStream(w.header) {
+		w.writeHeader(http.StatusOK)
+	}
+	if !w.streaming {
+		return
+	}
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *responseWriter) takeEvent() {
+	if event := takeResponseEvent(w.header, w.eventHeader); event.name != "" {
+		w.event = event
+	}
+}
+
+func (w *responseWriter) deadlineExceeded() bool {
+	return w.ctx != nil && w.ctx.Err() != nil
+}
+
+// records the status code of a response that is written through.
+type statusWriter struct {
+	statusCode    int
+	headerWritten bool
+	eventHeader   string
+	event         responseEvent // taken from the headers before they are sent
+	http.ResponseWriter
+}
+
+func (w *statusWriter) WriteHeader(statusCode int) {
+	if !w.headerWritten {
+		w.statusCode = statusCode
+		w.headerWritten = true
+		w.takeEvent()
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *statusWriter) Write(p []byte) (int, error) {
+	if !w.headerWritten {
+		w.headerWritten = true
+		w.takeEvent()
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *statusWriter) takeEvent() {
+	if event := takeResponseEvent(w.ResponseWriter.Header(), w.eventHeader); event.name != "" {
+		w.event = event
+	}
+}
+
+// keeps streaming responses working through the wrapper.
+func (w *statusWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// keeps websocket upgrades working through the wrapper.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, fmt.Errorf("%T does not support hijacking", w.ResponseWriter)
+	}
+	if !w.headerWritten {
+		w.statusCode = http.StatusSwitchingProtocols
+		w.headerWritten = true
+	}
+	return hijacker.Hijack()
+}
+
+// keeps http/2 server push working through the wrapper.
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	if pusher, ok := w.ResponseWriter.(http.Pusher); ok {
+		return pusher.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// writes the intercepted status and body to the underlying writer unmodified
+// called from Write with the lock held or after next returned.
+func (w *responseWriter) passThrough() error {
+	copyHeaders(w.ResponseWriter.Header(), w.header)
+	w.ResponseWriter.WriteHeader(w.statusCode)
+	_, err := w.ResponseWriter.Write(w.buffer.Bytes())
+	return err
 }
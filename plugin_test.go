@@ -0,0 +1,2002 @@
+package traefik_umami_plugin
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+const testPage = `<!DOCTYPE html><html><head><title>Test</title></head><body><h1>Test</h1></body></html>`
+
+// the default config with an umamiHost and websiteId, so it is valid.
+func testConfig() *Config {
+	config := CreateConfig()
+	config.UmamiHost = "http://umami.test"
+	config.WebsiteId = "website"
+	return config
+}
+
+// a plugin for the config in front of next, logging nowhere.
+func newTestPlugin(t testing.TB, config *Config, next http.Handler) *PluginHandler {
+	t.Helper()
+	handler, err := New(context.Background(), next, config, "test")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	h := handler.(*PluginHandler)
+	h.LogHandler = log.New(io.Discard, "", 0)
+	return h
+}
+
+// the field of the first config issue, empty if the config is valid.
+func configIssueField(h *PluginHandler) string {
+	if len(h.configIssues) == 0 {
+		return ""
+	}
+	return h.configIssues[0].Field
+}
+
+// replaces the sink of the plugin, tracking synchronously so the events are
+// recorded once ServeHTTP returned.
+func recordTracking(h *PluginHandler) *recordingSink {
+	sink := &recordingSink{}
+	h.SetTrackingSink(sink)
+	h.config.SyncTracking = true
+	h.syncTimeout = time.Second
+	return sink
+}
+
+// records the payloads sent instead of sending them.
+type recordingSink struct {
+	mu   sync.Mutex
+	sent [][]byte
+	err  error
+}
+
+func (s *recordingSink) Send(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sent = append(s.sent, payload)
+	return s.err
+}
+
+func (s *recordingSink) payloads() [][]byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([][]byte{}, s.sent...)
+}
+
+// the payloads decoded, failing the test for invalid ones.
+func (s *recordingSink) events(t *testing.T) []SendPayload {
+	t.Helper()
+	events := []SendPayload{}
+	for _, payload := range s.payloads() {
+		var body SendBody
+		if err := json.Unmarshal(payload, &body); err != nil {
+			t.Fatalf("payload %s: %v", payload, err)
+		}
+		events = append(events, body.Payload)
+	}
+	return events
+}
+
+// an umami answering every request with its path, besides the requests
+// recorded on the channel.
+func newUmamiStub(t testing.TB) (*httptest.Server, chan *http.Request) {
+	t.Helper()
+	requests := make(chan *http.Request, 100)
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		requests <- req
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(rw, "umami "+req.URL.Path)
+	}))
+	t.Cleanup(umami.Close)
+	return umami, requests
+}
+
+// a handler writing the body with the content type.
+func htmlHandler(contentType string, body string) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", contentType)
+		_, _ = io.WriteString(rw, body)
+	})
+}
+
+// a browser navigation to the target.
+func htmlRequest(method string, target string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	return req
+}
+
+func serve(h http.Handler, req *http.Request) *httptest.ResponseRecorder {
+	rw := httptest.NewRecorder()
+	h.ServeHTTP(rw, req)
+	return rw
+}
+
+// the injection as the regex path did it before the literal fast path.
+func regexInjectBefore(body []byte, anchor *regexp.Regexp, html string) []byte {
+	loc := anchor.FindIndex(body)
+	if loc == nil {
+		return body
+	}
+	out := append([]byte{}, body[:loc[0]]...)
+	out = append(out, html...)
+	return append(out, body[loc[0]:]...)
+}
+
+func TestFindAnchorLiteralMatchesRegex(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"page", testPage},
+		{"empty", ""},
+		{"no anchor", "<p>fragment</p>"},
+		{"anchor only", "</body>"},
+		{"two anchors", "<body>a</body><iframe srcdoc='</body>'></iframe></body>"},
+		{"partial anchor", "<body></bod</body>"},
+		{"uppercase", "<BODY></BODY>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			body := []byte(test.body)
+			start, end := findAnchor(body, insertBeforeRegex)
+			want := insertBeforeRegex.FindIndex(body)
+			if want == nil {
+				want = []int{-1, -1}
+			}
+			if start != want[0] || (start >= 0 && end != want[1]) {
+				t.Errorf("findAnchor = %d, %d, want %v", start, end, want)
+			}
+
+			rules := []injectionRule{{anchors: []*regexp.Regexp{insertBeforeRegex}, limit: 1}}
+			got := injectAll(body, rules, "<script></script>")
+			if expected := regexInjectBefore(body, insertBeforeRegex, "<script></script>"); !bytes.Equal(got, expected) {
+				t.Errorf("injectAll = %q, want %q", got, expected)
+			}
+		})
+	}
+}
+
+func TestInjectAllDoesNotAliasBody(t *testing.T) {
+	body := []byte(testPage)
+	orig := append([]byte{}, body...)
+	rules := []injectionRule{{anchors: []*regexp.Regexp{insertBeforeRegex}, limit: 1}}
+	out := injectAll(body, rules, "<script></script>")
+	out[0] = 'X'
+	if !bytes.Equal(body, orig) {
+		t.Errorf("injectAll modified the body it was given")
+	}
+}
+
+func BenchmarkServeHTTPInject(b *testing.B) {
+	page := strings.Replace(testPage, "<h1>Test</h1>", strings.Repeat("<p>Lorem ipsum dolor sit amet.</p>", 100), 1)
+	h := newTestPlugin(b, testConfig(), htmlHandler("text/html; charset=utf-8", page))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rw := serve(h, htmlRequest(http.MethodGet, "/"))
+		if !strings.Contains(rw.Body.String(), "data-website-id") {
+			b.Fatal("script was not injected")
+		}
+	}
+}
+
+// serves index.html.br to browsers accepting br and index.html otherwise.
+func precompressedHandler(withSibling bool) http.Handler {
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		if req.Header.Get("Accept-Encoding") == "identity" && withSibling {
+			_, _ = io.WriteString(rw, testPage)
+			return
+		}
+		rw.Header().Set("Content-Encoding", "br")
+		_, _ = io.WriteString(rw, "\x1b\x00brotli")
+	})
+}
+
+func TestPrecompressedFallback(t *testing.T) {
+	tests := []struct {
+		name         string
+		fallback     string
+		withSibling  bool
+		wantInjected bool
+		wantEncoding string
+		wantTracked  bool
+	}{
+		{"skip", PCFallbackSkip, true, false, "br", true},
+		{"client-only", PCFallbackClientOnly, true, false, "br", false},
+		{"sibling", PCFallbackSibling, true, true, "", false},
+		{"sibling missing", PCFallbackSibling, false, false, "br", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.PrecompressedFallback = test.fallback
+			config.ServerSideTracking = true
+			config.ServerSideTrackingMode = SSTModeNotinjected
+			h := newTestPlugin(t, config, precompressedHandler(test.withSibling))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("Accept-Encoding", "br, gzip")
+			rw := serve(h, req)
+			if injected := strings.Contains(rw.Body.String(), "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if encoding := rw.Header().Get("Content-Encoding"); encoding != test.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, test.wantEncoding)
+			}
+			if tracked := len(sink.payloads()) > 0; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestMethodFiltering(t *testing.T) {
+	tests := []struct {
+		name          string
+		method        string
+		injectMethods []string
+		trackMethods  []string
+		wantInjected  bool
+		wantTracked   bool
+	}{
+		{"GET by default", http.MethodGet, nil, nil, true, true},
+		{"POST by default", http.MethodPost, nil, nil, false, false},
+		{"HEAD by default", http.MethodHead, nil, nil, false, false},
+		{"POST listed", http.MethodPost, []string{"GET", "POST"}, []string{"get", "post"}, true, true},
+		{"POST tracked only", http.MethodPost, nil, []string{"POST"}, false, true},
+		{"HEAD listed", http.MethodHead, []string{"HEAD"}, []string{"HEAD"}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			if test.injectMethods != nil {
+				config.InjectMethods = test.injectMethods
+			}
+			if test.trackMethods != nil {
+				config.TrackMethods = test.trackMethods
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			rw := serve(h, htmlRequest(test.method, "/"))
+			if injected := strings.Contains(rw.Body.String(), "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if tracked := len(sink.payloads()) > 0; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestScriptInjectionDisabled(t *testing.T) {
+	umami, _ := newUmamiStub(t)
+	tests := []struct {
+		name         string
+		injection    bool
+		target       string
+		headers      map[string]string
+		wantBody     string
+		wantInjected bool
+		wantTracked  bool
+	}{
+		{"forwards the script", false, "/_umami/script.js", nil, "umami /script.js", false, false},
+		{"forwards events", false, "/_umami/api/send", nil, "umami /api/send", false, false},
+		{"tracks the page", false, "/", nil, "", false, true},
+		{"tracks assets", false, "/app.css", map[string]string{"Accept": "text/css"}, "", false, true},
+		{"injects and tracks the page", true, "/", nil, "", true, true},
+		{"skips assets of injected pages", true, "/app.css", map[string]string{"Accept": "text/css"}, "", false, false},
+		{"skips htmx requests", true, "/", map[string]string{"HX-Request": "true"}, "", false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = test.injection
+			config.ServerSideTracking = true
+			config.ServerSideTrackingMode = SSTModeAll
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, test.target)
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			rw := serve(h, req)
+			if test.wantBody != "" && rw.Body.String() != test.wantBody {
+				t.Errorf("body = %q, want %q", rw.Body.String(), test.wantBody)
+			}
+			if injected := strings.Contains(rw.Body.String(), "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if tracked := len(sink.payloads()) > 0; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestInterpolateEnv(t *testing.T) {
+	t.Setenv("TEST_UMAMI_HOST", "http://umami.internal:3000")
+	t.Setenv("TEST_WEBSITE_ID", "env-website")
+	t.Setenv("TEST_EMPTY", "")
+	tests := []struct {
+		name  string
+		value string
+		want  string
+	}{
+		{"whole value", "${TEST_WEBSITE_ID}", "env-website"},
+		{"part of the value", "id-${TEST_WEBSITE_ID}-1", "id-env-website-1"},
+		{"two references", "${TEST_WEBSITE_ID}/${TEST_WEBSITE_ID}", "env-website/env-website"},
+		{"empty variable", "${TEST_EMPTY}", ""},
+		{"unset variable", "${TEST_UNSET_VARIABLE}", "${TEST_UNSET_VARIABLE}"},
+		{"no reference", "website", "website"},
+		{"not a reference", "$TEST_WEBSITE_ID", "$TEST_WEBSITE_ID"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = "${TEST_UMAMI_HOST}"
+			config.WebsiteId = test.value
+			config.UmamiHosts = []string{"${TEST_UMAMI_HOST}"}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if h.config.UmamiHost != "http://umami.internal:3000" || h.config.UmamiHosts[0] != "http://umami.internal:3000" {
+				t.Errorf("umamiHost = %q, umamiHosts = %v", h.config.UmamiHost, h.config.UmamiHosts)
+			}
+			if h.config.WebsiteId != test.want {
+				t.Errorf("websiteId = %q, want %q", h.config.WebsiteId, test.want)
+			}
+			// the config passed to New is left as it is
+			if config.WebsiteId != test.value || config.UmamiHosts[0] != "${TEST_UMAMI_HOST}" {
+				t.Errorf("config.WebsiteId = %q, config.UmamiHosts = %v", config.WebsiteId, config.UmamiHosts)
+			}
+		})
+	}
+}
+
+func TestEnvFields(t *testing.T) {
+	configType := reflect.TypeOf(Config{})
+	for i := 0; i < configType.NumField(); i++ {
+		field := configType.Field(i)
+		if field.Type.Kind() != reflect.String {
+			continue
+		}
+		t.Run(field.Name, func(t *testing.T) {
+			config := CreateConfig()
+			reflect.ValueOf(config).Elem().Field(i).SetString("${TEST_ENV_FIELD}")
+			for _, envField := range envFields(config) {
+				if *envField == "${TEST_ENV_FIELD}" {
+					return
+				}
+			}
+			t.Errorf("%s is not interpolated, add it to envFields", field.Name)
+		})
+	}
+}
+
+func TestLoggedConfigHidesEnv(t *testing.T) {
+	t.Setenv("TEST_WEBSITE_ID", "secret-website")
+	t.Setenv("TEST_UMAMI_HOST", "http://secret.internal:3000")
+	tests := []struct {
+		name       string
+		websiteId  string
+		wantLogged string
+	}{
+		{"reference", "${TEST_WEBSITE_ID}", `"websiteId":"${TEST_WEBSITE_ID}"`},
+		{"part of the value", "id-${TEST_WEBSITE_ID}", `"websiteId":"id-${TEST_WEBSITE_ID}"`},
+		{"no reference", "website", `"websiteId":"website"`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.WebsiteId = test.websiteId
+			config.UmamiHosts = []string{"${TEST_UMAMI_HOST}"}
+			h, startup := newPluginLoggingTo(t, config)
+			// the script served to every page has the website id anyway
+			logged := regexp.MustCompile(`config: .*`).FindString(startup)
+			if !strings.Contains(logged, test.wantLogged) || !strings.Contains(logged, `"umamiHosts":["${TEST_UMAMI_HOST}"]`) {
+				t.Errorf("logged %q, want the config logged with %s", logged, test.wantLogged)
+			}
+			if strings.Contains(logged, "secret") {
+				t.Errorf("logged %q, want no env values", logged)
+			}
+			// only the log is changed
+			if h.config.UmamiHosts[0] != "http://secret.internal:3000" {
+				t.Errorf("umamiHosts = %v, want them resolved", h.config.UmamiHosts)
+			}
+		})
+	}
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	tests := []struct {
+		name          string
+		contentLength string
+		wantInjected  bool
+	}{
+		{"truncated", "1000", false},
+		{"overlong", "10", false},
+		{"invalid", "many", false},
+		{"matching", strconv.Itoa(len(testPage)), true},
+		{"undeclared", "", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				if test.contentLength != "" {
+					rw.Header().Set("Content-Length", test.contentLength)
+				}
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			body := rw.Body.String()
+			if injected := strings.Contains(body, "data-website-id"); injected != test.wantInjected {
+				t.Fatalf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			// the declared length is kept unless the body was injected
+			wantContentLength := test.contentLength
+			if test.wantInjected {
+				wantContentLength = strconv.Itoa(len(body))
+			} else if body != testPage {
+				t.Errorf("body = %q, want it unmodified", body)
+			}
+			if contentLength := rw.Header().Get("Content-Length"); contentLength != wantContentLength {
+				t.Errorf("Content-Length = %q, want %q", contentLength, wantContentLength)
+			}
+		})
+	}
+}
+
+func TestOnMissingAnchor(t *testing.T) {
+	const markerless = `<head><title>Fragment</title></head><div>no closing body</div>`
+	tests := []struct {
+		mode        string
+		wantBody    string // the script is appended in place of %s
+		wantHeader  string
+		wantWarning bool
+	}{
+		{MAModePassthrough, markerless, "", false},
+		{MAModeAppend, markerless + "%s", "", false},
+		{MAModeWarn, markerless, "", true},
+		{MAModeError, markerless, "anchor not found", false},
+	}
+	for _, test := range tests {
+		t.Run(test.mode, func(t *testing.T) {
+			config := testConfig()
+			config.OnMissingAnchor = test.mode
+			h := newTestPlugin(t, config, htmlHandler("text/html", markerless))
+			var logs bytes.Buffer
+			h.LogHandler = log.New(&logs, "", 0)
+
+			rw := serve(h, htmlRequest(http.MethodGet, "/page"))
+			wantBody := strings.Replace(test.wantBody, "%s", h.getScriptHtml(), 1)
+			if rw.Body.String() != wantBody {
+				t.Errorf("body = %q, want %q", rw.Body.String(), wantBody)
+			}
+			if header := rw.Header().Get("X-Umami-Inject-Error"); header != test.wantHeader {
+				t.Errorf("X-Umami-Inject-Error = %q, want %q", header, test.wantHeader)
+			}
+			warning := strings.Contains(logs.String(), "level=warning msg=\"[traefik-umami-plugin:test] injection anchor not found in /page\"")
+			if warning != test.wantWarning {
+				t.Errorf("warning logged = %v, want %v, logs: %s", warning, test.wantWarning, logs.String())
+			}
+		})
+	}
+}
+
+func TestIsUpgradeRequest(t *testing.T) {
+	tests := []struct {
+		name       string
+		connection []string
+		upgrade    string
+		want       bool
+	}{
+		{"websocket", []string{"Upgrade"}, "websocket", true},
+		{"lowercase", []string{"upgrade"}, "websocket", true},
+		{"token list", []string{"keep-alive, Upgrade"}, "websocket", true},
+		{"second header", []string{"keep-alive", "Upgrade"}, "h2c", true},
+		{"no upgrade header", []string{"Upgrade"}, "", false},
+		{"no connection token", []string{"keep-alive"}, "websocket", false},
+		{"plain request", nil, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			for _, connection := range test.connection {
+				req.Header.Add("Connection", connection)
+			}
+			if test.upgrade != "" {
+				req.Header.Set("Upgrade", test.upgrade)
+			}
+			if got := isUpgradeRequest(req); got != test.want {
+				t.Errorf("isUpgradeRequest = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUpgradePassthrough(t *testing.T) {
+	// echoes a line over the hijacked connection
+	next := http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		hijacker, ok := rw.(http.Hijacker)
+		if !ok {
+			http.Error(rw, "not a hijacker", http.StatusInternalServerError)
+			return
+		}
+		conn, buf, err := hijacker.Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		_ = buf.Flush()
+		line, _ := buf.ReadString('\n')
+		_, _ = buf.WriteString("echo " + line)
+		_ = buf.Flush()
+	})
+	tests := []struct {
+		name               string
+		serverSideTracking bool
+	}{
+		{"injection", false},
+		{"injection and tracking", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = test.serverSideTracking
+			h := newTestPlugin(t, config, next)
+			recordTracking(h)
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			conn, err := net.Dial("tcp", server.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: example.com\r\nAccept: text/html\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			reader := bufio.NewReader(conn)
+			res, err := http.ReadResponse(reader, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if res.StatusCode != http.StatusSwitchingProtocols {
+				t.Fatalf("status = %d, want 101", res.StatusCode)
+			}
+			_, _ = io.WriteString(conn, "hello\n")
+			if line, _ := reader.ReadString('\n'); line != "echo hello\n" {
+				t.Errorf("got %q over the upgraded connection", line)
+			}
+		})
+	}
+}
+
+// a recorder that can be hijacked and pushed to.
+type hijackPushRecorder struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+	pushed   []string
+}
+
+func (r *hijackPushRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	r.hijacked = true
+	return nil, nil, nil
+}
+
+func (r *hijackPushRecorder) Push(target string, opts *http.PushOptions) error {
+	r.pushed = append(r.pushed, target)
+	return nil
+}
+
+func TestStatusWriterForwardsHijackAndPush(t *testing.T) {
+	tests := []struct {
+		name         string
+		rw           http.ResponseWriter
+		wantHijacked bool
+		wantPushed   bool
+	}{
+		{"supported", &hijackPushRecorder{ResponseRecorder: httptest.NewRecorder()}, true, true},
+		{"unsupported", httptest.NewRecorder(), false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &statusWriter{ResponseWriter: test.rw, statusCode: http.StatusOK}
+			_, _, err := w.Hijack()
+			if (err == nil) != test.wantHijacked {
+				t.Errorf("Hijack error = %v, want hijacked %v", err, test.wantHijacked)
+			}
+			if test.wantHijacked && w.statusCode != http.StatusSwitchingProtocols {
+				t.Errorf("status after Hijack = %d, want 101", w.statusCode)
+			}
+			err = w.Push("/app.css", nil)
+			if test.wantPushed && err != nil {
+				t.Errorf("Push: %v", err)
+			}
+			if !test.wantPushed && err != http.ErrNotSupported {
+				t.Errorf("Push error = %v, want http.ErrNotSupported", err)
+			}
+			if recorder, ok := test.rw.(*hijackPushRecorder); ok && (!recorder.hijacked || len(recorder.pushed) != 1) {
+				t.Errorf("hijacked = %v, pushed = %v", recorder.hijacked, recorder.pushed)
+			}
+		})
+	}
+}
+
+// run with -race
+func TestScriptHtmlConcurrentRebuild(t *testing.T) {
+	tests := []struct {
+		name      string
+		envHeader string
+	}{
+		{"script", ""},
+		{"env scripts", "X-Env"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			if test.envHeader != "" {
+				config.EnvHeader = test.envHeader
+				config.EnvWebsiteMap = map[string]string{"staging": "staging-website"}
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			stop := make(chan struct{})
+			rebuilt := make(chan struct{})
+			go func() {
+				defer close(rebuilt)
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+						if err := h.rebuildScript(); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}
+			}()
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < 50; j++ {
+						req := htmlRequest(http.MethodGet, "/")
+						req.Header.Set("X-Env", "staging")
+						if body := serve(h, req).Body.String(); !strings.Contains(body, "data-website-id") {
+							t.Errorf("body %q is not injected", body)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			close(stop)
+			<-rebuilt
+		})
+	}
+}
+
+func TestWrap(t *testing.T) {
+	tests := []struct {
+		name         string
+		config       *Config
+		wantInjected bool
+	}{
+		{"configured", testConfig(), true},
+		// the defaults lack an umamiHost, so everything is passed through
+		{"nil config", nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.config != nil {
+				test.config.LogLevel = "error"
+			}
+			h := Wrap(htmlHandler("text/html", testPage), test.config)
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			if injected := strings.Contains(body, "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+		})
+	}
+}
+
+func TestInjectDeadline(t *testing.T) {
+	half := len(testPage) / 2
+	tests := []struct {
+		name         string
+		deadline     string
+		delayBetween time.Duration
+		delayAfter   time.Duration
+		wantInjected bool
+	}{
+		{"fast body", "1s", 0, 0, true},
+		{"no deadline", "", 50 * time.Millisecond, 0, true},
+		{"slow body", "20ms", 50 * time.Millisecond, 0, false},
+		{"slow handler", "20ms", 0, 50 * time.Millisecond, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.InjectDeadline = test.deadline
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = io.WriteString(rw, testPage[:half])
+				time.Sleep(test.delayBetween)
+				_, _ = io.WriteString(rw, testPage[half:])
+				time.Sleep(test.delayAfter)
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			body := rw.Body.String()
+			if injected := strings.Contains(body, "data-website-id"); injected != test.wantInjected {
+				t.Fatalf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if !test.wantInjected && body != testPage {
+				t.Errorf("body = %q, want it passed through", body)
+			}
+		})
+	}
+}
+
+func TestInjectDeadlineConfig(t *testing.T) {
+	tests := []struct {
+		deadline  string
+		wantIssue string
+	}{
+		{"", ""},
+		{"250ms", ""},
+		{"0s", "injectDeadline"},
+		{"-1s", "injectDeadline"},
+		{"soon", "injectDeadline"},
+	}
+	for _, test := range tests {
+		t.Run(test.deadline, func(t *testing.T) {
+			config := testConfig()
+			config.InjectDeadline = test.deadline
+			if field := configIssueField(newTestPlugin(t, config, http.NotFoundHandler())); field != test.wantIssue {
+				t.Errorf("config issue = %q, want %q", field, test.wantIssue)
+			}
+		})
+	}
+}
+
+func TestResponsesWithoutBody(t *testing.T) {
+	tests := []struct {
+		name   string
+		method string
+		status int
+		body   string
+	}{
+		{"204", http.MethodGet, http.StatusNoContent, ""},
+		{"304", http.MethodGet, http.StatusNotModified, ""},
+		{"empty 200", http.MethodGet, http.StatusOK, ""},
+		{"HEAD", http.MethodHead, http.StatusOK, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.InjectMethods = []string{http.MethodGet, http.MethodHead}
+			config.OnMissingAnchor = MAModeAppend
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header().Set("ETag", `"v1"`)
+				if req.Method == http.MethodHead {
+					rw.Header().Set("Content-Length", strconv.Itoa(len(testPage)))
+				}
+				rw.WriteHeader(test.status)
+				_, _ = io.WriteString(rw, test.body)
+			}))
+			rw := serve(h, htmlRequest(test.method, "/"))
+			if rw.Code != test.status {
+				t.Errorf("status = %d, want %d", rw.Code, test.status)
+			}
+			if rw.Body.Len() != 0 {
+				t.Errorf("body = %q, want none", rw.Body.String())
+			}
+			if etag := rw.Header().Get("ETag"); etag != `"v1"` {
+				t.Errorf("ETag = %q, want it kept", etag)
+			}
+			wantLength := ""
+			if test.method == http.MethodHead {
+				wantLength = strconv.Itoa(len(testPage))
+			}
+			if length := rw.Header().Get("Content-Length"); length != wantLength {
+				t.Errorf("Content-Length = %q, want %q", length, wantLength)
+			}
+		})
+	}
+}
+
+func TestHonorNoTransform(t *testing.T) {
+	tests := []struct {
+		name         string
+		cacheControl []string
+		honor        bool
+		wantInjected bool
+	}{
+		{"no-transform", []string{"no-transform"}, true, false},
+		{"directive list", []string{"public, max-age=60, No-Transform"}, true, false},
+		{"second header", []string{"public", "no-transform"}, true, false},
+		{"other directives", []string{"no-cache, no-store"}, true, true},
+		{"not honored", []string{"no-transform"}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.HonorNoTransform = test.honor
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				for _, value := range test.cacheControl {
+					rw.Header().Add("Cache-Control", value)
+				}
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			sink := recordTracking(h)
+
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			if injected := strings.Contains(body, "data-website-id"); injected != test.wantInjected {
+				t.Fatalf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if !test.wantInjected && body != testPage {
+				t.Errorf("body = %q, want it untouched", body)
+			}
+			// tracked server side either way
+			if len(sink.payloads()) != 1 {
+				t.Errorf("tracked %d events, want 1", len(sink.payloads()))
+			}
+		})
+	}
+}
+
+func TestInjectedResponseHeaders(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowlist   []string
+		wantHeaders map[string]string
+	}{
+		{"all but hop-by-hop", nil, map[string]string{"Content-Type": "text/html", "X-Internal": "1", "Cache-Control": "no-cache"}},
+		{"allowlist", []string{"Content-Type", "cache-control"}, map[string]string{"Content-Type": "text/html", "X-Internal": "", "Cache-Control": "no-cache"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ResponseHeaderAllowlist = test.allowlist
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				for _, name := range []string{"Connection", "Keep-Alive", "Transfer-Encoding", "Upgrade", "Trailer"} {
+					rw.Header().Set(name, "upstream")
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header().Set("X-Internal", "1")
+				rw.Header().Set("Cache-Control", "no-cache")
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			rw := httptest.NewRecorder()
+			// set by a middleware in front of the plugin
+			rw.Header().Set("Connection", "keep-alive")
+			h.ServeHTTP(rw, htmlRequest(http.MethodGet, "/"))
+
+			if !strings.Contains(rw.Body.String(), "data-website-id") {
+				t.Fatal("not injected")
+			}
+			if connection := rw.Header().Values("Connection"); len(connection) != 1 || connection[0] != "keep-alive" {
+				t.Errorf("Connection = %v, want only the one set in front", connection)
+			}
+			for _, name := range []string{"Keep-Alive", "Transfer-Encoding", "Upgrade", "Trailer"} {
+				if values := rw.Header().Values(name); len(values) != 0 {
+					t.Errorf("%s = %v, want it dropped", name, values)
+				}
+			}
+			for name, want := range test.wantHeaders {
+				if got := rw.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+			if length := rw.Header().Get("Content-Length"); length != strconv.Itoa(rw.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", length, rw.Body.Len())
+			}
+		})
+	}
+}
+
+func TestLogLimiter(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	type call struct {
+		after          time.Duration
+		wantAllowed    bool
+		wantSuppressed int
+	}
+	tests := []struct {
+		name  string
+		rate  int
+		calls []call
+	}{
+		{"below the rate", 2, []call{{0, true, 0}, {time.Millisecond, true, 0}}},
+		{"above the rate", 2, []call{{0, true, 0}, {0, true, 0}, {0, false, 0}, {0, false, 0}}},
+		{"summarized in the next window", 1, []call{{0, true, 0}, {0, false, 0}, {0, false, 0}, {time.Second, true, 2}, {time.Second, false, 0}}},
+		{"nothing to summarize", 1, []call{{0, true, 0}, {2 * time.Second, true, 0}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			limiter := &logLimiter{rate: test.rate}
+			for i, c := range test.calls {
+				allowed, suppressed := limiter.allow(start.Add(c.after))
+				if allowed != c.wantAllowed || suppressed != c.wantSuppressed {
+					t.Errorf("call %d = %v, %d, want %v, %d", i, allowed, suppressed, c.wantAllowed, c.wantSuppressed)
+				}
+			}
+		})
+	}
+}
+
+func TestLogRatePerSec(t *testing.T) {
+	config := testConfig()
+	config.LogRatePerSec = 3
+	h := newTestPlugin(t, config, http.NotFoundHandler())
+	var logs bytes.Buffer
+	h.LogHandler = log.New(&logs, "", 0)
+	// a window of its own, New logged already
+	h.logLimiter = &logLimiter{rate: config.LogRatePerSec}
+
+	for i := 0; i < 10; i++ {
+		h.log("processing HTML response")
+	}
+	if lines := strings.Count(logs.String(), "processing HTML response"); lines != 3 {
+		t.Errorf("logged %d messages, want 3: %s", lines, logs.String())
+	}
+	// the next window starts with the summary
+	h.logLimiter.mu.Lock()
+	h.logLimiter.windowStart = h.logLimiter.windowStart.Add(-time.Second)
+	h.logLimiter.mu.Unlock()
+	logs.Reset()
+	h.log("processing HTML response")
+	if !strings.Contains(logs.String(), "suppressed 7 log messages above logRatePerSec") || strings.Count(logs.String(), "processing HTML response") != 1 {
+		t.Errorf("logs = %s, want the summary and the message", logs.String())
+	}
+}
+
+// a handler writing the page encoded with the encoding.
+func encodedHtmlHandler(t testing.TB, encoding string, body string) http.Handler {
+	encoded, err := encodeBody(encoding, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		if encoding != "" {
+			rw.Header().Set("Content-Encoding", encoding)
+		}
+		_, _ = rw.Write(encoded)
+	})
+}
+
+func TestCompressionOrdering(t *testing.T) {
+	tests := []struct {
+		name     string
+		encoding string // of the body the plugin sees
+	}{
+		{"compress after the plugin", ""},
+		{"compress before the plugin", "gzip"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), encodedHtmlHandler(t, test.encoding, testPage))
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("Accept-Encoding", "gzip, br")
+			rw := serve(h, req)
+
+			if encoding := rw.Header().Get("Content-Encoding"); encoding != test.encoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, test.encoding)
+			}
+			if length := rw.Header().Get("Content-Length"); length != strconv.Itoa(rw.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", length, rw.Body.Len())
+			}
+			body, err := decodeBody(test.encoding, rw.Body.Bytes())
+			if err != nil {
+				t.Fatalf("decoding the body: %v", err)
+			}
+			if want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1); string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+// run with -race
+func TestResponseWriterConcurrentWrites(t *testing.T) {
+	tests := []struct {
+		name      string
+		threshold int
+	}{
+		{"buffered", 0},
+		{"streamed at the threshold", 256},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.StreamThresholdBytes = test.threshold
+			const writers, chunks = 8, 50
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = io.WriteString(rw, "<html><head></head><body>")
+				var wg sync.WaitGroup
+				for i := 0; i < writers; i++ {
+					wg.Add(1)
+					go func(writer int) {
+						defer wg.Done()
+						for j := 0; j < chunks; j++ {
+							_, _ = io.WriteString(rw, "<p>"+strconv.Itoa(writer)+"</p>")
+							if flusher, ok := rw.(http.Flusher); ok && j%10 == 0 {
+								flusher.Flush()
+							}
+						}
+					}(i)
+				}
+				wg.Wait()
+				_, _ = io.WriteString(rw, "</body></html>")
+			}))
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			for i := 0; i < writers; i++ {
+				if count := strings.Count(body, "<p>"+strconv.Itoa(i)+"</p>"); count != chunks {
+					t.Errorf("writer %d has %d intact chunks, want %d", i, count, chunks)
+				}
+			}
+			if !strings.HasPrefix(body, "<html><head></head><body>") || !strings.HasSuffix(body, "</body></html>") {
+				t.Errorf("body %q is out of order", body)
+			}
+			if test.threshold == 0 && !strings.Contains(body, "data-website-id") {
+				t.Errorf("body %q is not injected", body)
+			}
+		})
+	}
+}
+
+func TestEmptyHtmlBody(t *testing.T) {
+	tests := []struct {
+		name          string
+		status        int
+		contentLength string
+		onMissing     string
+	}{
+		{"200", http.StatusOK, "", MAModePassthrough},
+		{"200 with Content-Length 0", http.StatusOK, "0", MAModePassthrough},
+		{"append", http.StatusOK, "0", MAModeAppend},
+		{"error", http.StatusOK, "", MAModeError},
+		{"201", http.StatusCreated, "", MAModeAppend},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.OnMissingAnchor = test.onMissing
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+				rw.Header().Set("X-Upstream", "1")
+				if test.contentLength != "" {
+					rw.Header().Set("Content-Length", test.contentLength)
+				}
+				rw.WriteHeader(test.status)
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			if rw.Code != test.status || rw.Body.Len() != 0 {
+				t.Errorf("response = %d %q, want %d without body", rw.Code, rw.Body.String(), test.status)
+			}
+			want := http.Header{"Content-Type": {"text/html; charset=utf-8"}, "X-Upstream": {"1"}}
+			if test.contentLength != "" {
+				want.Set("Content-Length", test.contentLength)
+			}
+			if !reflect.DeepEqual(rw.Header(), want) {
+				t.Errorf("header = %v, want %v", rw.Header(), want)
+			}
+		})
+	}
+}
+
+func TestOptOutParam(t *testing.T) {
+	tests := []struct {
+		name         string
+		target       string
+		cookie       string
+		wantAnalyzed bool   // injected and tracked
+		wantCookie   string // the Set-Cookie, empty if none is set
+	}{
+		{"off", "/?umami=off", "", false, "umami=off; Path=/; HttpOnly; SameSite=Lax"},
+		{"off cookie", "/next", "off", false, ""},
+		{"on", "/?umami=on", "off", true, "umami=; Path=/; Max-Age=0; HttpOnly; SameSite=Lax"},
+		{"no param", "/", "", true, ""},
+		{"other value", "/?umami=maybe", "", true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.OptOutParam = "umami"
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, test.target)
+			if test.cookie != "" {
+				req.AddCookie(&http.Cookie{Name: "umami", Value: test.cookie})
+			}
+			rw := serve(h, req)
+			if injected := strings.Contains(rw.Body.String(), "data-website-id"); injected != test.wantAnalyzed {
+				t.Errorf("injected = %v, want %v", injected, test.wantAnalyzed)
+			}
+			if tracked := len(sink.payloads()) > 0; tracked != test.wantAnalyzed {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantAnalyzed)
+			}
+			if cookie := rw.Header().Get("Set-Cookie"); cookie != test.wantCookie {
+				t.Errorf("Set-Cookie = %q, want %q", cookie, test.wantCookie)
+			}
+		})
+	}
+}
+
+func TestBodyTransform(t *testing.T) {
+	meta := []byte(`<meta name="tracked" content="1">`)
+	addMeta := func(body []byte) []byte {
+		return bytes.Replace(body, []byte("</head>"), append(meta, "</head>"...), 1)
+	}
+	tests := []struct {
+		name      string
+		page      string
+		transform func([]byte) []byte
+		want      string // SCRIPT marks the umami script, empty if unmodified
+	}{
+		{"after the injection", testPage, addMeta, `<!DOCTYPE html><html><head><title>Test</title><meta name="tracked" content="1"></head><body><h1>Test</h1>SCRIPT</body></html>`},
+		{"replacing the body", testPage, func(body []byte) []byte { return bytes.ToUpper(body[:15]) }, "<!DOCTYPE HTML>"},
+		{"without an anchor", "<p>fragment</p></head>", addMeta, `<p>fragment</p><meta name="tracked" content="1"></head>`},
+		{"unchanged without an anchor", "<p>fragment</p>", addMeta, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), htmlHandler("text/html", test.page))
+			h.SetBodyTransform(test.transform)
+			want := test.page
+			if test.want != "" {
+				want = strings.Replace(test.want, "SCRIPT", h.getScriptHtml(), 1)
+			}
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			if body := rw.Body.String(); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+			if test.want != "" && rw.Header().Get("Content-Length") != strconv.Itoa(len(want)) {
+				t.Errorf("Content-Length = %q, want %d", rw.Header().Get("Content-Length"), len(want))
+			}
+		})
+	}
+}
+
+func TestMinInjectBodyBytes(t *testing.T) {
+	redirectStub := `<a href="/login">Found</a>.`
+	gzipPage := "<html><body>" + strings.Repeat("compressible ", 20) + "</body></html>"
+	tests := []struct {
+		name     string
+		min      int
+		encoding string
+		page     string
+		want     bool
+	}{
+		{"tiny body skipped", 64, "", redirectStub + "</body>", false},
+		{"normal page injected", 64, "", testPage, true},
+		{"at the minimum", len(testPage), "", testPage, true},
+		{"below the minimum", len(testPage) + 1, "", testPage, false},
+		{"decoded size counts", len(gzipPage), "gzip", gzipPage, true},
+		{"disabled", 0, "", "</body>", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.MinInjectBodyBytes = test.min
+			next := htmlHandler("text/html", test.page)
+			if test.encoding != "" {
+				next = encodedHtmlHandler(t, test.encoding, test.page)
+			}
+			h := newTestPlugin(t, config, next)
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			body, err := decodeBody(test.encoding, rw.Body.Bytes())
+			if err != nil {
+				t.Fatalf("decoding the body: %v", err)
+			}
+			if injected := bytes.Contains(body, []byte(h.getScriptHtml())); injected != test.want {
+				t.Errorf("injected = %v, want %v", injected, test.want)
+			}
+		})
+	}
+}
+
+func TestLogPrefix(t *testing.T) {
+	tests := []struct {
+		name       string
+		middleware string
+		logPrefix  string
+		want       string
+	}{
+		{"middleware name", "umami@docker", "", "msg=\"[traefik-umami-plugin:umami@docker] hello\""},
+		{"configured prefix", "umami@docker", "shop", "msg=\"[shop] hello\""},
+		{"no name", "", "", "msg=\"[traefik-umami-plugin] hello\""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.LogPrefix = test.logPrefix
+			handler, err := New(context.Background(), http.NotFoundHandler(), config, test.middleware)
+			if err != nil {
+				t.Fatalf("New: %v", err)
+			}
+			h := handler.(*PluginHandler)
+			var logs bytes.Buffer
+			h.LogHandler = log.New(&logs, "", 0)
+
+			h.log("hello")
+			h.warn("hello")
+			lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+			if len(lines) != 2 {
+				t.Fatalf("logged %d lines, want 2: %s", len(lines), logs.String())
+			}
+			for _, line := range lines {
+				if !strings.HasSuffix(line, test.want) {
+					t.Errorf("line %q does not end with %q", line, test.want)
+				}
+			}
+		})
+	}
+}
+
+func TestForceChunkedOutput(t *testing.T) {
+	tests := []struct {
+		name        string
+		force       bool
+		encoding    string
+		wantChunked bool
+	}{
+		{"chunked", true, "", true},
+		{"chunked re-encoded", true, "gzip", true},
+		{"content length", false, "", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ForceChunkedOutput = test.force
+			encoded, err := encodeBody(test.encoding, []byte(testPage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			next := encodedHtmlHandler(t, test.encoding, testPage)
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				// replaced by the injection
+				rw.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+				next.ServeHTTP(rw, req)
+			}))
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL, nil)
+			req.Header.Set("Accept", "text/html")
+			// decoded by the test, not the transport
+			req.Header.Set("Accept-Encoding", "identity")
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			raw, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatalf("reading the body: %v", err)
+			}
+			chunked := len(res.TransferEncoding) == 1 && res.TransferEncoding[0] == "chunked"
+			if chunked != test.wantChunked || (res.ContentLength < 0) != test.wantChunked {
+				t.Errorf("Transfer-Encoding = %v, Content-Length = %d, want chunked %v", res.TransferEncoding, res.ContentLength, test.wantChunked)
+			}
+			body, err := decodeBody(test.encoding, raw)
+			if err != nil {
+				t.Fatalf("decoding the body: %v", err)
+			}
+			if want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1); string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestChunkedUpstreamContentLength(t *testing.T) {
+	tests := []struct {
+		name   string
+		header map[string][]string // set by the upstream
+	}{
+		{"no length", nil},
+		{"chunked", map[string][]string{"Transfer-Encoding": {"chunked"}}},
+		{"empty length", map[string][]string{"Content-Length": {""}}},
+		{"lowercase headers", map[string][]string{"content-length": {""}, "transfer-encoding": {"chunked"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				for name, values := range test.header {
+					rw.Header()[name] = values
+				}
+				// written in chunks
+				for _, part := range strings.SplitAfter(testPage, ">") {
+					_, _ = io.WriteString(rw, part)
+				}
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1)
+			if body := rw.Body.String(); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+			lengths := []string{}
+			for name, values := range rw.Header() {
+				switch strings.ToLower(name) {
+				case "content-length":
+					lengths = append(lengths, values...)
+				case "transfer-encoding":
+					t.Errorf("%s = %q, want it removed", name, values)
+				}
+			}
+			if wantLengths := []string{strconv.Itoa(len(want))}; !reflect.DeepEqual(lengths, wantLengths) {
+				t.Errorf("Content-Length = %q, want %q", lengths, wantLengths)
+			}
+		})
+	}
+}
+
+func TestInjectErrorPages(t *testing.T) {
+	errorPage := `<!DOCTYPE html><html><head><title>500 Internal Server Error</title></head><body><h1>Something went wrong</h1></body></html>`
+	tests := []struct {
+		name      string
+		enabled   bool
+		status    int
+		threshold int // streamThresholdBytes
+		want      bool
+	}{
+		{"500 skipped by default", false, http.StatusInternalServerError, 0, false},
+		{"404 skipped by default", false, http.StatusNotFound, 0, false},
+		{"500", true, http.StatusInternalServerError, 0, true},
+		{"503", true, http.StatusServiceUnavailable, 0, true},
+		{"404", true, http.StatusNotFound, 0, true},
+		{"500 streamed", true, http.StatusInternalServerError, 16, true},
+		{"500 streamed skipped by default", false, http.StatusInternalServerError, 16, false},
+		{"200 by default", false, http.StatusOK, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.InjectErrorPages = test.enabled
+			config.StreamThresholdBytes = test.threshold
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+				rw.WriteHeader(test.status)
+				_, _ = io.WriteString(rw, errorPage)
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			if rw.Code != test.status {
+				t.Errorf("status = %d, want %d", rw.Code, test.status)
+			}
+			want := errorPage
+			if test.want {
+				want = strings.Replace(errorPage, "</body>", h.getScriptHtml()+"</body>", 1)
+			}
+			if body := rw.Body.String(); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+// a writer dropping the end of every write without an error.
+type shortWriter struct {
+	http.ResponseWriter
+}
+
+func (w shortWriter) Write(p []byte) (int, error) {
+	return w.ResponseWriter.Write(p[:len(p)/2])
+}
+
+func TestVerifyInjection(t *testing.T) {
+	stripScript := func(h *PluginHandler) func([]byte) []byte {
+		return func(body []byte) []byte {
+			return bytes.Replace(body, []byte(h.getScriptHtml()), nil, 1)
+		}
+	}
+	keepScript := func(h *PluginHandler) func([]byte) []byte {
+		return func(body []byte) []byte {
+			return append(body, "<!-- x -->"...)
+		}
+	}
+	tests := []struct {
+		name      string
+		enabled   bool
+		transform func(h *PluginHandler) func([]byte) []byte
+		short     bool
+		wantLog   string // empty for no warning
+	}{
+		{"script stripped", true, stripScript, false, "verifyInjection: the script is missing from the body written for /"},
+		{"script kept", true, keepScript, false, ""},
+		{"short write", true, nil, true, "verifyInjection: wrote "},
+		{"disabled", false, stripScript, true, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.VerifyInjection = test.enabled
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			var logs bytes.Buffer
+			h.LogHandler = log.New(&logs, "", 0)
+			if test.transform != nil {
+				h.SetBodyTransform(test.transform(h))
+			}
+
+			rw := httptest.NewRecorder()
+			var w http.ResponseWriter = rw
+			if test.short {
+				w = shortWriter{rw}
+			}
+			h.ServeHTTP(w, htmlRequest(http.MethodGet, "/"))
+			warned := strings.Contains(logs.String(), "verifyInjection")
+			if warned != (test.wantLog != "") || !strings.Contains(logs.String(), test.wantLog) {
+				t.Errorf("logs = %q, want %q", logs.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestDisableKey(t *testing.T) {
+	tests := []struct {
+		name        string
+		key         interface{}
+		value       interface{}
+		target      string
+		wantBody    string // SCRIPT marks the umami script
+		wantTracked bool
+	}{
+		{"disabled", DisableKey, true, "/", testPage, false},
+		{"forward path disabled", DisableKey, true, "/_umami/script.js", testPage, false},
+		{"enabled", DisableKey, false, "/", strings.Replace(testPage, "</body>", "SCRIPT</body>", 1), true},
+		{"not a bool", DisableKey, "yes", "/", strings.Replace(testPage, "</body>", "SCRIPT</body>", 1), true},
+		{"other key type", "traefik-umami-plugin-disable", true, "/", strings.Replace(testPage, "</body>", "SCRIPT</body>", 1), true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, _ := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, test.target)
+			req = req.WithContext(context.WithValue(req.Context(), test.key, test.value))
+			rw := serve(h, req)
+			if want := strings.Replace(test.wantBody, "SCRIPT", h.getScriptHtml(), 1); rw.Body.String() != want {
+				t.Errorf("body = %q, want %q", rw.Body.String(), want)
+			}
+			if tracked := len(sink.payloads()) == 1; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestSniffContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		sniff       bool
+		contentType []string // nil for none, empty to suppress the sniffing
+		body        string
+		want        bool
+		wantType    string
+	}{
+		{"html without type", true, nil, testPage, true, "text/html; charset=utf-8"},
+		{"text without type", true, nil, "just text</body>", false, "text/plain; charset=utf-8"},
+		{"sniffing suppressed", true, []string{}, testPage, false, ""},
+		{"explicit type", true, []string{"text/plain"}, testPage, false, "text/plain"},
+		{"disabled", false, nil, testPage, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.SniffContentType = test.sniff
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.contentType != nil {
+					rw.Header()["Content-Type"] = test.contentType
+				}
+				_, _ = io.WriteString(rw, test.body)
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			if injected := strings.Contains(rw.Body.String(), h.getScriptHtml()); injected != test.want {
+				t.Errorf("injected = %v, want %v", injected, test.want)
+			}
+			if test.wantType != "" && rw.Header().Get("Content-Type") != test.wantType {
+				t.Errorf("Content-Type = %q, want %q", rw.Header().Get("Content-Type"), test.wantType)
+			}
+		})
+	}
+}
+
+func TestCreateConfigPreset(t *testing.T) {
+	tests := []struct {
+		preset       string
+		wantErr      bool
+		wantInjected bool
+		wantTracked  bool
+		wantDNT      bool   // the script respects do not track
+		wantCookies  bool   // of forwarded responses
+		wantXFF      string // of a forwarded request from 198.51.100.7
+	}{
+		{preset: PresetMinimal, wantInjected: true, wantCookies: true, wantXFF: "198.51.100.7"},
+		{preset: PresetPrivacy, wantInjected: true, wantDNT: true, wantXFF: "198.51.100.0"},
+		{preset: PresetServerSideOnly, wantTracked: true, wantCookies: true, wantXFF: "198.51.100.7"},
+		{preset: "maximal", wantErr: true},
+		{preset: "", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.preset, func(t *testing.T) {
+			config, err := CreateConfigPreset(test.preset)
+			if test.wantErr {
+				if err == nil || config != nil {
+					t.Errorf("CreateConfigPreset = %+v, %v, want an error", config, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			requests := make(chan *http.Request, 10)
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				requests <- req
+				http.SetCookie(rw, &http.Cookie{Name: "umami.session", Value: "abc"})
+			}))
+			t.Cleanup(umami.Close)
+			// valid once the host and website are set
+			config.UmamiHost = umami.URL
+			config.WebsiteId = "website"
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != "" {
+				t.Fatalf("config issue = %q, want none", field)
+			}
+			h.syncTimeout = time.Second
+			h.config.SyncTracking = true
+
+			page := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			if injected := page != testPage; injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			if dnt := strings.Contains(page, "data-do-not-track='true'"); dnt != test.wantDNT {
+				t.Errorf("do not track = %v, want %v", dnt, test.wantDNT)
+			}
+			select {
+			case <-requests:
+				if !test.wantTracked {
+					t.Error("the page was tracked server side")
+				}
+			default:
+				if test.wantTracked {
+					t.Error("the page was not tracked server side")
+				}
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/_umami/api/send", nil)
+			req.RemoteAddr = "198.51.100.7:4000"
+			forwarded := serve(h, req)
+			if cookies := forwarded.Header().Get("Set-Cookie") != ""; cookies != test.wantCookies {
+				t.Errorf("Set-Cookie forwarded = %v, want %v", cookies, test.wantCookies)
+			}
+			if xff := (<-requests).Header.Get("X-Forwarded-For"); xff != test.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", xff, test.wantXFF)
+			}
+		})
+	}
+}
+
+func TestStreamThresholdBytes(t *testing.T) {
+	filler := strings.Repeat("x", 200)
+	early := "<html><body><p>early</p></body></html><!-- " + filler + " -->"
+	late := "<html><body><p>" + filler + "</p></body></html>"
+	legacy := "<!DOCTYPE html><html><!-- " + filler + " --><body></body></html>"
+	tests := []struct {
+		name         string
+		page         string
+		transform    bool
+		wantInjected bool
+		wantBuffered bool // the whole body was buffered, so it has a length
+	}{
+		{"marker before the threshold", early, false, true, false},
+		{"marker after the threshold", late, false, false, false},
+		{"no legacy anchors at the threshold", legacy, false, false, false},
+		{"below the threshold", "<body><p>short</p></body>", false, true, true},
+		{"buffered for a body transform", late, true, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.StreamThresholdBytes = 64
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				for page := test.page; page != ""; {
+					n := 16
+					if n > len(page) {
+						n = len(page)
+					}
+					_, _ = io.WriteString(rw, page[:n])
+					page = page[n:]
+				}
+			}))
+			if test.transform {
+				h.SetBodyTransform(func(body []byte) []byte { return body })
+			}
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+
+			want := test.page
+			if test.wantInjected {
+				want = strings.Replace(test.page, "</body>", h.getScriptHtml()+"</body>", 1)
+			}
+			if body := rw.Body.String(); body != want {
+				t.Errorf("body = %q\nwant %q", body, want)
+			}
+			if hasLength := rw.Header().Get("Content-Length") != ""; hasLength != test.wantBuffered {
+				t.Errorf("Content-Length = %q, want buffered %v", rw.Header().Get("Content-Length"), test.wantBuffered)
+			}
+		})
+	}
+}
+
+func TestInjectPagePathAttr(t *testing.T) {
+	tests := []struct {
+		name   string
+		enable bool
+		evade  bool
+		target string
+		want   string
+	}{
+		{"tag", true, false, "/docs/intro", " data-page-path='/docs/intro' data-website-id='"},
+		{"evade", true, true, "/docs/intro", "el.setAttribute('data-page-path', '/docs/intro');el.setAttribute('data-website-id'"},
+		{"quote escaped", true, true, "/it's", "el.setAttribute('data-page-path', '/it%27s');"},
+		{"query left out", true, false, "/search?q=1", " data-page-path='/search' "},
+		{"disabled", false, false, "/docs/intro", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.InjectPagePathAttr = test.enable
+			config.EvadeGoogleTagManager = test.evade
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			body := serve(h, htmlRequest(http.MethodGet, test.target)).Body.String()
+
+			if test.want == "" {
+				if strings.Contains(body, "data-page-path") {
+					t.Errorf("body = %q, want no data-page-path", body)
+				}
+				return
+			}
+			if !strings.Contains(body, test.want) {
+				t.Errorf("body = %q, want it to contain %q", body, test.want)
+			}
+		})
+	}
+}
+
+func TestEventStreamBypass(t *testing.T) {
+	const events = "data: one\n\ndata: two\n\n"
+	tests := []struct {
+		name        string
+		contentType string
+		flushFirst  bool // the header is flushed before the first event
+		wantStream  bool
+	}{
+		{"html shell", "text/html", false, false},
+		{"event stream", "text/event-stream", false, true},
+		{"event stream with charset", "Text/Event-Stream; charset=utf-8", false, true},
+		{"header flushed first", "text/event-stream", true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			release := make(chan struct{})
+			var releaseOnce sync.Once
+			releaseAll := func() { releaseOnce.Do(func() { close(release) }) }
+			t.Cleanup(releaseAll)
+			page := testPage
+			if test.wantStream {
+				page = events
+			}
+			first, rest := page[:10], page[10:]
+			h := newTestPlugin(t, testConfig(), http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", test.contentType)
+				flusher := rw.(http.Flusher)
+				if test.flushFirst {
+					flusher.Flush()
+					<-release
+				}
+				_, _ = io.WriteString(rw, first)
+				flusher.Flush()
+				<-release
+				_, _ = io.WriteString(rw, rest)
+			}))
+			server := httptest.NewServer(h)
+			t.Cleanup(server.Close)
+			if !test.wantStream {
+				// buffered until the upstream returns
+				releaseAll()
+			}
+
+			req, _ := http.NewRequest(http.MethodGet, server.URL+"/", nil)
+			req.Header.Set("Accept", "text/html,text/event-stream")
+			responses := make(chan *http.Response, 1)
+			go func() {
+				res, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					close(responses)
+					return
+				}
+				responses <- res
+			}()
+			var res *http.Response
+			select {
+			case res = <-responses:
+			case <-time.After(5 * time.Second):
+				t.Fatal("the header was not sent before the upstream returned")
+			}
+			if res == nil {
+				return
+			}
+			defer res.Body.Close()
+			if test.wantStream {
+				if res.ContentLength != -1 {
+					t.Errorf("ContentLength = %d, want it streamed", res.ContentLength)
+				}
+				if test.flushFirst {
+					releaseAll()
+				}
+				got := make([]byte, len(first))
+				if _, err := io.ReadFull(res.Body, got); err != nil || string(got) != first {
+					t.Fatalf("first event = %q (%v), want %q", got, err, first)
+				}
+				releaseAll()
+			}
+			body, _ := io.ReadAll(res.Body)
+			want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1)
+			if test.wantStream {
+				body = append([]byte(first), body...)
+				want = events
+			}
+			if string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentInjections(t *testing.T) {
+	tests := []struct {
+		name         string
+		max          int
+		inFlight     int // requests held in the upstream
+		wantInjected bool
+		wantIssue    string
+	}{
+		{name: "unlimited", max: 0, inFlight: 2, wantInjected: true},
+		{name: "below the cap", max: 3, inFlight: 2, wantInjected: true},
+		{name: "saturated", max: 2, inFlight: 2, wantInjected: false},
+		{name: "invalid", max: -1, wantIssue: "maxConcurrentInjections"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entered := make(chan struct{}, test.inFlight)
+			release := make(chan struct{})
+			config := testConfig()
+			config.MaxConcurrentInjections = test.max
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if req.URL.Path == "/held" {
+					entered <- struct{}{}
+					<-release
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			logs := &syncBuffer{}
+			h.LogHandler = log.New(logs, "", 0)
+			injected := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1)
+
+			var held sync.WaitGroup
+			for i := 0; i < test.inFlight; i++ {
+				held.Add(1)
+				go func() {
+					defer held.Done()
+					if body := serve(h, htmlRequest(http.MethodGet, "/held")).Body.String(); body != injected {
+						t.Errorf("held body = %q, want it injected", body)
+					}
+				}()
+			}
+			for i := 0; i < test.inFlight; i++ {
+				<-entered
+			}
+			want := testPage
+			if test.wantInjected {
+				want = injected
+			}
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+			if logged := strings.Contains(logs.String(), "maxConcurrentInjections reached"); logged == test.wantInjected {
+				t.Errorf("logs = %q, want the cap logged %v", logs.String(), !test.wantInjected)
+			}
+			close(release)
+			held.Wait()
+
+			// the slots are given back
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != injected {
+				t.Errorf("body after release = %q, want it injected", body)
+			}
+		})
+	}
+}
+
+// what New logs to stdout before the logger of a test can be set.
+func newPluginLoggingTo(t *testing.T, config *Config) (*PluginHandler, string) {
+	t.Helper()
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := make(chan string)
+	go func() {
+		logged, _ := io.ReadAll(reader)
+		output <- string(logged)
+	}()
+	stdout := os.Stdout
+	os.Stdout = writer
+	handler, err := New(context.Background(), htmlHandler("text/html", testPage), config, "test")
+	os.Stdout = stdout
+	_ = writer.Close()
+	logged := <-output
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	return handler.(*PluginHandler), logged
+}
+
+func TestInvalidConfigLogging(t *testing.T) {
+	tests := []struct {
+		name           string
+		websiteId      string
+		logLevel       string
+		wantErrors     int // at startup
+		wantIssues     string
+		wantRequestLog bool
+	}{
+		{"valid", "website", "info", 0, "", false},
+		{"invalid", "", "info", 1, "websiteId is not set", false},
+		{"invalid with debug", "", "debug", 1, "websiteId is not set", true},
+		{"invalid logLevel", "website", "loud", 1, "logLevel is not valid", false},
+		{"invalid only logged at error", "", "error", 1, "websiteId is not set", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.WebsiteId = test.websiteId
+			config.LogLevel = test.logLevel
+			h, startup := newPluginLoggingTo(t, config)
+			if errorLines := strings.Count(startup, "level=error"); errorLines != test.wantErrors {
+				t.Errorf("startup logged %d errors, want %d:\n%s", errorLines, test.wantErrors, startup)
+			}
+			if test.wantIssues != "" && !strings.Contains(startup, "passing all requests through: "+test.wantIssues) {
+				t.Errorf("startup = %q, want the issues %q summarized", startup, test.wantIssues)
+			}
+
+			logs := &syncBuffer{}
+			h.LogHandler = log.New(logs, "", 0)
+			for i := 0; i < 3; i++ {
+				serve(h, htmlRequest(http.MethodGet, "/"))
+			}
+			notices := strings.Count(logs.String(), "config is invalid, passing / through")
+			if test.wantRequestLog && notices != 3 {
+				t.Errorf("logged %d request notices, want 3:\n%s", notices, logs.String())
+			}
+			if !test.wantRequestLog && logs.String() != "" {
+				t.Errorf("requests logged %q, want nothing", logs.String())
+			}
+		})
+	}
+}
+
+// a writer failing after limit bytes, counting the writes.
+type failingWriter struct {
+	*httptest.ResponseRecorder
+	limit   int
+	writes  int
+	headers int
+}
+
+func (w *failingWriter) WriteHeader(statusCode int) {
+	w.headers++
+	w.ResponseRecorder.WriteHeader(statusCode)
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	if w.limit < 0 {
+		return w.ResponseRecorder.Write(p)
+	}
+	n := w.limit - w.ResponseRecorder.Body.Len()
+	if n > len(p) {
+		n = len(p)
+	}
+	if n < 0 {
+		n = 0
+	}
+	_, _ = w.ResponseRecorder.Write(p[:n])
+	return n, errors.New("connection reset")
+}
+
+func TestInjectedWriteError(t *testing.T) {
+	tests := []struct {
+		name         string
+		limit        int // bytes written before the error, negative for none
+		wantInjected bool
+	}{
+		{"written", -1, true},
+		{"failing at once", 0, false},
+		{"failing midway", 40, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), htmlHandler("text/html", testPage))
+			logs := &syncBuffer{}
+			h.LogHandler = log.New(logs, "", 0)
+			rw := &failingWriter{ResponseRecorder: httptest.NewRecorder(), limit: test.limit}
+			h.ServeHTTP(rw, htmlRequest(http.MethodGet, "/"))
+
+			injected := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1)
+			if rw.writes != 1 || rw.headers != 1 {
+				t.Errorf("wrote %d bodies and %d headers, want 1 each", rw.writes, rw.headers)
+			}
+			// the partial injected body, never followed by the original
+			if body := rw.Body.String(); !strings.HasPrefix(injected, body) {
+				t.Errorf("body = %q, want a prefix of %q", body, injected)
+			}
+			if length := rw.Header().Get("Content-Length"); length != strconv.Itoa(len(injected)) {
+				t.Errorf("Content-Length = %q, want %d", length, len(injected))
+			}
+			if got := atomic.LoadUint64(&h.counters.injected); (got == 1) != test.wantInjected {
+				t.Errorf("counted %d injected, want injected %v", got, test.wantInjected)
+			}
+			if logged := strings.Contains(logs.String(), "could not write injected body of /"); logged == test.wantInjected {
+				t.Errorf("logs = %q, want the write error logged %v", logs.String(), !test.wantInjected)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package traefik_umami_plugin
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// returned instead of contacting umami while the circuit is open.
+var errCircuitOpen = errors.New("umami circuit is open")
+
+// stops forwarding & tracking to umami after threshold consecutive failures
+// once the cooldown is over a single probe is let through, its result
+// closes the circuit again or reopens it for another cooldown.
+type circuitBreaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// check if a request to umami may be made.
+func (c *circuitBreaker) allow(now time.Time) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.failures < c.threshold {
+		return true
+	}
+	if now.Before(c.openUntil) {
+		return false
+	}
+	// half-open, requests racing the probe wait for another cooldown
+	c.openUntil = now.Add(c.cooldown)
+	return true
+}
+
+// records the outcome of a request to umami.
+func (c *circuitBreaker) record(now time.Time, failed bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !failed {
+		c.failures = 0
+		return
+	}
+	c.failures++
+	if c.failures >= c.threshold {
+		c.openUntil = now.Add(c.cooldown)
+	}
+}
+
+// transport errors and 5xx count as umami being down, 4xx don't.
+func isUmamiFailure(err error) bool {
+	var statusErr *trackingStatusError
+	if errors.As(err, &statusErr) {
+		return statusErr.status >= 500
+	}
+	var retryErr *retryAfterError
+	if errors.As(err, &retryErr) {
+		return retryErr.status >= 500
+	}
+	return err != nil
+}
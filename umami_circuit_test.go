@@ -0,0 +1,131 @@
+package traefik_umami_plugin
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	type step struct {
+		after     time.Duration
+		wantAllow bool
+		failed    bool // recorded if allowed
+	}
+	tests := []struct {
+		name  string
+		steps []step
+	}{
+		{"closed below the threshold", []step{{0, true, true}, {0, true, true}, {0, true, false}, {0, true, true}}},
+		{"opens at the threshold", []step{{0, true, true}, {0, true, true}, {0, true, true}, {time.Second, false, false}}},
+		{"half-open after the cooldown", []step{{0, true, true}, {0, true, true}, {0, true, true}, {10 * time.Second, true, false}, {10 * time.Second, true, false}}},
+		{"failed probe reopens", []step{{0, true, true}, {0, true, true}, {0, true, true}, {10 * time.Second, true, true}, {15 * time.Second, false, false}, {20 * time.Second, true, false}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			circuit := &circuitBreaker{threshold: 3, cooldown: 10 * time.Second}
+			for i, s := range test.steps {
+				now := start.Add(s.after)
+				if allowed := circuit.allow(now); allowed != s.wantAllow {
+					t.Fatalf("step %d: allow = %v, want %v", i, allowed, s.wantAllow)
+				}
+				if s.wantAllow {
+					circuit.record(now, s.failed)
+				}
+			}
+		})
+	}
+	t.Run("requests racing the probe", func(t *testing.T) {
+		circuit := &circuitBreaker{threshold: 1, cooldown: 10 * time.Second}
+		circuit.record(start, true)
+		if !circuit.allow(start.Add(10 * time.Second)) {
+			t.Fatal("probe not allowed")
+		}
+		if circuit.allow(start.Add(10 * time.Second)) {
+			t.Error("second request allowed while the probe is out")
+		}
+	})
+}
+
+func TestIsUmamiFailure(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"success", nil, false},
+		{"transport", errors.New("connection refused"), true},
+		{"500", &trackingStatusError{status: 500}, true},
+		{"404", &trackingStatusError{status: 404}, false},
+		{"429", &retryAfterError{status: 429, delay: time.Second}, false},
+		{"503", &retryAfterError{status: 503, delay: time.Second}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isUmamiFailure(test.err); got != test.want {
+				t.Errorf("isUmamiFailure = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCircuitForwardAndTracking(t *testing.T) {
+	var hits uint64
+	var down int32 = 1
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		atomic.AddUint64(&hits, 1)
+		if atomic.LoadInt32(&down) == 1 {
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer umami.Close()
+
+	config := testConfig()
+	config.UmamiHost = umami.URL
+	config.ScriptInjection = false
+	config.ServerSideTracking = true
+	config.SyncTracking = true
+	config.CircuitThreshold = 2
+	config.CircuitCooldown = "50ms"
+	h := newTestPlugin(t, config, http.NotFoundHandler())
+
+	tests := []struct {
+		name       string
+		target     string
+		wantStatus int
+		wantHits   uint64 // umami requests so far
+	}{
+		{"forward fails", "/_umami/script.js", http.StatusBadGateway, 1},
+		{"tracking fails and opens", "/", http.StatusNotFound, 2},
+		{"forward fails fast", "/_umami/script.js", http.StatusServiceUnavailable, 2},
+		{"tracking dropped", "/", http.StatusNotFound, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if rw := serve(h, httptest.NewRequest(http.MethodGet, test.target, nil)); rw.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", rw.Code, test.wantStatus)
+			}
+			if got := atomic.LoadUint64(&hits); got != test.wantHits {
+				t.Errorf("umami got %d requests, want %d", got, test.wantHits)
+			}
+		})
+	}
+
+	// recovered umami closes the circuit with the probe after the cooldown
+	atomic.StoreInt32(&down, 0)
+	time.Sleep(60 * time.Millisecond)
+	for i := 0; i < 2; i++ {
+		if rw := serve(h, httptest.NewRequest(http.MethodGet, "/_umami/script.js", nil)); rw.Code != http.StatusOK {
+			t.Errorf("status after recovery = %d, want 200", rw.Code)
+		}
+	}
+	if got := atomic.LoadUint64(&hits); got != 4 {
+		t.Errorf("umami got %d requests, want 4", got)
+	}
+}
@@ -0,0 +1,156 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const scriptTagRegexPattern = `(?is)<script([^>]*)>(.*?)</script>`
+
+var scriptTagRegex = regexp.MustCompile(scriptTagRegexPattern)
+
+const scriptNonceRegexPattern = `\snonce='([^']*)'`
+
+var scriptNonceRegex = regexp.MustCompile(scriptNonceRegexPattern)
+
+// a random nonce for the scripts of one response.
+func newCSPNonce() (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(nonce), nil
+}
+
+// sets the nonce on every script tag of the script html.
+func withScriptNonce(scriptHtml string, nonce string) string {
+	return strings.ReplaceAll(scriptHtml, "<script", fmt.Sprintf("<script nonce='%s'", nonce))
+}
+
+// the script-src sources the script html needs, 'self' for scripts loaded
+// through the forwardPath and the hashes of inline scripts
+// scripts with a generated nonce add it as well, the loaders recreating
+// scripts can't pass it on.
+func cspScriptSources(scriptHtml string) []string {
+	sources := []string{}
+	for _, match := range scriptTagRegex.FindAllStringSubmatch(scriptHtml, -1) {
+		attributes, content := match[1], match[2]
+		if nonce := scriptNonceRegex.FindStringSubmatch(attributes); nonce != nil {
+			sources = append(sources, "'nonce-"+nonce[1]+"'")
+		}
+		if strings.Contains(attributes, "src=") {
+			sources = append(sources, "'self'")
+		} else if content != "" {
+			sum := sha256.Sum256([]byte(content))
+			sources = append(sources, "'sha256-"+base64.StdEncoding.EncodeToString(sum[:])+"'")
+		}
+	}
+	// the evade loader sets the src from js
+	if strings.Contains(scriptHtml, "el.setAttribute('src'") {
+		sources = append(sources, "'self'")
+	}
+	return sources
+}
+
+// check if the response has a csp, enforced or report only.
+func hasCSP(header http.Header) bool {
+	return len(header.Values("Content-Security-Policy")) > 0 || len(header.Values("Content-Security-Policy-Report-Only")) > 0
+}
+
+// adds the sources the injected script needs to the csp headers
+// existing directives are only appended to, never removed.
+func patchCSP(header http.Header, scriptHtml string) {
+	scriptSources := cspScriptSources(scriptHtml)
+	for _, name := range []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"} {
+		values := header.Values(name)
+		if len(values) == 0 {
+			continue
+		}
+		header.Del(name)
+		for _, value := range values {
+			policies := strings.Split(value, ",")
+			for i, policy := range policies {
+				policies[i] = patchCSPPolicy(policy, scriptSources)
+			}
+			header.Add(name, strings.Join(policies, ", "))
+		}
+	}
+}
+
+// appends the script sources to script-src and 'self' to connect-src
+// a directive missing in favor of default-src is added with its sources.
+func patchCSPPolicy(policy string, scriptSources []string) string {
+	directives := [][]string{}
+	index := map[string]int{}
+	for _, directive := range strings.Split(policy, ";") {
+		fields := strings.Fields(directive)
+		if len(fields) == 0 {
+			continue
+		}
+		name := strings.ToLower(fields[0])
+		// browsers ignore repeated directives
+		if _, ok := index[name]; !ok {
+			index[name] = len(directives)
+		}
+		directives = append(directives, fields)
+	}
+
+	additions := []struct {
+		name    string
+		sources []string
+	}{
+		{"script-src", scriptSources},
+		{"connect-src", []string{"'self'"}},
+	}
+	for _, addition := range additions {
+		i, ok := index[addition.name]
+		if !ok {
+			defaultIndex, ok := index["default-src"]
+			if !ok {
+				// nothing restricts the directive
+				continue
+			}
+			directive := append([]string{addition.name}, directives[defaultIndex][1:]...)
+			directives = append(directives, directive)
+			i = len(directives) - 1
+		}
+		directives[i] = appendCSPSources(directives[i], addition.sources)
+	}
+
+	rendered := make([]string, len(directives))
+	for i, directive := range directives {
+		rendered[i] = strings.Join(directive, " ")
+	}
+	return strings.Join(rendered, "; ")
+}
+
+// appends the sources missing in the directive
+// hashes and nonces are skipped where they would disable 'unsafe-inline'.
+func appendCSPSources(directive []string, sources []string) []string {
+	existing := map[string]bool{}
+	hasHashOrNonce := false
+	for _, source := range directive[1:] {
+		source = strings.ToLower(source)
+		existing[source] = true
+		if strings.HasPrefix(source, "'sha") || strings.HasPrefix(source, "'nonce-") {
+			hasHashOrNonce = true
+		}
+	}
+	for _, source := range sources {
+		if existing[strings.ToLower(source)] {
+			continue
+		}
+		isHashOrNonce := strings.HasPrefix(source, "'sha") || strings.HasPrefix(source, "'nonce-")
+		if isHashOrNonce && existing["'unsafe-inline'"] && !hasHashOrNonce {
+			continue
+		}
+		existing[strings.ToLower(source)] = true
+		directive = append(directive, source)
+	}
+	return directive
+}
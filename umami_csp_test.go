@@ -0,0 +1,133 @@
+package traefik_umami_plugin
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestPatchCSPPolicy(t *testing.T) {
+	hash := "'sha256-abc='"
+	tests := []struct {
+		name    string
+		policy  string
+		sources []string
+		want    string
+	}{
+		{"appended", "script-src https://cdn.test; connect-src https://api.test", []string{"'self'"}, "script-src https://cdn.test 'self'; connect-src https://api.test 'self'"},
+		{"existing source kept once", "script-src 'SELF'; connect-src 'self'", []string{"'self'"}, "script-src 'SELF'; connect-src 'self'"},
+		{"other directives preserved", "img-src *; script-src 'none'; frame-ancestors 'none'; report-uri /csp", []string{"'self'"}, "img-src *; script-src 'none' 'self'; frame-ancestors 'none'; report-uri /csp"},
+		{"from default-src", "default-src https://cdn.test", []string{"'self'"}, "default-src https://cdn.test; script-src https://cdn.test 'self'; connect-src https://cdn.test 'self'"},
+		{"unrestricted", "img-src *", []string{"'self'"}, "img-src *"},
+		{"repeated directive", "script-src a.test; script-src b.test", []string{"'self'"}, "script-src a.test 'self'; script-src b.test"},
+		{"uppercase directive", "SCRIPT-SRC a.test", []string{"'self'"}, "SCRIPT-SRC a.test 'self'"},
+		{"hash", "script-src 'self'", []string{hash}, "script-src 'self' " + hash},
+		{"hash kept from unsafe-inline", "script-src 'unsafe-inline'", []string{hash}, "script-src 'unsafe-inline'"},
+		{"hash with other hashes", "script-src 'unsafe-inline' 'sha256-xyz='", []string{hash}, "script-src 'unsafe-inline' 'sha256-xyz=' " + hash},
+		{"empty directives", " ; script-src a.test;; ", []string{"'self'"}, "script-src a.test 'self'"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := patchCSPPolicy(test.policy, test.sources); got != test.want {
+				t.Errorf("patchCSPPolicy(%q) = %q, want %q", test.policy, got, test.want)
+			}
+		})
+	}
+}
+
+func TestPatchCSP(t *testing.T) {
+	tests := []struct {
+		name     string
+		patchCSP bool
+		header   string
+		values   []string
+		want     []string
+	}{
+		{"patched", true, "Content-Security-Policy", []string{"default-src 'none'; img-src *"}, []string{"default-src 'none'; img-src *; script-src 'none' 'self'; connect-src 'none' 'self'"}},
+		{"report only", true, "Content-Security-Policy-Report-Only", []string{"script-src a.test"}, []string{"script-src a.test 'self'"}},
+		{"every policy", true, "Content-Security-Policy", []string{"script-src a.test, connect-src b.test", "img-src *"}, []string{"script-src a.test 'self', connect-src b.test 'self'", "img-src *"}},
+		{"disabled", false, "Content-Security-Policy", []string{"script-src a.test"}, []string{"script-src a.test"}},
+		{"no csp", true, "Content-Security-Policy", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.PatchCSP = test.patchCSP
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				for _, value := range test.values {
+					rw.Header().Add(test.header, value)
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = rw.Write([]byte(testPage))
+			}))
+			rw := serve(h, htmlRequest(http.MethodGet, "/"))
+			got := rw.Header().Values(test.header)
+			if len(got) != len(test.want) {
+				t.Fatalf("%s = %q, want %q", test.header, got, test.want)
+			}
+			for i := range test.want {
+				if got[i] != test.want[i] {
+					t.Errorf("%s = %q, want %q", test.header, got[i], test.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGenerateCSPNonce(t *testing.T) {
+	tests := []struct {
+		name      string
+		generate  bool
+		csp       string // of the upstream, empty for none
+		wantNonce bool
+	}{
+		{"nonce in tag and csp", true, "script-src 'self'", true},
+		{"from default-src", true, "default-src 'none'", true},
+		{"no csp", true, "", false},
+		{"disabled", false, "script-src 'self'", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.PatchCSP = true
+			config.GenerateCSPNonce = test.generate
+			config.BeforeSend = "scrub"
+			config.BeforeSendScript = "function scrub(t, p) { return p; }"
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.csp != "" {
+					rw.Header().Set("Content-Security-Policy", test.csp)
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = rw.Write([]byte(testPage))
+			}))
+
+			nonces := map[string]bool{}
+			for i := 0; i < 2; i++ {
+				rw := serve(h, htmlRequest(http.MethodGet, "/"))
+				body, csp := rw.Body.String(), rw.Header().Get("Content-Security-Policy")
+				matches := scriptNonceRegex.FindAllStringSubmatch(body, -1)
+				if !test.wantNonce {
+					if len(matches) != 0 || strings.Contains(csp, "'nonce-") {
+						t.Fatalf("body %q, csp %q have a nonce", body, csp)
+					}
+					if test.csp == "" && csp != "" {
+						t.Errorf("csp = %q added to a page without one", csp)
+					}
+					return
+				}
+				// the helper and the umami script
+				if len(matches) != 2 || matches[0][1] != matches[1][1] || matches[0][1] == "" {
+					t.Fatalf("nonces = %q, want the same one on both scripts", matches)
+				}
+				nonce := matches[0][1]
+				if !strings.Contains(csp, "script-src") || !strings.Contains(csp, "'nonce-"+nonce+"'") {
+					t.Errorf("csp %q does not allow the nonce %s", csp, nonce)
+				}
+				nonces[nonce] = true
+			}
+			if len(nonces) != 2 {
+				t.Errorf("nonces %v are reused across responses", nonces)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// upper bound for sample documents posted to the diagnostics.
+const maxDiagnosticsBodyBytes = 10 << 20
+
+// result of matching the injection anchors against a sample document.
+type injectDiagnostics struct {
+	Matched   bool `json:"matched"`
+	Offset    int  `json:"offset"`
+	NewLength int  `json:"newLength"`
+}
+
+// validity of the config and the invalid options.
+type configDiagnostics struct {
+	Valid  bool          `json:"valid"`
+	Issues []ConfigIssue `json:"issues"`
+}
+
+// injection success rate of the rolling window, null without html responses.
+type statsDiagnostics struct {
+	HtmlResponses int      `json:"htmlResponses"`
+	Injected      int      `json:"injected"`
+	InjectionRate *float64 `json:"injectionRate"`
+	DroppedEvents uint64   `json:"droppedEvents"`
+}
+
+// check if the request targets a diagnostics endpoint
+// eg. /<forwardPath>/test-inject, only if diagnostics are enabled.
+func isDiagnosticsPath(req *http.Request, config *Config, endpoint string) bool {
+	return config.Diagnostics && req.URL.Path == fmt.Sprintf("/%s/%s", config.ForwardPath, endpoint)
+}
+
+// reports where the anchors match in the posted html
+// and how long the injected document would be.
+func (h *PluginHandler) serveTestInject(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		rw.Header().Set("Allow", http.MethodPost)
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, maxDiagnosticsBodyBytes))
+	if err != nil {
+		rw.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	result := injectDiagnostics{Matched: false, Offset: -1, NewLength: len(body)}
+	for _, rule := range h.injections {
+		offset, _ := rule.find(body)
+		if offset >= 0 && (!result.Matched || offset < result.Offset) {
+			result.Matched = true
+			result.Offset = offset
+		}
+	}
+	scriptHtml := h.getScriptHtmlFor(req)
+	if result.Matched {
+		result.NewLength = len(injectAll(body, h.injections, scriptHtml))
+	} else if h.config.OnMissingAnchor == MAModeAppend {
+		result.NewLength = len(body) + len(scriptHtml)
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err = json.NewEncoder(rw).Encode(result)
+	if err != nil {
+		h.log(err.Error())
+	}
+}
+
+// reports whether the config is valid and which options are not.
+func (h *PluginHandler) serveConfigIssues(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	result := configDiagnostics{Valid: h.configIsValid, Issues: h.configIssues}
+	if result.Issues == nil {
+		result.Issues = []ConfigIssue{}
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(result)
+	if err != nil {
+		h.log(err.Error())
+	}
+}
+
+// reports the injection success rate of the last statsBuckets minutes, a drop
+// hints at pages the anchors don't match anymore.
+func (h *PluginHandler) serveStats(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodGet && req.Method != http.MethodHead {
+		rw.Header().Set("Allow", "GET, HEAD")
+		rw.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	html, injected := h.stats.totals(time.Now())
+	result := statsDiagnostics{HtmlResponses: html, Injected: injected, DroppedEvents: atomic.LoadUint64(&h.droppedEvents)}
+	if html > 0 {
+		rate := float64(injected) / float64(html)
+		result.InjectionRate = &rate
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(rw).Encode(result)
+	if err != nil {
+		h.log(err.Error())
+	}
+}
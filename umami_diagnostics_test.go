@@ -0,0 +1,178 @@
+package traefik_umami_plugin
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeTestInject(t *testing.T) {
+	tests := []struct {
+		name        string
+		diagnostics bool
+		method      string
+		sample      string
+		onMissing   string
+		wantStatus  int
+		wantMatched bool
+		wantOffset  int
+		wantGrowth  bool // newLength is the sample plus the script
+	}{
+		{"matched", true, http.MethodPost, testPage, "", http.StatusOK, true, strings.Index(testPage, "</body>"), true},
+		{"not matched", true, http.MethodPost, "<head></head><div>", "", http.StatusOK, false, -1, false},
+		{"not matched, appended", true, http.MethodPost, "<head></head><div>", MAModeAppend, http.StatusOK, false, -1, true},
+		{"GET", true, http.MethodGet, "", "", http.StatusMethodNotAllowed, false, 0, false},
+		{"disabled", false, http.MethodPost, testPage, "", http.StatusNotFound, false, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Diagnostics = test.diagnostics
+			if test.onMissing != "" {
+				config.OnMissingAnchor = test.onMissing
+			}
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+			rw := serve(h, httptest.NewRequest(test.method, "/_umami/test-inject", strings.NewReader(test.sample)))
+			if rw.Code != test.wantStatus {
+				t.Fatalf("status = %d, want %d", rw.Code, test.wantStatus)
+			}
+			if test.wantStatus != http.StatusOK {
+				return
+			}
+			var result injectDiagnostics
+			if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+				t.Fatalf("%s: %v", rw.Body.String(), err)
+			}
+			wantLength := len(test.sample)
+			if test.wantGrowth {
+				wantLength += len(h.getScriptHtml())
+			}
+			want := injectDiagnostics{Matched: test.wantMatched, Offset: test.wantOffset, NewLength: wantLength}
+			if result != want {
+				t.Errorf("diagnostics = %+v, want %+v", result, want)
+			}
+		})
+	}
+}
+
+func TestConfigIssues(t *testing.T) {
+	tests := []struct {
+		name       string
+		configure  func(config *Config)
+		wantIssues []ConfigIssue
+	}{
+		{"valid", func(config *Config) {}, []ConfigIssue{}},
+		{"missing host and website", func(config *Config) {
+			config.UmamiHost = ""
+			config.WebsiteId = ""
+		}, []ConfigIssue{{"umamiHost", "is not set"}, {"websiteId", "is not set"}}},
+		{"invalid modes", func(config *Config) {
+			config.ScriptInjectionMode = "inline"
+			config.OnMissingAnchor = "panic"
+		}, []ConfigIssue{{"scriptInjectionMode", "is not valid"}, {"onMissingAnchor", "is not valid"}}},
+		{"invalid entries", func(config *Config) {
+			config.TrustedProxies = []string{"10.0.0.0/8", "proxy"}
+			config.SkipInjectUserAgents = []string{"("}
+		}, []ConfigIssue{{"trustedProxies", "entry proxy is not a valid CIDR"}, {"skipInjectUserAgents", "entry ( is not valid: error parsing regexp: missing closing ): `(?i)(`"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Diagnostics = true
+			test.configure(config)
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+
+			rw := serve(h, httptest.NewRequest(http.MethodGet, "/_umami/config", nil))
+			if rw.Code != http.StatusOK {
+				t.Fatalf("status = %d, want 200", rw.Code)
+			}
+			var result configDiagnostics
+			if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+				t.Fatalf("%s: %v", rw.Body.String(), err)
+			}
+			want := configDiagnostics{Valid: len(test.wantIssues) == 0, Issues: test.wantIssues}
+			if !reflect.DeepEqual(result, want) {
+				t.Errorf("diagnostics = %+v, want %+v", result, want)
+			}
+		})
+	}
+}
+
+func TestServeStats(t *testing.T) {
+	tests := []struct {
+		name         string
+		pages        []string // served before the stats
+		wantHtml     int
+		wantInjected int
+		wantRate     float64 // -1 for no rate
+	}{
+		{"no html responses", nil, 0, 0, -1},
+		{"all injected", []string{testPage, testPage}, 2, 2, 1},
+		{"mixed", []string{testPage, "<head></head><div>", testPage, "<head></head><div>"}, 4, 2, 0.5},
+		{"none injected", []string{"<head></head><div>"}, 1, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Diagnostics = true
+			page := 0
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = rw.Write([]byte(test.pages[page]))
+				page++
+			}))
+			for range test.pages {
+				serve(h, htmlRequest(http.MethodGet, "/"))
+			}
+			// the stats endpoint itself isn't counted
+			serve(h, httptest.NewRequest(http.MethodGet, "/_umami/stats", nil))
+
+			rw := serve(h, httptest.NewRequest(http.MethodGet, "/_umami/stats", nil))
+			var result statsDiagnostics
+			if err := json.Unmarshal(rw.Body.Bytes(), &result); err != nil {
+				t.Fatalf("%s: %v", rw.Body.String(), err)
+			}
+			if result.HtmlResponses != test.wantHtml || result.Injected != test.wantInjected {
+				t.Errorf("stats = %d of %d injected, want %d of %d", result.Injected, result.HtmlResponses, test.wantInjected, test.wantHtml)
+			}
+			if test.wantRate < 0 {
+				if result.InjectionRate != nil {
+					t.Errorf("injectionRate = %v, want null", *result.InjectionRate)
+				}
+			} else if result.InjectionRate == nil || *result.InjectionRate != test.wantRate {
+				t.Errorf("injectionRate = %v, want %v", result.InjectionRate, test.wantRate)
+			}
+		})
+	}
+}
+
+func TestInjectionStatsWindow(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	stats := &injectionStats{}
+	stats.record(start, true)
+	stats.record(start.Add(time.Minute), false)
+	stats.record(start.Add(5*time.Minute), true)
+	tests := []struct {
+		name         string
+		after        time.Duration
+		wantHtml     int
+		wantInjected int
+	}{
+		{"within the window", 10 * time.Minute, 3, 2},
+		{"first minute left", statsBuckets * time.Minute, 2, 1},
+		{"second minute left", (statsBuckets + 1) * time.Minute, 1, 1},
+		{"all left", (statsBuckets + 5) * time.Minute, 0, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			html, injected := stats.totals(start.Add(test.after))
+			if html != test.wantHtml || injected != test.wantInjected {
+				t.Errorf("totals = %d, %d, want %d, %d", html, injected, test.wantHtml, test.wantInjected)
+			}
+		})
+	}
+}
@@ -0,0 +1,95 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// how long the last resolved addresses are reused after their ttl
+// while resolving the host fails.
+const dnsCacheGrace = 5 * time.Minute
+
+// resolved addresses of the umami host, cached for the ttl.
+type dnsCache struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	lookup  func(ctx context.Context, host string) ([]string, error)
+	entries map[string]dnsEntry
+}
+
+type dnsEntry struct {
+	addrs      []string
+	resolvedAt time.Time
+}
+
+func newDNSCache(ttl time.Duration) *dnsCache {
+	return &dnsCache{
+		ttl:     ttl,
+		lookup:  net.DefaultResolver.LookupHost,
+		entries: map[string]dnsEntry{},
+	}
+}
+
+// the addresses of the host, resolved again once the ttl is over
+// a failing lookup falls back to the last good addresses for the grace period.
+func (c *dnsCache) resolve(ctx context.Context, host string, now time.Time) ([]string, error) {
+	c.mu.Lock()
+	entry, cached := c.entries[host]
+	c.mu.Unlock()
+	if cached && now.Sub(entry.resolvedAt) < c.ttl {
+		return entry.addrs, nil
+	}
+
+	addrs, err := c.lookup(ctx, host)
+	if err == nil && len(addrs) == 0 {
+		err = errors.New("no addresses found for " + host)
+	}
+	if err != nil {
+		if cached && now.Sub(entry.resolvedAt) < c.ttl+dnsCacheGrace {
+			return entry.addrs, nil
+		}
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.entries[host] = dnsEntry{addrs: addrs, resolvedAt: now}
+	c.mu.Unlock()
+	return addrs, nil
+}
+
+// dials the cached addresses of the host in order until one connects.
+func (c *dnsCache) dialContext(dialer *net.Dialer) func(ctx context.Context, network, addr string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) != nil {
+			return dialer.DialContext(ctx, network, addr)
+		}
+		addrs, err := c.resolve(ctx, host, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		var dialErr error
+		for _, ip := range addrs {
+			conn, err := dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+			if err == nil {
+				return conn, nil
+			}
+			dialErr = err
+		}
+		return nil, dialErr
+	}
+}
+
+// the default transport, dialing through the dns cache.
+func newDNSCacheTransport(cache *dnsCache) *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = cache.dialContext(&net.Dialer{Timeout: 30 * time.Second, KeepAlive: 30 * time.Second})
+	return transport
+}
@@ -0,0 +1,121 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// a resolver answering with the addresses on the first lookup and
+// failing afterwards, counting the lookups.
+type flakyResolver struct {
+	addrs   []string
+	lookups int
+}
+
+func (r *flakyResolver) lookup(ctx context.Context, host string) ([]string, error) {
+	r.lookups++
+	if r.lookups > 1 {
+		return nil, errors.New("no such host")
+	}
+	return r.addrs, nil
+}
+
+func TestDNSCacheResolve(t *testing.T) {
+	start := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	ttl := time.Minute
+	tests := []struct {
+		name        string
+		after       time.Duration // since the first lookup
+		wantAddrs   []string
+		wantErr     bool
+		wantLookups int
+	}{
+		{"within the ttl", 30 * time.Second, []string{"10.0.0.1"}, false, 1},
+		{"failing within the grace period", ttl + time.Minute, []string{"10.0.0.1"}, false, 2},
+		{"failing after the grace period", ttl + dnsCacheGrace + time.Second, nil, true, 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			resolver := &flakyResolver{addrs: []string{"10.0.0.1"}}
+			cache := newDNSCache(ttl)
+			cache.lookup = resolver.lookup
+			if _, err := cache.resolve(context.Background(), "umami", start); err != nil {
+				t.Fatal(err)
+			}
+			addrs, err := cache.resolve(context.Background(), "umami", start.Add(test.after))
+			if (err != nil) != test.wantErr || !reflect.DeepEqual(addrs, test.wantAddrs) {
+				t.Errorf("resolve = %v, %v, want %v, error %v", addrs, err, test.wantAddrs, test.wantErr)
+			}
+			if resolver.lookups != test.wantLookups {
+				t.Errorf("looked up %d times, want %d", resolver.lookups, test.wantLookups)
+			}
+		})
+	}
+}
+
+func TestDNSCacheEmptyAnswer(t *testing.T) {
+	cache := newDNSCache(time.Minute)
+	cache.lookup = func(ctx context.Context, host string) ([]string, error) {
+		return []string{}, nil
+	}
+	if _, err := cache.resolve(context.Background(), "umami", time.Now()); err == nil {
+		t.Error("resolved a host without addresses")
+	}
+}
+
+func TestDNSCacheTransport(t *testing.T) {
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		_, _ = io.WriteString(rw, "umami")
+	}))
+	defer umami.Close()
+	_, port, _ := net.SplitHostPort(umami.Listener.Addr().String())
+
+	resolver := &flakyResolver{addrs: []string{"127.0.0.1"}}
+	cache := newDNSCache(time.Nanosecond)
+	cache.lookup = resolver.lookup
+	client := &http.Client{Transport: newDNSCacheTransport(cache)}
+	for i := 0; i < 2; i++ {
+		// a new connection each time, so the second one resolves again
+		res, err := client.Get("http://umami.test:" + port + "/")
+		if err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		client.CloseIdleConnections()
+		if string(body) != "umami" {
+			t.Errorf("request %d: body = %q", i, body)
+		}
+	}
+	if resolver.lookups != 2 {
+		t.Errorf("looked up %d times, want 2", resolver.lookups)
+	}
+}
+
+func TestDNSCacheTTLConfig(t *testing.T) {
+	tests := []struct {
+		ttl       string
+		wantIssue string
+	}{
+		{"", ""},
+		{"30s", ""},
+		{"0s", "dnsCacheTTL"},
+		{"forever", "dnsCacheTTL"},
+	}
+	for _, test := range tests {
+		t.Run(test.ttl, func(t *testing.T) {
+			config := testConfig()
+			config.DNSCacheTTL = test.ttl
+			if field := configIssueField(newTestPlugin(t, config, http.NotFoundHandler())); field != test.wantIssue {
+				t.Errorf("config issue = %q, want %q", field, test.wantIssue)
+			}
+		})
+	}
+}
@@ -0,0 +1,123 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the normalized Content-Encoding of a response, empty for identity.
+func contentEncoding(header http.Header) string {
+	value := header.Get("Content-Encoding")
+	if value == "" {
+		// upstreams may set it bypassing the canonical key
+		for key, values := range header {
+			if strings.EqualFold(key, "Content-Encoding") && len(values) > 0 {
+				value = values[0]
+			}
+		}
+	}
+	encoding := strings.ToLower(strings.TrimSpace(value))
+	if encoding == "identity" {
+		return ""
+	}
+	return encoding
+}
+
+// check if the injection can decode and re-encode the encoding.
+func canDecode(encoding string) bool {
+	switch encoding {
+	case "", "gzip", "x-gzip", "deflate":
+		return true
+	}
+	return false
+}
+
+// check if the response body is encoded with an encoding
+// the injection can't decode (eg. a precompressed .html.br).
+func isPrecompressed(header http.Header) bool {
+	return !canDecode(contentEncoding(header))
+}
+
+// the Accept-Encoding for the upstream request
+// limited to what the injection can decode, so compression ahead of us is kept.
+func decodableAcceptEncoding(acceptEncoding string) string {
+	accepted := []string{}
+	for _, token := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(token, ";")
+		encoding := strings.ToLower(strings.TrimSpace(params[0]))
+		if encoding != "gzip" && encoding != "deflate" {
+			continue
+		}
+		// eg. gzip;q=0 explicitly refuses gzip
+		refused := false
+		for _, param := range params[1:] {
+			param = strings.TrimSpace(param)
+			if !strings.HasPrefix(param, "q=") {
+				continue
+			}
+			if q, err := strconv.ParseFloat(param[2:], 64); err == nil && q == 0 {
+				refused = true
+			}
+		}
+		if !refused {
+			accepted = append(accepted, encoding)
+		}
+	}
+	if len(accepted) == 0 {
+		return "identity"
+	}
+	return strings.Join(accepted, ", ")
+}
+
+func decodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case "deflate":
+		// deflate is zlib wrapped, some servers send raw deflate though
+		reader, err := zlib.NewReader(bytes.NewReader(body))
+		if err != nil {
+			return io.ReadAll(flate.NewReader(bytes.NewReader(body)))
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	}
+	return body, nil
+}
+
+func encodeBody(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		var buf bytes.Buffer
+		writer := gzip.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "deflate":
+		var buf bytes.Buffer
+		writer := zlib.NewWriter(&buf)
+		if _, err := writer.Write(body); err != nil {
+			return nil, err
+		}
+		if err := writer.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return body, nil
+}
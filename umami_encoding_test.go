@@ -0,0 +1,188 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestIsPrecompressed(t *testing.T) {
+	tests := []struct {
+		encoding string
+		want     bool
+	}{
+		{"", false},
+		{"identity", false},
+		{"gzip", false},
+		{"x-gzip", false},
+		{"deflate", false},
+		{" GZIP ", false},
+		{"br", true},
+		{"zstd", true},
+	}
+	for _, test := range tests {
+		t.Run(test.encoding, func(t *testing.T) {
+			header := http.Header{}
+			if test.encoding != "" {
+				header.Set("Content-Encoding", test.encoding)
+			}
+			if got := isPrecompressed(header); got != test.want {
+				t.Errorf("isPrecompressed(%q) = %v, want %v", test.encoding, got, test.want)
+			}
+		})
+	}
+}
+
+func TestDecodableAcceptEncoding(t *testing.T) {
+	tests := []struct {
+		acceptEncoding string
+		want           string
+	}{
+		{"", "identity"},
+		{"br", "identity"},
+		{"gzip, deflate, br, zstd", "gzip, deflate"},
+		{"GZIP;q=0.8", "gzip"},
+		{"gzip;q=0, deflate", "deflate"},
+		{"gzip;q=0", "identity"},
+		{"*", "identity"},
+	}
+	for _, test := range tests {
+		t.Run(test.acceptEncoding, func(t *testing.T) {
+			if got := decodableAcceptEncoding(test.acceptEncoding); got != test.want {
+				t.Errorf("decodableAcceptEncoding(%q) = %q, want %q", test.acceptEncoding, got, test.want)
+			}
+		})
+	}
+}
+
+func TestEncodeDecodeBody(t *testing.T) {
+	for _, encoding := range []string{"", "gzip", "x-gzip", "deflate"} {
+		t.Run(encoding, func(t *testing.T) {
+			encoded, err := encodeBody(encoding, []byte(testPage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := decodeBody(encoding, encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(decoded) != testPage {
+				t.Errorf("decoded %q, want %q", decoded, testPage)
+			}
+		})
+	}
+}
+
+func TestDeflateInjection(t *testing.T) {
+	var raw bytes.Buffer
+	writer, _ := flate.NewWriter(&raw, flate.DefaultCompression)
+	_, _ = writer.Write([]byte(testPage))
+	_ = writer.Close()
+	zlibBody, err := encodeBody("deflate", []byte(testPage))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name         string
+		header       string
+		body         []byte
+		reencode     bool
+		wantEncoding string
+	}{
+		{"zlib", "deflate", zlibBody, true, "deflate"},
+		{"raw deflate", "deflate", raw.Bytes(), true, "deflate"},
+		{"mixed case", "Deflate", zlibBody, true, "deflate"},
+		{"sent decoded", "deflate", zlibBody, false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ReencodeAfterInject = test.reencode
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header().Set("Content-Encoding", test.header)
+				_, _ = rw.Write(test.body)
+			}))
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("Accept-Encoding", "deflate")
+			rw := serve(h, req)
+
+			if encoding := contentEncoding(rw.Header()); encoding != test.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, test.wantEncoding)
+			}
+			if length := rw.Header().Get("Content-Length"); length != strconv.Itoa(rw.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", length, rw.Body.Len())
+			}
+			body := rw.Body.Bytes()
+			if test.wantEncoding != "" {
+				// re-encoded as zlib
+				reader, err := zlib.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatalf("body is not zlib: %v", err)
+				}
+				body, _ = io.ReadAll(reader)
+			}
+			if want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1); string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestReencodeAfterInject(t *testing.T) {
+	tests := []struct {
+		name         string
+		header       string
+		encoding     string
+		reencode     bool
+		wantEncoding string
+	}{
+		{"gzip re-encoded", "Content-Encoding", "gzip", true, "gzip"},
+		{"x-gzip re-encoded", "Content-Encoding", "x-gzip", true, "x-gzip"},
+		{"gzip sent as identity", "Content-Encoding", "gzip", false, ""},
+		{"x-gzip sent as identity", "Content-Encoding", "x-gzip", false, ""},
+		{"non-canonical header re-encoded", "content-encoding", "gzip", true, "gzip"},
+		{"non-canonical header sent as identity", "content-encoding", "gzip", false, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, err := encodeBody(test.encoding, []byte(testPage))
+			if err != nil {
+				t.Fatal(err)
+			}
+			config := testConfig()
+			config.ReencodeAfterInject = test.reencode
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				rw.Header()[test.header] = []string{test.encoding}
+				rw.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+				_, _ = rw.Write(encoded)
+			}))
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("Accept-Encoding", "gzip")
+			rw := serve(h, req)
+
+			if encoding := contentEncoding(rw.Header()); encoding != test.wantEncoding {
+				t.Errorf("Content-Encoding = %q, want %q", encoding, test.wantEncoding)
+			}
+			if values := len(rw.Header().Values("Content-Encoding")) + len(rw.Header()["content-encoding"]); test.wantEncoding == "" && values != 0 || test.wantEncoding != "" && values != 1 {
+				t.Errorf("Content-Encoding headers = %v, want only %q", rw.Header(), test.wantEncoding)
+			}
+			if length := rw.Header().Get("Content-Length"); length != strconv.Itoa(rw.Body.Len()) {
+				t.Errorf("Content-Length = %q, want %d", length, rw.Body.Len())
+			}
+			body, err := decodeBody(test.wantEncoding, rw.Body.Bytes())
+			if err != nil {
+				t.Fatalf("body is not %q: %v", test.wantEncoding, err)
+			}
+			if want := strings.Replace(testPage, "</body>", h.getScriptHtml()+"</body>", 1); string(body) != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
@@ -3,19 +3,28 @@ package traefik_umami_plugin
 import (
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"net/url"
 	"regexp"
+	"strings"
+	"time"
 )
 
+// marks requests the plugin sends to umami, so it recognizes them if the
+// umamiHost routes back through traefik.
+const umamiForwardedHeader = "X-Umami-Plugin-Forwarded"
+
 // check if the requested URL should be forwaeded to umami
 // based on the ForwardPath (eg. /umami)
-// only forwards /api/send and /script.js.
+// only matches the forwardAllowedPaths below it, with or without a trailing slash
+// the bare forwardPath (eg. /umami or /umami/) is the root of umami, it is
+// only forwarded if / is allowed, other paths are left to the next handler.
 func isUmamiForwardPath(req *http.Request, config *Config) (bool, string) {
 	currentPath := req.URL.EscapedPath()
-	pathRegex := fmt.Sprintf(`\/%s\/((?:script\.js)|(?:api\/send))`, config.ForwardPath)
+	pathRegex := fmt.Sprintf(`^\/%s(?:\/(.*?))?\/?$`, regexp.QuoteMeta(config.ForwardPath))
 	match := regexp.MustCompile(pathRegex).FindStringSubmatch(currentPath)
-	if match != nil {
+	if match != nil && forwardPathAllowed(match[1], config.ForwardAllowedPaths) {
 		pathAfter := match[1]
 		return true, pathAfter
 	}
@@ -23,10 +32,13 @@ func isUmamiForwardPath(req *http.Request, config *Config) (bool, string) {
 }
 
 // build the new URL to umami
-// based on the UmamiHost and pathAfter.
-func (h *PluginHandler) getForwardUrl(pathAfter string) (string, error) {
+// based on the umami host, pathAfter and the query of the request.
+func (h *PluginHandler) getForwardUrl(host string, pathAfter string, rawQuery string) (string, error) {
 	// return path.Join(config.UmamiConfig.UmamiHost, pathAfter)
-	urlString := fmt.Sprintf("%s/%s", h.config.UmamiHost, pathAfter)
+	urlString := fmt.Sprintf("%s/%s", host, pathAfter)
+	if rawQuery != "" {
+		urlString += "?" + rawQuery
+	}
 	// validate the URL
 	_, err := url.Parse(urlString)
 	// return the URL and error
@@ -35,37 +47,73 @@ func (h *PluginHandler) getForwardUrl(pathAfter string) (string, error) {
 
 // forward the incoming request to umami
 // if not 2XX, shortcut and return forward response
-// if 2XX, continue to next handler.
+// if 2XX, continue to next handler
+// HEAD is forwarded as HEAD and answered without a body
+// unreachable umami hosts are failed over
+// fails fast with 503 while the circuit is open.
 func (h *PluginHandler) forwardToUmami(rw http.ResponseWriter, req *http.Request, pathAfter string) {
-	// build URL
-	forwardUrl, err := h.getForwardUrl(pathAfter)
-	if err != nil {
-		// h.log(fmt.Sprintf("h.getForwardUrl: %+v", err))
-		rw.WriteHeader(http.StatusInternalServerError)
+	// preflights are answered without asking umami
+	if len(h.config.CorsOrigins) > 0 && isCorsPreflight(req) {
+		writeCorsHeaders(rw.Header(), req, h.config.CorsOrigins)
+		if rw.Header().Get("Access-Control-Allow-Origin") != "" {
+			rw.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+			rw.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+			rw.Header().Set("Access-Control-Max-Age", "86400")
+		}
+		rw.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	// build proxy request
-	proxyReq, err := newForwardRequest(req, forwardUrl)
-	if err != nil {
-		// h.log(fmt.Sprintf("traefik_plugin_forward_request.NewForwardRequest: %+v", err))
-		rw.WriteHeader(http.StatusInternalServerError)
+	// make proxy request
+	if h.circuit != nil && !h.circuit.allow(time.Now()) {
+		rw.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
+	proxyRes, err := h.umamiHosts.do(h.umamiClient, func(host string) (*http.Request, error) {
+		// build URL
+		forwardUrl, err := h.getForwardUrl(host, pathAfter, req.URL.RawQuery)
+		if err != nil {
+			return nil, err
+		}
 
-	// make proxy request
-	client := &http.Client{}
-	proxyRes, err := client.Do(proxyReq)
+		// build proxy request
+		proxyReq, err := newForwardRequest(req, forwardUrl)
+		if err != nil {
+			return nil, err
+		}
+		// the body was read already, which answered the client's 100-continue
+		proxyReq.Header.Del("Expect")
+		writeClientIPHeaders(proxyReq.Header, req, &h.config)
+		writeWebsiteIdHeader(proxyReq.Header, req, &h.config)
+		proxyReq.Header.Set(umamiForwardedHeader, "1")
+		return proxyReq, nil
+	})
+	if h.circuit != nil {
+		h.circuit.record(time.Now(), err != nil || proxyRes.StatusCode >= 500)
+	}
 	if err != nil {
 		// h.log(fmt.Sprintf("h.client.Do: %+v", err))
 		rw.WriteHeader(http.StatusInternalServerError)
 		return
 	}
+	defer proxyRes.Body.Close()
 
 	// build response
 	copyHeaders(rw.Header(), proxyRes.Header)
 	removeHeaders(rw.Header(), hopHeaders...)
+	if !h.config.ForwardCookies {
+		removeHeaders(rw.Header(), "Set-Cookie")
+	}
+	if len(h.config.CorsOrigins) > 0 {
+		// replaces the cors headers of umami
+		removeHeaders(rw.Header(), "Access-Control-Allow-Origin", "Access-Control-Allow-Credentials")
+		writeCorsHeaders(rw.Header(), req, h.config.CorsOrigins)
+	}
 	rw.WriteHeader(proxyRes.StatusCode)
+	// HEAD only returns the headers of umami, including its Content-Length
+	if req.Method == http.MethodHead {
+		return
+	}
 	body, err := io.ReadAll(proxyRes.Body)
 	if err != nil {
 		// h.log(fmt.Sprintf("io.ReadAll: %+v", err))
@@ -74,3 +122,119 @@ func (h *PluginHandler) forwardToUmami(rw http.ResponseWriter, req *http.Request
 	}
 	rw.Write(body)
 }
+
+// check if the path below the forwardPath is one of the allowed paths.
+func forwardPathAllowed(pathAfter string, allowed []string) bool {
+	for _, path := range allowed {
+		if strings.Trim(path, "/") == pathAfter {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the request is a cors preflight.
+func isCorsPreflight(req *http.Request) bool {
+	return req.Method == http.MethodOptions && req.Header.Get("Origin") != "" && req.Header.Get("Access-Control-Request-Method") != ""
+}
+
+// allows the origin of the request if it is one of the origins
+// "*" allows all origins.
+func writeCorsHeaders(header http.Header, req *http.Request, origins []string) {
+	header.Add("Vary", "Origin")
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return
+	}
+	for _, allowed := range origins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			header.Set("Access-Control-Allow-Origin", origin)
+			return
+		}
+	}
+}
+
+// headers umami reads the client ip from, besides X-Forwarded-For.
+var clientIPHeaders = []string{
+	"True-Client-Ip",
+	"Cf-Connecting-Ip",
+	"X-Client-Ip",
+	"Do-Connecting-Ip",
+	"Fastly-Client-Ip",
+	"X-Real-Ip",
+	"X-Cluster-Client-Ip",
+	"X-Forwarded",
+	"Forwarded",
+}
+
+// passes the client ip headers of the request on only if the peer is
+// trusted, otherwise the client ip is the peer address
+// with anonymizeIP, only the network of the client ip is passed on.
+func writeClientIPHeaders(dst http.Header, req *http.Request, config *Config) {
+	if !isTrustedPeer(req, config) {
+		removeHeaders(dst, clientIPHeaders...)
+		if clientIP, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+			dst.Set(xForwardedFor, clientIP)
+		}
+	}
+	if config.AnonymizeIP {
+		anonymizeClientIP(dst)
+	}
+}
+
+// replaces the client ip headers by an X-Forwarded-For of the network of
+// the client, the first ip of the chain.
+func anonymizeClientIP(dst http.Header) {
+	clientIP := strings.TrimSpace(strings.Split(dst.Get(xForwardedFor), ",")[0])
+	removeHeaders(dst, clientIPHeaders...)
+	dst.Del(xForwardedFor)
+	if ip := net.ParseIP(clientIP); ip != nil {
+		dst.Set(xForwardedFor, anonymizeIP(ip).String())
+	}
+}
+
+// the /24 network of an ipv4, the /48 network of an ipv6 address.
+func anonymizeIP(ip net.IP) net.IP {
+	if ipv4 := ip.To4(); ipv4 != nil {
+		return ipv4.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+// check if the peer may set the client ip headers
+// trustForwardedFor without trustedProxies trusts every peer.
+func isTrustedPeer(req *http.Request, config *Config) bool {
+	if len(config.TrustedProxies) == 0 {
+		return config.TrustForwardedFor
+	}
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return false
+	}
+	for _, proxy := range config.TrustedProxies {
+		network, err := parseTrustedProxy(proxy)
+		if err == nil && network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// parses a trusted proxy CIDR, a single ip is its own network.
+func parseTrustedProxy(proxy string) (*net.IPNet, error) {
+	if !strings.Contains(proxy, "/") {
+		if ip := net.ParseIP(proxy); ip != nil {
+			bits := 8 * len(ip.To16())
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 32
+			}
+			return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+		}
+	}
+	_, network, err := net.ParseCIDR(proxy)
+	return network, err
+}
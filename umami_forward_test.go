@@ -0,0 +1,466 @@
+package traefik_umami_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestForwardCookies(t *testing.T) {
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		http.SetCookie(rw, &http.Cookie{Name: "umami.session", Value: "abc"})
+		http.SetCookie(rw, &http.Cookie{Name: "umami.visitor", Value: "def"})
+		rw.WriteHeader(http.StatusOK)
+	}))
+	defer umami.Close()
+	tests := []struct {
+		name           string
+		forwardCookies bool
+		want           []string
+	}{
+		{"passed through by default", true, []string{"umami.session=abc", "umami.visitor=def"}},
+		{"stripped", false, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ForwardCookies = test.forwardCookies
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+
+			rw := serve(h, httptest.NewRequest(http.MethodPost, "/_umami/api/send", nil))
+			cookies := rw.Header().Values("Set-Cookie")
+			if len(cookies) != len(test.want) {
+				t.Fatalf("Set-Cookie = %v, want %v", cookies, test.want)
+			}
+			for i, want := range test.want {
+				if cookies[i] != want {
+					t.Errorf("Set-Cookie = %q, want %q", cookies[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestForwardPathVariants(t *testing.T) {
+	tests := []struct {
+		name         string
+		forwardPath  string
+		allowed      []string
+		target       string
+		wantUpstream string // empty if the request isn't forwarded
+	}{
+		{"script", "_umami", nil, "/_umami/script.js", "/script.js"},
+		{"script with trailing slash", "_umami", nil, "/_umami/script.js/", "/script.js"},
+		{"query", "_umami", nil, "/_umami/api/send?cache=1&x=%20y", "/api/send?cache=1&x=%20y"},
+		{"configured with slashes", "/_umami/", nil, "/_umami/script.js", "/script.js"},
+		{"bare path", "_umami", nil, "/_umami", ""},
+		{"bare path with trailing slash", "_umami", nil, "/_umami/", ""},
+		{"bare path allowed", "_umami", []string{"/", "script.js"}, "/_umami", "/"},
+		{"bare path allowed with trailing slash", "_umami", []string{"/"}, "/_umami/?x=1", "/?x=1"},
+		{"prefix of another path", "_umami", nil, "/_umamiscript.js", ""},
+		{"not allowed", "_umami", nil, "/_umami/api/websites", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ForwardPath = test.forwardPath
+			if test.allowed != nil {
+				config.ForwardAllowedPaths = test.allowed
+			}
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				_, _ = io.WriteString(rw, "next")
+			}))
+			rw := serve(h, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			if test.wantUpstream == "" {
+				if rw.Body.String() != "next" {
+					t.Errorf("body = %q, want it served by next", rw.Body.String())
+				}
+				return
+			}
+			select {
+			case req := <-requests:
+				if upstream := req.URL.RequestURI(); upstream != test.wantUpstream {
+					t.Errorf("forwarded to %q, want %q", upstream, test.wantUpstream)
+				}
+			default:
+				t.Fatalf("not forwarded, body %q", rw.Body.String())
+			}
+		})
+	}
+}
+
+func TestForwardCors(t *testing.T) {
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Access-Control-Allow-Origin", "*")
+		_, _ = io.WriteString(rw, "umami")
+	}))
+	defer umami.Close()
+	tests := []struct {
+		name        string
+		origins     []string
+		method      string
+		origin      string
+		wantStatus  int
+		wantOrigin  string
+		wantMethods string
+		wantBody    string
+	}{
+		{"preflight", []string{"https://app.test"}, http.MethodOptions, "https://app.test", http.StatusNoContent, "https://app.test", "GET, POST, OPTIONS", ""},
+		{"preflight any origin", []string{"*"}, http.MethodOptions, "https://other.test", http.StatusNoContent, "https://other.test", "GET, POST, OPTIONS", ""},
+		{"preflight other origin", []string{"https://app.test"}, http.MethodOptions, "https://other.test", http.StatusNoContent, "", "", ""},
+		{"cross origin post", []string{"https://APP.test"}, http.MethodPost, "https://app.test", http.StatusOK, "https://app.test", "", "umami"},
+		{"post other origin", []string{"https://app.test"}, http.MethodPost, "https://other.test", http.StatusOK, "", "", "umami"},
+		{"disabled", nil, http.MethodPost, "https://app.test", http.StatusOK, "*", "", "umami"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.CorsOrigins = test.origins
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+
+			req := httptest.NewRequest(test.method, "/_umami/api/send", nil)
+			req.Header.Set("Origin", test.origin)
+			if test.method == http.MethodOptions {
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			rw := serve(h, req)
+			if rw.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", rw.Code, test.wantStatus)
+			}
+			if origin := rw.Header().Get("Access-Control-Allow-Origin"); origin != test.wantOrigin {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", origin, test.wantOrigin)
+			}
+			if methods := rw.Header().Get("Access-Control-Allow-Methods"); methods != test.wantMethods {
+				t.Errorf("Access-Control-Allow-Methods = %q, want %q", methods, test.wantMethods)
+			}
+			if test.origins != nil && rw.Header().Get("Vary") != "Origin" {
+				t.Errorf("Vary = %q, want Origin", rw.Header().Get("Vary"))
+			}
+			if body := rw.Body.String(); body != test.wantBody {
+				t.Errorf("body = %q, want %q", body, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestClientIPHeaders(t *testing.T) {
+	tests := []struct {
+		name       string
+		trust      bool
+		proxies    []string
+		remoteAddr string
+		wantXFF    string // a trusted peer is appended to the chain
+		wantRealIP string
+		wantIssue  string
+	}{
+		{"spoofed from untrusted peer", false, nil, "198.51.100.7:4000", "198.51.100.7", "", ""},
+		{"spoofed from peer outside the trusted proxies", true, []string{"10.0.0.0/8"}, "198.51.100.7:4000", "198.51.100.7", "", ""},
+		{"trusted proxy", false, []string{"10.0.0.0/8"}, "10.1.2.3:4000", "203.0.113.9, 10.1.2.3", "203.0.113.9", ""},
+		{"trusted single ip", false, []string{"10.1.2.3"}, "10.1.2.3:4000", "203.0.113.9, 10.1.2.3", "203.0.113.9", ""},
+		{"trusted ipv6 proxy", false, []string{"fd00::/8"}, "[fd00::1]:4000", "203.0.113.9, fd00::1", "203.0.113.9", ""},
+		{"every peer trusted", true, nil, "198.51.100.7:4000", "203.0.113.9, 198.51.100.7", "203.0.113.9", ""},
+		{"invalid proxy", false, []string{"10.0.0.0/33"}, "10.1.2.3:4000", "", "", "trustedProxies"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.TrustForwardedFor = test.trust
+			config.TrustedProxies = test.proxies
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+
+			req := httptest.NewRequest(http.MethodPost, "/_umami/api/send", nil)
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			req.Header.Set("X-Real-Ip", "203.0.113.9")
+			serve(h, req)
+			upstream := <-requests
+			if xff := upstream.Header.Get("X-Forwarded-For"); xff != test.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", xff, test.wantXFF)
+			}
+			if realIP := upstream.Header.Get("X-Real-Ip"); realIP != test.wantRealIP {
+				t.Errorf("X-Real-Ip = %q, want %q", realIP, test.wantRealIP)
+			}
+		})
+	}
+}
+
+func TestAnonymizeIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		anonymize  bool
+		track      bool // server side tracking, otherwise forwarding
+		trust      bool
+		remoteAddr string
+		wantXFF    string
+		wantRealIP string
+	}{
+		{"disabled", false, false, false, "198.51.100.7:4000", "198.51.100.7", ""},
+		{"forwarded ipv4", true, false, false, "198.51.100.7:4000", "198.51.100.0", ""},
+		{"forwarded ipv6", true, false, false, "[2001:db8:1234:5678::1]:4000", "2001:db8:1234::", ""},
+		{"forwarded through a trusted proxy", true, false, true, "10.1.2.3:4000", "203.0.113.0", ""},
+		{"tracked ipv4", true, true, false, "198.51.100.7:4000", "198.51.100.0", ""},
+		{"tracked through a trusted proxy", true, true, true, "10.1.2.3:4000", "203.0.113.0", ""},
+		{"tracked disabled through a trusted proxy", false, true, true, "10.1.2.3:4000", "203.0.113.9, 10.1.2.3", "203.0.113.9"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.AnonymizeIP = test.anonymize
+			config.TrustForwardedFor = test.trust
+			config.ScriptInjection = false
+			config.ServerSideTracking = test.track
+			config.SyncTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			req := htmlRequest(http.MethodGet, "/page")
+			if !test.track {
+				req = httptest.NewRequest(http.MethodPost, "/_umami/api/send", nil)
+			}
+			req.RemoteAddr = test.remoteAddr
+			req.Header.Set("X-Forwarded-For", "203.0.113.9")
+			req.Header.Set("X-Real-Ip", "203.0.113.9")
+			serve(h, req)
+			var upstream *http.Request
+			select {
+			case upstream = <-requests:
+			case <-time.After(5 * time.Second):
+				t.Fatal("nothing was sent to umami")
+			}
+			if upstream.URL.Path != "/api/send" {
+				t.Errorf("umami got %s, want /api/send", upstream.URL.Path)
+			}
+			if xff := upstream.Header.Get("X-Forwarded-For"); xff != test.wantXFF {
+				t.Errorf("X-Forwarded-For = %q, want %q", xff, test.wantXFF)
+			}
+			if realIP := upstream.Header.Get("X-Real-Ip"); realIP != test.wantRealIP {
+				t.Errorf("X-Real-Ip = %q, want %q", realIP, test.wantRealIP)
+			}
+		})
+	}
+}
+
+func TestSelfProxyLoop(t *testing.T) {
+	tests := []struct {
+		name       string
+		umamiPath  string // of the umamiHost on the plugin
+		target     string
+		forwarded  bool // sent by the plugin, as umami routed through traefik would get it
+		wantStatus int
+		wantBody   string // SCRIPT marks the umami script
+	}{
+		{"forwarded to the forward path", "/_umami", "/_umami/script.js", false, http.StatusLoopDetected, ""},
+		{"forwarded to the site", "", "/_umami/script.js", false, http.StatusOK, testPage},
+		{"umami page", "", "/dashboard", true, http.StatusOK, testPage},
+		{"client page", "", "/dashboard", false, http.StatusOK, strings.Replace(testPage, "</body>", "SCRIPT</body>", 1)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// the umamiHost is served by the plugin itself
+			var h *PluginHandler
+			traefik := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				h.ServeHTTP(rw, req)
+			}))
+			defer traefik.Close()
+			config := testConfig()
+			config.UmamiHost = traefik.URL + test.umamiPath
+			config.ServerSideTracking = true
+			h = newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, test.target)
+			if test.forwarded {
+				req.Header.Set(umamiForwardedHeader, "1")
+			}
+			rw := serve(h, req)
+			if rw.Code != test.wantStatus {
+				t.Errorf("status = %d, want %d", rw.Code, test.wantStatus)
+			}
+			if want := strings.Replace(test.wantBody, "SCRIPT", h.getScriptHtml(), 1); rw.Body.String() != want {
+				t.Errorf("body = %q, want %q", rw.Body.String(), want)
+			}
+			wantTracked := 0
+			if test.target == "/dashboard" && !test.forwarded {
+				wantTracked = 1
+			}
+			if tracked := len(sink.payloads()); tracked != wantTracked {
+				t.Errorf("tracked %d events, want %d", tracked, wantTracked)
+			}
+		})
+	}
+}
+
+func TestForwardHead(t *testing.T) {
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "application/javascript")
+		rw.Header().Set("Cache-Control", "max-age=3600")
+		rw.Header().Set("X-Method", req.Method)
+		if req.URL.Path == "/missing.js" {
+			rw.WriteHeader(http.StatusNotFound)
+		}
+		_, _ = io.WriteString(rw, "(function(){})()")
+	}))
+	defer umami.Close()
+	tests := []struct {
+		name       string
+		method     string
+		target     string
+		wantStatus int
+		wantBody   string
+	}{
+		{"HEAD", http.MethodHead, "/_umami/script.js", http.StatusOK, ""},
+		{"HEAD of an error", http.MethodHead, "/_umami/missing.js", http.StatusNotFound, ""},
+		{"GET", http.MethodGet, "/_umami/script.js", http.StatusOK, "(function(){})()"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ForwardAllowedPaths = append(config.ForwardAllowedPaths, "missing.js")
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+			server := httptest.NewServer(h)
+			defer server.Close()
+
+			req, _ := http.NewRequest(test.method, server.URL+test.target, nil)
+			res, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != test.wantStatus {
+				t.Errorf("status = %d, want %d", res.StatusCode, test.wantStatus)
+			}
+			if string(body) != test.wantBody {
+				t.Errorf("body = %q, want %q", body, test.wantBody)
+			}
+			// the headers of umami to its own request method
+			if method := res.Header.Get("X-Method"); method != test.method {
+				t.Errorf("forwarded as %q, want %q", method, test.method)
+			}
+			if res.Header.Get("Cache-Control") != "max-age=3600" || res.Header.Get("Content-Type") != "application/javascript" {
+				t.Errorf("headers = %v, want the headers of umami", res.Header)
+			}
+			if res.ContentLength != int64(len("(function(){})()")) {
+				t.Errorf("Content-Length = %d, want the length of the script", res.ContentLength)
+			}
+		})
+	}
+}
+
+func TestForwardExpectContinue(t *testing.T) {
+	type received struct {
+		expect string
+		body   string
+	}
+	tests := []struct {
+		name   string
+		expect bool
+		body   string
+	}{
+		{"100-continue", true, `{"type":"event","payload":{"website":"website"}}`},
+		{"100-continue large body", true, strings.Repeat("x", 1<<20)},
+		{"no expectation", false, `{"type":"event"}`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := make(chan received, 1)
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				got <- received{expect: req.Header.Get("Expect"), body: string(body)}
+				_, _ = io.WriteString(rw, "ok")
+			}))
+			defer umami.Close()
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			server := httptest.NewServer(newTestPlugin(t, config, http.NotFoundHandler()))
+			defer server.Close()
+
+			// a stalled expectation would wait for the whole timeout
+			client := &http.Client{Transport: &http.Transport{ExpectContinueTimeout: time.Minute}, Timeout: 10 * time.Second}
+			req, _ := http.NewRequest(http.MethodPost, server.URL+"/_umami/api/send", strings.NewReader(test.body))
+			if test.expect {
+				req.Header.Set("Expect", "100-continue")
+			}
+			res, err := client.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, _ := io.ReadAll(res.Body)
+			if res.StatusCode != http.StatusOK || string(body) != "ok" {
+				t.Errorf("response = %d %q, want 200 ok", res.StatusCode, body)
+			}
+			upstream := <-got
+			if upstream.expect != "" {
+				t.Errorf("umami got Expect %q", upstream.expect)
+			}
+			if upstream.body != test.body {
+				t.Errorf("umami got %d bytes, want %d", len(upstream.body), len(test.body))
+			}
+		})
+	}
+}
+
+func TestForwardAllowedPaths(t *testing.T) {
+	tests := []struct {
+		name        string
+		allowed     []string // nil for the defaults
+		target      string
+		wantForward bool
+	}{
+		{"script by default", nil, "/_umami/script.js", true},
+		{"collect by default", nil, "/_umami/api/send", true},
+		{"api by default", nil, "/_umami/api/websites", false},
+		{"login by default", nil, "/_umami/login", false},
+		{"traversal", nil, "/_umami/script.js/../api/websites", false},
+		{"encoded slash", nil, "/_umami/api%2Fsend", false},
+		{"configured", []string{"/api/websites/"}, "/_umami/api/websites", true},
+		{"not configured", []string{"api/websites"}, "/_umami/script.js", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			if test.allowed != nil {
+				config.ForwardAllowedPaths = test.allowed
+			}
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(http.StatusNotFound)
+				_, _ = io.WriteString(rw, "next")
+			}))
+			rw := serve(h, httptest.NewRequest(http.MethodGet, test.target, nil))
+
+			forwarded := len(requests) == 1
+			if forwarded != test.wantForward {
+				t.Fatalf("forwarded = %v, want %v", forwarded, test.wantForward)
+			}
+			// paths that aren't allowed are the site's, as if there was no forwardPath
+			wantBody := "next"
+			if test.wantForward {
+				wantBody = "umami " + (<-requests).URL.Path
+			}
+			if rw.Body.String() != wantBody {
+				t.Errorf("body = %q, want %q", rw.Body.String(), wantBody)
+			}
+		})
+	}
+}
@@ -0,0 +1,74 @@
+package traefik_umami_plugin
+
+import (
+	"errors"
+	"net/http"
+	"sync/atomic"
+)
+
+var errNoUmamiHost = errors.New("no umami host is set")
+
+// the configured umami hosts, umamiHost first.
+func umamiHostList(config *Config) []string {
+	hosts := []string{}
+	if config.UmamiHost != "" {
+		hosts = append(hosts, config.UmamiHost)
+	}
+	for _, host := range config.UmamiHosts {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// picks the umami host of a request
+// fails over to the next host on connection errors.
+type umamiHostPool struct {
+	next       uint64
+	hosts      []string
+	roundRobin bool
+}
+
+func newUmamiHostPool(config *Config) *umamiHostPool {
+	return &umamiHostPool{
+		hosts:      umamiHostList(config),
+		roundRobin: config.UmamiHostStrategy == UHStrategyRoundrobin,
+	}
+}
+
+// the hosts in the order they are tried
+// roundrobin starts every request at the next host.
+func (p *umamiHostPool) order() []string {
+	if !p.roundRobin || len(p.hosts) < 2 {
+		return p.hosts
+	}
+	start := int((atomic.AddUint64(&p.next, 1) - 1) % uint64(len(p.hosts)))
+	ordered := make([]string, 0, len(p.hosts))
+	ordered = append(ordered, p.hosts[start:]...)
+	return append(ordered, p.hosts[:start]...)
+}
+
+// sends the request built for each host until one of them answers
+// an answer of umami is returned whatever its status, only unreachable
+// hosts are failed over.
+func (p *umamiHostPool) do(client *http.Client, build func(host string) (*http.Request, error)) (*http.Response, error) {
+	err := errNoUmamiHost
+	for _, host := range p.order() {
+		var req *http.Request
+		req, err = build(host)
+		if err != nil {
+			return nil, err
+		}
+		var res *http.Response
+		res, err = client.Do(req)
+		if err == nil {
+			return res, nil
+		}
+		// the client is gone, no other host will do better
+		if req.Context().Err() != nil {
+			return nil, err
+		}
+	}
+	return nil, err
+}
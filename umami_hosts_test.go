@@ -0,0 +1,134 @@
+package traefik_umami_plugin
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// an umami host answering with its name and recording the paths it got.
+type namedUmami struct {
+	*httptest.Server
+	mu    sync.Mutex
+	paths []string
+}
+
+func newNamedUmami(t *testing.T, name string, status int) *namedUmami {
+	t.Helper()
+	umami := &namedUmami{}
+	umami.Server = httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		umami.mu.Lock()
+		umami.paths = append(umami.paths, req.URL.Path)
+		umami.mu.Unlock()
+		rw.WriteHeader(status)
+		_, _ = io.WriteString(rw, name)
+	}))
+	t.Cleanup(umami.Close)
+	return umami
+}
+
+func (u *namedUmami) requests() []string {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	return append([]string{}, u.paths...)
+}
+
+// the url of a host refusing connections.
+func downUmamiHost() string {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	return down.URL
+}
+
+func TestUmamiHostsForwarding(t *testing.T) {
+	tests := []struct {
+		name          string
+		strategy      string
+		primaryDown   bool
+		primaryStatus int
+		want          []string // the answering host of each request
+	}{
+		{"failover", UHStrategyFailover, false, http.StatusOK, []string{"primary", "primary", "primary"}},
+		{"failover primary down", UHStrategyFailover, true, http.StatusOK, []string{"secondary", "secondary", "secondary"}},
+		{"error status not failed over", UHStrategyFailover, false, http.StatusInternalServerError, []string{"primary", "primary", "primary"}},
+		{"roundrobin", UHStrategyRoundrobin, false, http.StatusOK, []string{"primary", "secondary", "primary"}},
+		{"roundrobin primary down", UHStrategyRoundrobin, true, http.StatusOK, []string{"secondary", "secondary", "secondary"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			primary := newNamedUmami(t, "primary", test.primaryStatus)
+			secondary := newNamedUmami(t, "secondary", http.StatusOK)
+			config := testConfig()
+			config.UmamiHost = primary.URL
+			if test.primaryDown {
+				config.UmamiHost = downUmamiHost()
+			}
+			config.UmamiHosts = []string{secondary.URL}
+			config.UmamiHostStrategy = test.strategy
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+
+			got := []string{}
+			for range test.want {
+				rw := serve(h, httptest.NewRequest(http.MethodGet, "/_umami/script.js", nil))
+				got = append(got, rw.Body.String())
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("answered by %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUmamiHostsTracking(t *testing.T) {
+	secondary := newNamedUmami(t, "secondary", http.StatusOK)
+	config := testConfig()
+	config.UmamiHost = downUmamiHost()
+	config.UmamiHosts = []string{secondary.URL}
+	config.ScriptInjection = false
+	config.ServerSideTracking = true
+	config.SyncTracking = true
+	h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+	serve(h, htmlRequest(http.MethodGet, "/"))
+	if got := secondary.requests(); len(got) != 1 || !strings.HasSuffix(got[0], "/api/send") {
+		t.Errorf("secondary got %v, want the tracking request", got)
+	}
+	if dropped := atomic.LoadUint64(&h.droppedEvents); dropped != 0 {
+		t.Errorf("dropped %d events, want 0", dropped)
+	}
+}
+
+func TestUmamiHostsConfig(t *testing.T) {
+	tests := []struct {
+		name      string
+		host      string
+		hosts     []string
+		strategy  string
+		wantHosts []string
+		wantIssue string
+	}{
+		{"single host", "http://a.test", nil, UHStrategyFailover, []string{"http://a.test"}, ""},
+		{"umamiHost first", "http://a.test", []string{"http://b.test", ""}, UHStrategyFailover, []string{"http://a.test", "http://b.test"}, ""},
+		{"hosts only", "", []string{"http://b.test"}, UHStrategyRoundrobin, []string{"http://b.test"}, ""},
+		{"invalid strategy", "http://a.test", nil, "random", []string{"http://a.test"}, "umamiHostStrategy"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = test.host
+			config.UmamiHosts = test.hosts
+			config.UmamiHostStrategy = test.strategy
+			if got := umamiHostList(config); !reflect.DeepEqual(got, test.wantHosts) {
+				t.Errorf("hosts = %v, want %v", got, test.wantHosts)
+			}
+			if field := configIssueField(newTestPlugin(t, config, http.NotFoundHandler())); field != test.wantIssue {
+				t.Errorf("config issue = %q, want %q", field, test.wantIssue)
+			}
+		})
+	}
+}
@@ -1,12 +1,19 @@
 package traefik_umami_plugin
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
+	"html"
 	"io"
 	"net/http"
+	"net/url"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
 )
 
@@ -14,14 +21,335 @@ const insertBeforeRegexPattern = `</body>`
 
 var insertBeforeRegex = regexp.MustCompile(insertBeforeRegexPattern)
 
-// injects the umami script into the response head.
-func regexReplaceSingle(bytes []byte, match *regexp.Regexp, replace string) []byte {
-	rx := match.FindIndex(bytes)
-	if len(rx) == 0 {
-		return bytes
+// </BODY> or </body > of hand written or minified pages, only tried
+// after the literal </body> fast path.
+const insertBeforeFoldRegexPattern = `(?i)</body\s*>`
+
+var insertBeforeFoldRegex = regexp.MustCompile(insertBeforeFoldRegexPattern)
+
+// legacy pages without a head and body get the script after <html> or the
+// doctype, the empty at group marks the insertion point.
+// quoted attribute values may contain a >.
+const afterHtmlTagRegexPattern = `(?i)<html\b(?:[^>"']|"[^"]*"|'[^']*')*>(?P<at>)`
+
+var afterHtmlTagRegex = regexp.MustCompile(afterHtmlTagRegexPattern)
+
+const afterDoctypeRegexPattern = `(?i)<!doctype\b(?:[^>"']|"[^"]*"|'[^']*')*>(?P<at>)`
+
+var afterDoctypeRegex = regexp.MustCompile(afterDoctypeRegexPattern)
+
+// pages with a head or body tag aren't legacy pages, a missing </body>
+// is left to onMissingAnchor.
+const headOrBodyTagRegexPattern = `(?i)<(?:head|body)\b`
+
+var headOrBodyTagRegex = regexp.MustCompile(headOrBodyTagRegexPattern)
+
+const jsIdentifierRegexPattern = `^[A-Za-z_$][A-Za-z0-9_$]*$`
+
+var jsIdentifierRegex = regexp.MustCompile(jsIdentifierRegexPattern)
+
+// letters, digits and _.- only, safe in attributes and js strings.
+const tokenRegexPattern = `^[A-Za-z0-9_.-]+$`
+
+var tokenRegex = regexp.MustCompile(tokenRegexPattern)
+
+// html attribute names like data-umami.
+const attributeNameRegexPattern = `^[A-Za-z_:][A-Za-z0-9_:.-]*$`
+
+var attributeNameRegex = regexp.MustCompile(attributeNameRegexPattern)
+
+// session cookie marking visitors that got the script with firstVisitOnly.
+const firstVisitCookie = "umami-visited"
+
+// anchors tried in order and the html inserted before the first match
+// or replacing it.
+type injectionRule struct {
+	anchors []*regexp.Regexp
+	legacy  []*regexp.Regexp // tried after the anchors for pages without head and body
+	html    string           // empty for the umami script
+	replace bool
+	limit   int // matches of the anchor injected at most
+}
+
+// the rules for the injections config, by default the script before the
+// hydration marker if one is set and found, otherwise before </body>
+// with replaceTagSelector the script replaces the stub tag instead.
+func buildInjectionRules(config *Config) ([]injectionRule, error) {
+	if len(config.Injections) == 0 {
+		if config.ReplaceTagSelector != "" {
+			return []injectionRule{{anchors: []*regexp.Regexp{stubTagRegex(config.ReplaceTagSelector)}, replace: true, limit: config.MaxInjectionsPerResponse}}, nil
+		}
+		anchors := []*regexp.Regexp{insertBeforeRegex, insertBeforeFoldRegex}
+		if config.HydrationMarker != "" {
+			marker := regexp.MustCompile(regexp.QuoteMeta(config.HydrationMarker))
+			anchors = append([]*regexp.Regexp{marker}, anchors...)
+		}
+		legacy := []*regexp.Regexp{afterHtmlTagRegex, afterDoctypeRegex}
+		return []injectionRule{{anchors: anchors, legacy: legacy, limit: config.MaxInjectionsPerResponse}}, nil
+	}
+	rules := make([]injectionRule, 0, len(config.Injections))
+	for _, injection := range config.Injections {
+		anchor, err := regexp.Compile(injection.Anchor)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, injectionRule{anchors: []*regexp.Regexp{anchor}, html: injection.Html, limit: config.MaxInjectionsPerResponse})
+	}
+	return rules, nil
+}
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// matches a whole script tag with the attribute, eg. <script data-umami></script>.
+func stubTagRegex(attribute string) *regexp.Regexp {
+	return regexp.MustCompile(fmt.Sprintf(`(?is)<script\b[^>]*?\s%s(?:\s*=\s*(?:"[^"]*"|'[^']*'|[^\s>]*))?(?:\s[^>]*)?>.*?</script\s*>`, regexp.QuoteMeta(attribute)))
+}
+
+// the first anchor of the rule that is found, start is -1 if none is.
+// anchors are matched after a leading BOM and blank lines, so ^<!DOCTYPE
+// still matches, the prefix is kept.
+func (rule injectionRule) find(body []byte) (int, int) {
+	skip := documentStart(body)
+	for _, anchor := range rule.anchorsFor(body) {
+		if start, end := findAnchor(body[skip:], anchor); start >= 0 {
+			return start + skip, end + skip
+		}
+	}
+	return -1, -1
+}
+
+// the first matches of the first anchor of the rule that is found, up to
+// its limit, like find.
+func (rule injectionRule) findAll(body []byte) [][]int {
+	if rule.limit <= 1 {
+		if start, end := rule.find(body); start >= 0 {
+			return [][]int{{start, end}}
+		}
+		return nil
+	}
+	skip := documentStart(body)
+	for _, anchor := range rule.anchorsFor(body) {
+		locs := findAnchors(body[skip:], anchor, rule.limit)
+		if len(locs) > 0 {
+			for _, loc := range locs {
+				loc[0] += skip
+				loc[1] += skip
+			}
+			return locs
+		}
+	}
+	return nil
+}
+
+// the anchors tried for the body, the legacy ones only for pages without
+// head and body.
+func (rule injectionRule) anchorsFor(body []byte) []*regexp.Regexp {
+	if len(rule.legacy) == 0 || headOrBodyTagRegex.Match(body) {
+		return rule.anchors
+	}
+	return append(append([]*regexp.Regexp{}, rule.anchors...), rule.legacy...)
+}
+
+// the rules without the legacy anchors, for a part of the body that can't
+// tell if the page has a head or body.
+func withoutLegacyAnchors(rules []injectionRule) []injectionRule {
+	stripped := make([]injectionRule, 0, len(rules))
+	for _, rule := range rules {
+		rule.legacy = nil
+		stripped = append(stripped, rule)
+	}
+	return stripped
+}
+
+// the offset of the document after a UTF-8 BOM and leading whitespace.
+func documentStart(body []byte) int {
+	start := 0
+	if bytes.HasPrefix(body, utf8BOM) {
+		start = len(utf8BOM)
+	}
+	for start < len(body) && isHTMLSpace(body[start]) {
+		start++
+	}
+	return start
+}
+
+// whitespace as defined by the html spec.
+func isHTMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\n' || b == '\r' || b == '\f'
+}
+
+// finds the first match of the anchor, start is -1 if there is none.
+// literal anchors take the bytes.Index fast path, anything else the regex.
+func findAnchor(body []byte, anchor *regexp.Regexp) (int, int) {
+	if literal, complete := anchor.LiteralPrefix(); complete {
+		start := bytes.Index(body, []byte(literal))
+		return start, start + len(literal)
+	}
+	locs := findAnchors(body, anchor, 1)
+	if len(locs) == 0 {
+		return -1, -1
+	}
+	return locs[0][0], locs[0][1]
+}
+
+// the first n matches of the anchor
+// an anchor with an at group matches the empty position of the group.
+func findAnchors(body []byte, anchor *regexp.Regexp, n int) [][]int {
+	at := anchor.SubexpIndex("at")
+	if at < 0 {
+		return anchor.FindAllIndex(body, n)
+	}
+	locs := [][]int{}
+	for _, loc := range anchor.FindAllSubmatchIndex(body, n) {
+		if loc[2*at] >= 0 {
+			locs = append(locs, []int{loc[2*at], loc[2*at]})
+		}
+	}
+	return locs
+}
+
+// inserts the html of every rule before its anchor (or in place of it) in a
+// single pass, rules with an anchor that isn't found are skipped
+// only the first match of an anchor is injected unless the rule has a higher limit.
+func injectAll(body []byte, rules []injectionRule, scriptHtml string) []byte {
+	type insertion struct {
+		offset int
+		end    int // after the replaced anchor, offset when inserting
+		html   string
+	}
+	insertions := make([]insertion, 0, len(rules))
+	size := len(body)
+	for _, rule := range rules {
+		html := rule.html
+		if html == "" {
+			html = scriptHtml
+		}
+		for _, loc := range rule.findAll(body) {
+			offset, end := loc[0], loc[1]
+			if !rule.replace {
+				end = offset
+			}
+			insertions = append(insertions, insertion{offset: offset, end: end, html: html})
+			size += len(html)
+		}
+	}
+	if len(insertions) == 0 {
+		return body
+	}
+	// rules sharing an anchor keep their configured order
+	sort.SliceStable(insertions, func(i, j int) bool {
+		return insertions[i].offset < insertions[j].offset
+	})
+
+	out := make([]byte, 0, size)
+	last := 0
+	for _, ins := range insertions {
+		out = append(out, body[last:ins.offset]...)
+		out = append(out, ins.html...)
+		last = ins.end
+	}
+	return append(out, body[last:]...)
+}
+
+const titleRegexPattern = `(?is)<title[^>]*>(.*?)</title>`
+
+var titleRegex = regexp.MustCompile(titleRegexPattern)
+
+// upper bound for extracted titles, the length umami stores.
+const maxTitleLength = 500
+
+// the text of the <title> of an html body, empty if there is none
+// or the body can't be decoded.
+func extractTitle(header http.Header, body []byte) string {
+	decoded, err := decodeBody(contentEncoding(header), body)
+	if err != nil {
+		return ""
+	}
+	match := titleRegex.FindSubmatch(decoded)
+	if match == nil {
+		return ""
+	}
+	title := strings.Join(strings.Fields(html.UnescapeString(string(match[1]))), " ")
+	if runes := []rune(title); len(runes) > maxTitleLength {
+		title = string(runes[:maxTitleLength])
+	}
+	return title
+}
+
+// check if the response to the request should be injected into
+// independent of forwarding and server side tracking.
+func shouldInjectScript(req *http.Request, config *Config) bool {
+	if !config.ScriptInjection || !methodInList(req, config.InjectMethods) {
+		return false
+	}
+	// responses to HEAD never have a body
+	if req.Method == http.MethodHead {
+		return false
+	}
+	// skip documents loaded into frames, eg. sandboxed embeds
+	if config.SkipFramedRequests && isFramedRequest(req) {
+		return false
+	}
+	// only the entry page of a visit with firstVisitOnly
+	if config.FirstVisitOnly {
+		if _, err := req.Cookie(firstVisitCookie); err == nil {
+			return false
+		}
+	}
+	return acceptsHtmlDocument(req)
+}
+
+// check if the request asks for an html document, not HTMX fragments,
+// assets or XHRs of the page.
+func acceptsHtmlDocument(req *http.Request) bool {
+	// skip script injection for HTMX requests
+	if req.Header.Get("HX-Request") == "true" {
+		return false
+	}
+	return strings.Contains(req.Header.Get("Accept"), "text/html")
+}
+
+// check if the browser loads the document into a frame.
+func isFramedRequest(req *http.Request) bool {
+	switch strings.ToLower(req.Header.Get("Sec-Fetch-Dest")) {
+	case "iframe", "frame", "embed", "object":
+		return true
 	}
-	// insert the script before the head tag
-	return append(bytes[:rx[0]], append([]byte(replace), bytes[rx[0]:]...)...)
+	return false
+}
+
+// check if the response is a server-sent event stream.
+func isEventStream(header http.Header) bool {
+	mediaType := strings.TrimSpace(strings.Split(header.Get("Content-Type"), ";")[0])
+	return strings.EqualFold(mediaType, "text/event-stream")
+}
+
+// check if a response with the status may have a body.
+func statusHasBody(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+// check if the response forbids intermediaries to modify its body.
+func hasNoTransform(header http.Header) bool {
+	for _, value := range header.Values("Cache-Control") {
+		for _, directive := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(directive), "no-transform") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// check if the upstream declared a Content-Length
+// that differs from the number of bytes it actually wrote.
+func hasContentLengthMismatch(header http.Header, written int) bool {
+	declared := header.Get("Content-Length")
+	if declared == "" {
+		return false
+	}
+	length, err := strconv.Atoi(declared)
+	return err != nil || length != written
 }
 
 // builds the umami script.
@@ -45,13 +373,160 @@ func buildUmamiScript(config *Config) (string, error) {
 	var src string
 	if config.ScriptInjectionMode == SIModeTag {
 		src = fmt.Sprintf(`/%s/script.js`, config.ForwardPath)
+		version, err := scriptVersion(config)
+		if err != nil {
+			return "", err
+		}
+		if version != "" {
+			src += "?v=" + url.QueryEscape(version)
+		}
 	}
 
+	var html string
 	if config.EvadeGoogleTagManager {
-		return buildUmamiScriptWithEvade(config, scriptJs, src), nil
+		html = buildUmamiScriptWithEvade(config, scriptJs, src)
 	} else {
-		return buildUmamiScriptWithoutEvade(config, scriptJs, src), nil
+		html = buildUmamiScriptWithoutEvade(config, scriptJs, src)
+	}
+
+	// keep the umami script inert until the loader activates it
+	if config.ConsentMode || config.InjectLoadStrategy != ILStrategyImmediate {
+		marker := "data-deferred"
+		if config.ConsentMode {
+			marker = "data-consent"
+		}
+		// the loader restores the type from data-type
+		html = strings.Replace(html, "<script type='module'", "<script data-type='module'", 1)
+		html = strings.Replace(html, "<script", "<script type='text/plain' "+marker, 1)
+		html += buildLoaderScript(config, marker)
+	}
+
+	// the beforeSend function has to exist before the umami script runs
+	if config.BeforeSendScript != "" {
+		html = fmt.Sprintf("<script>%s</script>", config.BeforeSendScript) + html
+	}
+	if config.OutboundLinks {
+		html += buildOutboundLinksScript(config)
+	}
+	if config.TrackDownloads && len(config.DownloadExtensions) > 0 {
+		html += buildDownloadsScript(config)
+	}
+	if config.SPARouteEvent != "" {
+		html += buildSPARouteScript(config)
+	}
+	return html, nil
+}
+
+// js expression that is true if the client opted out of tracking
+// mirrors the checks of the umami script.
+func buildClientDisabledCheck(config *Config) string {
+	check := "(function () { try { return localStorage.getItem('umami.disabled'); } catch (e) {} })()"
+	if config.DoNotTrack {
+		check += " || navigator.doNotTrack == '1' || window.doNotTrack == '1'"
+	}
+	return check
+}
+
+// loader replacing the inert scripts marked with the marker attribute by
+// executable ones, scheduled by the injectLoadStrategy
+// in consent mode only once the consent cookie or localStorage flag is 'true'
+// window.umamiConsent() activates them right after the user opted in.
+func buildLoaderScript(config *Config, marker string) string {
+	html := "<script>"
+	html += "(function () {"
+	if config.ConsentMode {
+		html += fmt.Sprintf("var name = '%s';", config.ConsentCookie)
+		html += "function granted() {"
+		html += "try { if (localStorage.getItem(name) === 'true') return true; } catch (e) {}"
+		html += "return document.cookie.split('; ').indexOf(name + '=true') >= 0;"
+		html += "}"
+	}
+	html += "function activate() {"
+	html += fmt.Sprintf("var stubs = document.querySelectorAll('script[%s]');", marker)
+	html += "for (var i = 0; i < stubs.length; i++) {"
+	html += "var stub = stubs[i], el = document.createElement('script');"
+	html += "for (var j = 0; j < stub.attributes.length; j++) {"
+	html += "var a = stub.attributes[j];"
+	html += "if (a.name === 'data-type') el.setAttribute('type', a.value);"
+	html += fmt.Sprintf("else if (a.name !== 'type' && a.name !== '%s') el.setAttribute(a.name, a.value);", marker)
+	html += "}"
+	html += "el.text = stub.text;"
+	html += "stub.parentNode.replaceChild(el, stub);"
+	html += "}"
+	html += "}"
+	if config.ConsentMode {
+		html += "window.umamiConsent = activate;"
+		html += "function start() { if (granted()) activate(); }"
+	} else {
+		html += "var start = activate;"
+	}
+	switch config.InjectLoadStrategy {
+	case ILStrategyOnload:
+		html += "if (document.readyState === 'complete') start();"
+		html += "else window.addEventListener('load', start);"
+	case ILStrategyIdle:
+		// browsers without requestIdleCallback wait for the load event
+		html += "if (window.requestIdleCallback) requestIdleCallback(start);"
+		html += "else if (document.readyState === 'complete') start();"
+		html += "else window.addEventListener('load', start);"
+	default:
+		html += "start();"
+	}
+	html += "})();"
+	html += "</script>"
+	return html
+}
+
+// helper reporting clicks on links to other hosts as umami events.
+func buildOutboundLinksScript(config *Config) string {
+	html := "<script>"
+	html += "(function () {"
+	html += fmt.Sprintf("if (%s) return;", buildClientDisabledCheck(config))
+	html += "document.addEventListener('click', function (e) {"
+	html += "var a = e.target.closest && e.target.closest('a[href]');"
+	html += "if (!a || a.host === location.host || !/^https?:$/.test(a.protocol)) return;"
+	html += "if (window.umami) window.umami.track('outbound-link', { url: a.href });"
+	html += "}, true);"
+	html += "})();"
+	html += "</script>"
+	return html
+}
+
+// helper reporting clicks on links to files with the download extensions
+// as umami download events.
+func buildDownloadsScript(config *Config) string {
+	extensions := make([]string, 0, len(config.DownloadExtensions))
+	for _, extension := range config.DownloadExtensions {
+		extensions = append(extensions, fmt.Sprintf("'%s'", strings.ToLower(strings.TrimPrefix(extension, "."))))
 	}
+	html := "<script>"
+	html += "(function () {"
+	html += fmt.Sprintf("if (%s) return;", buildClientDisabledCheck(config))
+	html += fmt.Sprintf("var extensions = [%s];", strings.Join(extensions, ","))
+	html += "document.addEventListener('click', function (e) {"
+	html += "var a = e.target.closest && e.target.closest('a[href]');"
+	html += "if (!a || !/^https?:$/.test(a.protocol)) return;"
+	html += "var file = a.pathname.split('/').pop(), dot = file.lastIndexOf('.');"
+	html += "if (dot < 0 || extensions.indexOf(file.slice(dot + 1).toLowerCase()) < 0) return;"
+	html += "if (window.umami) window.umami.track('download', { url: a.href, file: file });"
+	html += "}, true);"
+	html += "})();"
+	html += "</script>"
+	return html
+}
+
+// helper tracking a pageview on the spaRouteEvent for routers not changing
+// the history, captured on window wherever it is dispatched.
+func buildSPARouteScript(config *Config) string {
+	html := "<script>"
+	html += "(function () {"
+	html += fmt.Sprintf("if (%s) return;", buildClientDisabledCheck(config))
+	html += fmt.Sprintf("window.addEventListener('%s', function () {", config.SPARouteEvent)
+	html += "if (window.umami) window.umami.track();"
+	html += "}, true);"
+	html += "})();"
+	html += "</script>"
+	return html
 }
 
 func buildUmamiScriptWithEvade(config *Config, scriptJs, src string) string {
@@ -63,9 +538,14 @@ func buildUmamiScriptWithEvade(config *Config, scriptJs, src string) string {
 		html += fmt.Sprintf("el.setAttribute('src', '%s');", src)
 	} else if config.ScriptInjectionMode == SIModeSource {
 		scriptBase64 := base64.StdEncoding.EncodeToString([]byte(scriptJs))
-		html += "el.setAttribute('type', 'text/javascript');"
+		if config.ScriptType == "" {
+			html += "el.setAttribute('type', 'text/javascript');"
+		}
 		html += fmt.Sprintf("el.innerHTML = atob('%s');", scriptBase64)
 	}
+	if config.ScriptType == STypeModule {
+		html += "el.setAttribute('type', 'module');"
+	}
 	html += fmt.Sprintf("el.setAttribute('data-website-id', '%s');", config.WebsiteId)
 	if config.AutoTrack {
 		html += "el.setAttribute('data-auto-track', 'true');"
@@ -81,6 +561,12 @@ func buildUmamiScriptWithEvade(config *Config, scriptJs, src string) string {
 	if len(config.Domains) > 0 {
 		html += fmt.Sprintf("el.setAttribute('data-domains', '%s');", strings.Join(config.Domains, ","))
 	}
+	if config.BeforeSend != "" {
+		html += fmt.Sprintf("el.setAttribute('data-before-send', '%s');", config.BeforeSend)
+	}
+	if config.EnvironmentTag != "" {
+		html += fmt.Sprintf("el.setAttribute('data-tag', '%s');", config.EnvironmentTag)
+	}
 	html += "document.body.appendChild(el);"
 	html += "})();"
 	html += "</script>"
@@ -89,8 +575,13 @@ func buildUmamiScriptWithEvade(config *Config, scriptJs, src string) string {
 
 func buildUmamiScriptWithoutEvade(config *Config, scriptJs, src string) string {
 	html := "<script"
-	html += " async"
-	html += " defer"
+	if config.ScriptType == STypeModule {
+		// module scripts are deferred anyway
+		html += " type='module'"
+	} else {
+		html += " async"
+		html += " defer"
+	}
 	html += fmt.Sprintf(" data-host-url='/%s'", config.ForwardPath)
 	if config.ScriptInjectionMode == SIModeTag {
 		html += fmt.Sprintf(" src='%s'", src)
@@ -110,6 +601,12 @@ func buildUmamiScriptWithoutEvade(config *Config, scriptJs, src string) string {
 	if len(config.Domains) > 0 {
 		html += fmt.Sprintf(" data-domains='%s'", strings.Join(config.Domains, ","))
 	}
+	if config.BeforeSend != "" {
+		html += fmt.Sprintf(" data-before-send='%s'", config.BeforeSend)
+	}
+	if config.EnvironmentTag != "" {
+		html += fmt.Sprintf(" data-tag='%s'", config.EnvironmentTag)
+	}
 	html += ">"
 	if config.ScriptInjectionMode == SIModeSource {
 		html += scriptJs
@@ -118,23 +615,49 @@ func buildUmamiScriptWithoutEvade(config *Config, scriptJs, src string) string {
 	return html
 }
 
-func downloadScript(config *Config, ctx context.Context) (string, error) {
-	// request
-	url := fmt.Sprintf("%s/script.js", config.UmamiHost)
-	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// sets a per-request attribute on the umami script, next to its data-website-id
+// the value must not contain quotes or backslashes, eg. an escaped path with ' encoded as well.
+func withScriptAttribute(scriptHtml string, name string, value string) string {
+	if strings.Contains(scriptHtml, "el.setAttribute('data-website-id'") {
+		return strings.Replace(scriptHtml, "el.setAttribute('data-website-id'", fmt.Sprintf("el.setAttribute('%s', '%s');el.setAttribute('data-website-id'", name, value), 1)
+	}
+	return strings.Replace(scriptHtml, " data-website-id='", fmt.Sprintf(" %s='%s' data-website-id='", name, html.EscapeString(value)), 1)
+}
+
+// the cache-busting version appended to the script src
+// auto hashes the current script, so it changes with umami upgrades.
+func scriptVersion(config *Config) (string, error) {
+	if config.ScriptVersionQuery != SVQueryAuto {
+		return config.ScriptVersionQuery, nil
+	}
+	scriptJs, err := downloadScript(config, context.Background())
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("User-Agent", "traefik-umami-plugin")
-	req.Header.Set("Accept", "application/javascript")
-	req.Header.Set("Accept-Encoding", "identity")
+	sum := sha256.Sum256([]byte(scriptJs))
+	return hex.EncodeToString(sum[:4]), nil
+}
 
+// tries the umami hosts in order.
+func downloadScript(config *Config, ctx context.Context) (string, error) {
 	// make request
+	hosts := &umamiHostPool{hosts: umamiHostList(config)}
 	client := &http.Client{}
-	res, err := client.Do(req)
+	res, err := hosts.do(client, func(host string) (*http.Request, error) {
+		url := fmt.Sprintf("%s/script.js", host)
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("User-Agent", "traefik-umami-plugin")
+		req.Header.Set("Accept", "application/javascript")
+		req.Header.Set("Accept-Encoding", "identity")
+		return req, nil
+	})
 	if err != nil {
 		return "", err
 	}
+	defer res.Body.Close()
 
 	// read response
 	body, err := io.ReadAll(res.Body)
@@ -0,0 +1,774 @@
+package traefik_umami_plugin
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestBeforeSend(t *testing.T) {
+	tests := []struct {
+		name       string
+		beforeSend string
+		script     string
+		evade      bool
+		wantIssue  string
+		wantHtml   []string
+		wantPrefix string
+	}{
+		{"attribute", "scrubUrl", "", false, "", []string{" data-before-send='scrubUrl'"}, "<script async"},
+		{"attribute evade", "scrubUrl", "", true, "", []string{"el.setAttribute('data-before-send', 'scrubUrl');"}, "<script>"},
+		{"helper script", "scrubUrl", "function scrubUrl(t, p) { return p; }", false, "", []string{" data-before-send='scrubUrl'"}, "<script>function scrubUrl(t, p) { return p; }</script><script async"},
+		{"dollar name", "$scrub_1", "", false, "", []string{" data-before-send='$scrub_1'"}, "<script async"},
+		{"invalid name", "scrub()", "", false, "beforeSend", nil, ""},
+		{"quoted name", "a'b", "", false, "beforeSend", nil, ""},
+		{"leading digit", "1scrub", "", false, "beforeSend", nil, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.BeforeSend = test.beforeSend
+			config.BeforeSendScript = test.script
+			config.EvadeGoogleTagManager = test.evade
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				// passed through unmodified
+				if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != testPage {
+					t.Errorf("body = %q, want it unmodified", body)
+				}
+				return
+			}
+			scriptHtml := h.getScriptHtml()
+			for _, want := range test.wantHtml {
+				if !strings.Contains(scriptHtml, want) {
+					t.Errorf("script %q does not contain %q", scriptHtml, want)
+				}
+			}
+			if !strings.HasPrefix(scriptHtml, test.wantPrefix) {
+				t.Errorf("script %q does not start with %q", scriptHtml, test.wantPrefix)
+			}
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); !strings.Contains(body, scriptHtml) {
+				t.Errorf("body %q does not contain the script", body)
+			}
+		})
+	}
+}
+
+func TestOutboundLinks(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		doNotTrack bool
+		want       []string
+		wantAbsent []string
+	}{
+		{"disabled", false, false, nil, []string{"outbound-link"}},
+		{"enabled", true, false, []string{"window.umami.track('outbound-link'", "localStorage.getItem('umami.disabled')"}, []string{"navigator.doNotTrack"}},
+		{"enabled with doNotTrack", true, true, []string{"window.umami.track('outbound-link'", "navigator.doNotTrack == '1'"}, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.OutboundLinks = test.enabled
+			config.DoNotTrack = test.doNotTrack
+			body := serve(newTestPlugin(t, config, htmlHandler("text/html", testPage)), htmlRequest(http.MethodGet, "/")).Body.String()
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+			for _, absent := range test.wantAbsent {
+				if strings.Contains(body, absent) {
+					t.Errorf("body %q contains %q", body, absent)
+				}
+			}
+			// after the umami script, before </body>
+			if test.enabled && strings.Index(body, "outbound-link") < strings.Index(body, "data-website-id") {
+				t.Errorf("helper is injected before the umami script")
+			}
+		})
+	}
+}
+
+// the attributes of the first <script> tag with the attribute.
+func scriptTagWith(t *testing.T, html string, attribute string) string {
+	t.Helper()
+	for _, match := range scriptTagRegex.FindAllStringSubmatch(html, -1) {
+		if strings.Contains(match[1], attribute) {
+			return match[1]
+		}
+	}
+	t.Fatalf("no script tag with %s in %q", attribute, html)
+	return ""
+}
+
+func TestConsentMode(t *testing.T) {
+	tests := []struct {
+		name       string
+		cookie     string
+		scriptType string
+		wantIssue  string
+		wantTag    []string
+		wantLoader []string
+	}{
+		{"default cookie", "", "", "", []string{" type='text/plain'", " data-consent", " src='/_umami/script.js'"}, []string{"var name = 'umami-consent';", "window.umamiConsent = activate;"}},
+		{"custom cookie", "analytics_ok", "", "", []string{" type='text/plain'", " data-consent"}, []string{"var name = 'analytics_ok';", "name + '=true'"}},
+		{"module", "", STypeModule, "", []string{" type='text/plain'", " data-type='module'"}, []string{"if (a.name === 'data-type') el.setAttribute('type', a.value);"}},
+		{"invalid cookie", "consent;", "", "consentCookie", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ConsentMode = true
+			if test.cookie != "" {
+				config.ConsentCookie = test.cookie
+			}
+			config.ScriptType = test.scriptType
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			tag := scriptTagWith(t, body, "data-website-id")
+			for _, want := range test.wantTag {
+				if !strings.Contains(tag, want) {
+					t.Errorf("tag %q does not contain %q", tag, want)
+				}
+			}
+			// only one type, the inert one, until the loader activates it
+			if strings.Count(tag, " type=") != 1 {
+				t.Errorf("tag %q has an executable type", tag)
+			}
+			for _, want := range test.wantLoader {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipFramedRequests(t *testing.T) {
+	tests := []struct {
+		name         string
+		skip         bool
+		dest         string
+		wantInjected bool
+	}{
+		{"document", true, "document", true},
+		{"no fetch metadata", true, "", true},
+		{"iframe", true, "iframe", false},
+		{"frame", true, "frame", false},
+		{"embed", true, "embed", false},
+		{"object", true, "object", false},
+		{"uppercase", true, "IFRAME", false},
+		{"iframe not skipped", false, "iframe", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.SkipFramedRequests = test.skip
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			req := htmlRequest(http.MethodGet, "/")
+			if test.dest != "" {
+				req.Header.Set("Sec-Fetch-Dest", test.dest)
+			}
+			body := serve(h, req).Body.String()
+			if injected := strings.Contains(body, "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+		})
+	}
+}
+
+func TestInjections(t *testing.T) {
+	const preconnect = `<link rel="preconnect" href="/_umami">`
+	tests := []struct {
+		name       string
+		injections []Injection
+		limit      int
+		body       string
+		want       string // %s is the umami script
+		wantIssue  string
+	}{
+		{
+			name:       "head and body",
+			injections: []Injection{{Anchor: `</head>`, Html: preconnect}, {Anchor: `</body>`}},
+			body:       "<html><head></head><body></body></html>",
+			want:       "<html><head>" + preconnect + "</head><body>%s</body></html>",
+		},
+		{
+			name:       "configured order on a shared anchor",
+			injections: []Injection{{Anchor: `</body>`, Html: "<a>"}, {Anchor: `</body>`, Html: "<b>"}},
+			body:       "<body></body>",
+			want:       "<body><a><b></body>",
+		},
+		{
+			name:       "after an at group",
+			injections: []Injection{{Anchor: `<head[^>]*>(?P<at>)`, Html: preconnect}},
+			body:       "<html><head lang=en><title></title></head></html>",
+			want:       "<html><head lang=en>" + preconnect + "<title></title></head></html>",
+		},
+		{
+			name:       "missing anchor skipped",
+			injections: []Injection{{Anchor: `</head>`, Html: preconnect}, {Anchor: `</body>`}},
+			body:       "<body></body>",
+			want:       "<body>%s</body>",
+		},
+		{
+			name:       "first match only",
+			injections: []Injection{{Anchor: `<hr>`, Html: "<br>"}},
+			body:       "<hr><hr>",
+			want:       "<br><hr><hr>",
+		},
+		{
+			name:       "up to the limit",
+			injections: []Injection{{Anchor: `<hr>`, Html: "<br>"}},
+			limit:      2,
+			body:       "<hr><hr><hr>",
+			want:       "<br><hr><br><hr><hr>",
+		},
+		{
+			name:       "invalid anchor",
+			injections: []Injection{{Anchor: `(</body>`}},
+			wantIssue:  "injections",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Injections = test.injections
+			if test.limit > 0 {
+				config.MaxInjectionsPerResponse = test.limit
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", test.body))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			if want := strings.Replace(test.want, "%s", h.getScriptHtml(), 1); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestScriptType(t *testing.T) {
+	tests := []struct {
+		name       string
+		scriptType string
+		evade      bool
+		wantIssue  string
+		want       []string
+		wantAbsent []string
+	}{
+		{"classic", "", false, "", []string{"<script async defer data-host-url="}, []string{"type='module'"}},
+		{"module", STypeModule, false, "", []string{"<script type='module' data-host-url="}, []string{" async", " defer"}},
+		{"module evade", STypeModule, true, "", []string{"el.setAttribute('type', 'module');"}, nil},
+		{"classic evade", "", true, "", nil, []string{"'module'"}},
+		{"invalid", "text/babel", false, "scriptType", nil, nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptType = test.scriptType
+			config.EvadeGoogleTagManager = test.evade
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			scriptHtml := h.getScriptHtml()
+			for _, want := range test.want {
+				if !strings.Contains(scriptHtml, want) {
+					t.Errorf("script %q does not contain %q", scriptHtml, want)
+				}
+			}
+			for _, absent := range test.wantAbsent {
+				if strings.Contains(scriptHtml, absent) {
+					t.Errorf("script %q contains %q", scriptHtml, absent)
+				}
+			}
+		})
+	}
+}
+
+func TestHydrationMarker(t *testing.T) {
+	const nextPage = `<!DOCTYPE html><html><head></head><body><div id="__next"></div><script id="__NEXT_DATA__" type="application/json">{"props":{}}</script></body></html>`
+	tests := []struct {
+		name   string
+		marker string
+		body   string
+		before string // the script is injected right before it
+	}{
+		{"next.js", `<script id="__NEXT_DATA__"`, nextPage, `<script id="__NEXT_DATA__"`},
+		{"marker missing", `<script id="__NUXT__"`, nextPage, `</body>`},
+		{"no marker", "", nextPage, `</body>`},
+		{"regex characters", `<div id="app">(*)`, `<body><div id="app">(*)</div></body>`, `<div id="app">(*)`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.HydrationMarker = test.marker
+			h := newTestPlugin(t, config, htmlHandler("text/html", test.body))
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			want := strings.Replace(test.body, test.before, h.getScriptHtml()+test.before, 1)
+			if body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestScriptVersionQuery(t *testing.T) {
+	umami, _ := newUmamiStub(t)
+	sum := sha256.Sum256([]byte("umami /script.js"))
+	tests := []struct {
+		name      string
+		version   string
+		evade     bool
+		wantSrc   string
+		wantIssue string
+	}{
+		{"none", "", false, "/_umami/script.js", ""},
+		{"static", "2.13.0", false, "/_umami/script.js?v=2.13.0", ""},
+		{"static evade", "2.13.0", true, "/_umami/script.js?v=2.13.0", ""},
+		{"auto", SVQueryAuto, false, "/_umami/script.js?v=" + hex.EncodeToString(sum[:4]), ""},
+		{"invalid", "v=1&x", false, "", "scriptVersionQuery"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptVersionQuery = test.version
+			config.EvadeGoogleTagManager = test.evade
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			scriptHtml := h.getScriptHtml()
+			if !strings.Contains(scriptHtml, "'"+test.wantSrc+"'") {
+				t.Errorf("script %q does not load %q", scriptHtml, test.wantSrc)
+			}
+			// stable across rebuilds while the script doesn't change
+			if err := h.rebuildScript(); err != nil {
+				t.Fatal(err)
+			}
+			if rebuilt := h.getScriptHtml(); rebuilt != scriptHtml {
+				t.Errorf("rebuilt script %q differs from %q", rebuilt, scriptHtml)
+			}
+		})
+	}
+}
+
+func TestInjectLoadStrategy(t *testing.T) {
+	tests := []struct {
+		strategy   string
+		wantInert  bool
+		wantLoader []string
+		wantIssue  string
+	}{
+		{ILStrategyImmediate, false, nil, ""},
+		{ILStrategyOnload, true, []string{"else window.addEventListener('load', start);"}, ""},
+		{ILStrategyIdle, true, []string{"if (window.requestIdleCallback) requestIdleCallback(start);", "else window.addEventListener('load', start);"}, ""},
+		{"lazy", false, nil, "injectLoadStrategy"},
+	}
+	for _, test := range tests {
+		t.Run(test.strategy, func(t *testing.T) {
+			config := testConfig()
+			config.InjectLoadStrategy = test.strategy
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			tag := scriptTagWith(t, body, "data-website-id")
+			if inert := strings.Contains(tag, " type='text/plain' data-deferred"); inert != test.wantInert {
+				t.Errorf("tag %q inert = %v, want %v", tag, inert, test.wantInert)
+			}
+			if loader := strings.Contains(body, "script[data-deferred]"); loader != test.wantInert {
+				t.Errorf("loader injected = %v, want %v", loader, test.wantInert)
+			}
+			for _, want := range test.wantLoader {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+		})
+	}
+}
+
+func TestFirstVisitOnly(t *testing.T) {
+	tests := []struct {
+		name         string
+		firstVisit   bool
+		cookie       bool
+		wantInjected bool
+		wantCookie   bool
+	}{
+		{"first visit", true, false, true, true},
+		{"following visit", true, true, false, false},
+		{"disabled", false, true, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.FirstVisitOnly = test.firstVisit
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			req := htmlRequest(http.MethodGet, "/")
+			if test.cookie {
+				req.AddCookie(&http.Cookie{Name: firstVisitCookie, Value: "1"})
+			}
+			rw := serve(h, req)
+			if injected := strings.Contains(rw.Body.String(), "data-website-id"); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			cookie := rw.Header().Get("Set-Cookie")
+			if (cookie != "") != test.wantCookie || (test.wantCookie && !strings.HasPrefix(cookie, firstVisitCookie+"=1; Path=/; HttpOnly")) {
+				t.Errorf("Set-Cookie = %q, want cookie %v", cookie, test.wantCookie)
+			}
+		})
+	}
+}
+
+func TestReplaceTagSelector(t *testing.T) {
+	tests := []struct {
+		name     string
+		selector string
+		page     string
+		want     string // SCRIPT marks the umami script, empty if unmodified
+	}{
+		{"stub", "data-umami", `<html><head><script data-umami></script></head><body></body></html>`, `<html><head>SCRIPT</head><body></body></html>`},
+		{"stub with value and content", "data-umami", `<head><script type="text/plain" data-umami="x">placeholder</script></head>`, `<head>SCRIPT</head>`},
+		{"uppercase stub", "data-umami", `<head><SCRIPT data-umami></SCRIPT ></head>`, `<head>SCRIPT</head>`},
+		{"other scripts kept", "data-umami", `<head><script src="app.js"></script><script data-umami></script></head>`, `<head><script src="app.js"></script>SCRIPT</head>`},
+		{"attribute prefix", "data-umami", testPage[:len(testPage)-len("</body></html>")] + `<script data-umami-id="x"></script></body></html>`, ""},
+		{"no stub", "data-umami", testPage, ""},
+		{"invalid selector", "data umami", `<head><script data-umami></script></head>`, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ReplaceTagSelector = test.selector
+			h := newTestPlugin(t, config, htmlHandler("text/html", test.page))
+			want := test.page
+			if test.want != "" {
+				want = strings.Replace(test.want, "SCRIPT", h.getScriptHtml(), 1)
+			}
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestExtractTitle(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		encoding string
+		page     string
+		want     string
+	}{
+		{"title", true, "", testPage, "Test"},
+		{"entities and whitespace", true, "", "<html><head><title lang='en'>\n  Fish &amp; Chips\t Menu </title></head><body></body></html>", "Fish & Chips Menu"},
+		{"uppercase tag", true, "", "<HTML><HEAD><TITLE>Shouting</TITLE></HEAD><BODY></BODY></HTML>", "Shouting"},
+		{"gzip", true, "gzip", testPage, "Test"},
+		{"truncated", true, "", "<title>" + strings.Repeat("ü", maxTitleLength+10) + "</title>", strings.Repeat("ü", maxTitleLength)},
+		{"no title", true, "", "<html><head></head><body><h1>Untitled</h1></body></html>", ""},
+		{"disabled", false, "", testPage, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			config.ExtractTitle = test.enabled
+			next := htmlHandler("text/html", test.page)
+			if test.encoding != "" {
+				next = encodedHtmlHandler(t, test.encoding, test.page)
+			}
+			h := newTestPlugin(t, config, next)
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, "/"))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Title != test.want {
+				t.Errorf("title = %q, want %q", events[0].Title, test.want)
+			}
+		})
+	}
+}
+
+func TestMinifiedInjection(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want string // SCRIPT marks the umami script
+	}{
+		{"one line", `<!doctype html><html lang=en><head><meta charset=utf-8><title>x</title><script src=/a.js></script></head><body class=a><p>x</p></body></html>`, `<!doctype html><html lang=en><head><meta charset=utf-8><title>x</title><script src=/a.js></script></head><body class=a><p>x</p>SCRIPT</body></html>`},
+		{"uppercase", `<HTML><HEAD></HEAD><BODY><P>x</P></BODY></HTML>`, `<HTML><HEAD></HEAD><BODY><P>x</P>SCRIPT</BODY></HTML>`},
+		{"whitespace in the end tag", "<body><p>x</p></body\n></html>", "<body><p>x</p>SCRIPT</body\n></html>"},
+		{"no end tag after the body", `<body><p>x</p></body>`, `<body><p>x</p>SCRIPT</body>`},
+		{"no head and body", `<!doctype html><html lang=en><p>x`, `<!doctype html><html lang=en>SCRIPT<p>x`},
+		{"quoted attribute", `<html lang="en" data-a='x>y'><p>x`, `<html lang="en" data-a='x>y'>SCRIPT<p>x`},
+		{"doctype only", `<!DOCTYPE html><p>x</p>`, `<!DOCTYPE html>SCRIPT<p>x</p>`},
+		{"quoted doctype", `<!DOCTYPE html PUBLIC "-//W3C//DTD HTML 4.01//EN" "a>b"><p>x</p>`, `<!DOCTYPE html PUBLIC "-//W3C//DTD HTML 4.01//EN" "a>b">SCRIPT<p>x</p>`},
+		{"html prefix", `<htmlx><p>x</p>`, `<htmlx><p>x</p>`},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), htmlHandler("text/html", test.page))
+			want := strings.Replace(test.want, "SCRIPT", h.getScriptHtml(), 1)
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q\nwant %q", body, want)
+			}
+		})
+	}
+}
+
+func TestLeadingBOMAndWhitespace(t *testing.T) {
+	bom := "\xEF\xBB\xBF"
+	tests := []struct {
+		name       string
+		page       string
+		injections []Injection
+		want       string // SCRIPT marks the umami script
+	}{
+		{"bom", bom + testPage, nil, bom + strings.Replace(testPage, "</body>", "SCRIPT</body>", 1)},
+		{"blank lines", "\n\r\n  \t" + testPage, nil, "\n\r\n  \t" + strings.Replace(testPage, "</body>", "SCRIPT</body>", 1)},
+		{"bom and blank lines", bom + "\n\n" + testPage, nil, bom + "\n\n" + strings.Replace(testPage, "</body>", "SCRIPT</body>", 1)},
+		{"legacy page with bom", bom + "<!DOCTYPE html><p>x</p>", nil, bom + "<!DOCTYPE html>SCRIPT<p>x</p>"},
+		{"anchored at the start", bom + "\n<!DOCTYPE html><html></html>", []Injection{{Anchor: `^<!DOCTYPE html>`, Html: "<!-- x -->"}}, bom + "\n<!-- x --><!DOCTYPE html><html></html>"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.Injections = test.injections
+			h := newTestPlugin(t, config, htmlHandler("text/html", test.page))
+			want := strings.Replace(test.want, "SCRIPT", h.getScriptHtml(), 1)
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q\nwant %q", body, want)
+			}
+		})
+	}
+}
+
+func TestMaxInjectionsPerResponse(t *testing.T) {
+	twoHeads := "<html><head></head><head></head><body></body></html>"
+	tests := []struct {
+		name       string
+		limit      int
+		injections []Injection
+		selector   string
+		body       string
+		want       string // SCRIPT marks the umami script
+		wantIssue  string
+	}{
+		{"two heads once", 1, []Injection{{Anchor: `</head>`}}, "", twoHeads, "<html><head>SCRIPT</head><head></head><body></body></html>", ""},
+		{"two heads twice", 2, []Injection{{Anchor: `</head>`}}, "", twoHeads, "<html><head>SCRIPT</head><head>SCRIPT</head><body></body></html>", ""},
+		{"two bodies once", 1, nil, "", "<body></body><body></body>", "<body>SCRIPT</body><body></body>", ""},
+		{"limit above the matches", 5, nil, "", "<body></body>", "<body>SCRIPT</body>", ""},
+		{"two stubs once", 1, nil, "data-umami", "<script data-umami></script><script data-umami></script>", "SCRIPT<script data-umami></script>", ""},
+		{"zero", 0, nil, "", testPage, testPage, "maxInjectionsPerResponse"},
+		{"negative", -1, nil, "", testPage, testPage, "maxInjectionsPerResponse"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.MaxInjectionsPerResponse = test.limit
+			config.Injections = test.injections
+			config.ReplaceTagSelector = test.selector
+			h := newTestPlugin(t, config, htmlHandler("text/html", test.body))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			want := strings.ReplaceAll(test.want, "SCRIPT", h.getScriptHtml())
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q\nwant %q", body, want)
+			}
+		})
+	}
+}
+
+func TestTrackDownloads(t *testing.T) {
+	tests := []struct {
+		name       string
+		enabled    bool
+		extensions []string
+		doNotTrack bool
+		want       []string
+		wantAbsent []string
+		wantIssue  string
+	}{
+		{"disabled", false, []string{"pdf"}, false, nil, []string{"'download'"}, ""},
+		{"defaults", true, nil, false, []string{"window.umami.track('download'", "var extensions = ['pdf','zip','dmg','exe','msi','csv','docx','xlsx','pptx','mp3','mp4'];", "localStorage.getItem('umami.disabled')"}, []string{"navigator.doNotTrack"}, ""},
+		{"configured", true, []string{".PDF", "epub"}, false, []string{"var extensions = ['pdf','epub'];"}, []string{"'zip'"}, ""},
+		{"with doNotTrack", true, []string{"pdf"}, true, []string{"window.umami.track('download'", "navigator.doNotTrack == '1'"}, nil, ""},
+		{"no extensions", true, []string{}, false, nil, []string{"'download'"}, ""},
+		{"invalid extension", true, []string{"pdf", "x');alert('"}, false, nil, []string{"'download'", "alert"}, "downloadExtensions"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.TrackDownloads = test.enabled
+			if test.extensions != nil {
+				config.DownloadExtensions = test.extensions
+			}
+			config.DoNotTrack = test.doNotTrack
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+			for _, absent := range test.wantAbsent {
+				if strings.Contains(body, absent) {
+					t.Errorf("body %q contains %q", body, absent)
+				}
+			}
+			if test.want != nil && strings.Index(body, "'download'") < strings.Index(body, "data-website-id") {
+				t.Errorf("helper is injected before the umami script")
+			}
+		})
+	}
+}
+
+func TestSkipInjectUserAgents(t *testing.T) {
+	browser := "Mozilla/5.0 (X11; Linux x86_64; rv:120.0) Gecko/20100101 Firefox/120.0"
+	tests := []struct {
+		name         string
+		patterns     []string
+		skipTracking bool
+		userAgent    string
+		wantInjected bool
+		wantTracked  bool
+		wantIssue    string
+	}{
+		{"browser", []string{"axe-core", `Lighthouse/\d+`}, false, browser, true, false, ""},
+		{"matching", []string{"axe-core", `Lighthouse/\d+`}, false, "Mozilla/5.0 Chrome-Lighthouse/11", false, true, ""},
+		{"ignoring case", []string{"AXE-CORE"}, false, "axe-core/4.8", false, true, ""},
+		{"matching tracking skipped", []string{"InternalCrawler"}, true, "InternalCrawler/1.0", false, false, ""},
+		{"browser tracking skipped", []string{"InternalCrawler"}, true, browser, true, false, ""},
+		{"invalid pattern", []string{"(crawler"}, false, browser, false, false, "skipInjectUserAgents"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			config.ServerSideTrackingMode = SSTModeNotinjected
+			config.SkipInjectUserAgents = test.patterns
+			config.SkipUserAgentsTracking = test.skipTracking
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("User-Agent", test.userAgent)
+			body := serve(h, req).Body.String()
+			if injected := strings.Contains(body, h.getScriptHtml()); injected != test.wantInjected {
+				t.Errorf("injected = %v, want %v", injected, test.wantInjected)
+			}
+			// notinjected tracks the pages that didn't get the script
+			if tracked := len(sink.payloads()) == 1; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestLegacyAnchors(t *testing.T) {
+	tests := []struct {
+		name string
+		page string
+		want string // SCRIPT marks the umami script, empty if unmodified
+	}{
+		{"bare html", "<html><p>old</p></html>", "<html>SCRIPT<p>old</p></html>"},
+		{"doctype and html", "<!DOCTYPE html><html lang=en><p>old</p></html>", "<!DOCTYPE html><html lang=en>SCRIPT<p>old</p></html>"},
+		{"doctype only", "<!doctype html><p>old</p>", "<!doctype html>SCRIPT<p>old</p>"},
+		{"body end first", "<html><p>old</p></body></html>", "<html><p>old</p>SCRIPT</body></html>"},
+		{"not with a head", "<html><head><title>x</title></head><p>old</p></html>", ""},
+		{"not with a body", "<!DOCTYPE html><html><BODY class=x><p>old</p></html>", ""},
+		{"neither", "<p>fragment</p>", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newTestPlugin(t, testConfig(), htmlHandler("text/html", test.page))
+			want := test.page
+			if test.want != "" {
+				want = strings.Replace(test.want, "SCRIPT", h.getScriptHtml(), 1)
+			}
+			if body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String(); body != want {
+				t.Errorf("body = %q\nwant %q", body, want)
+			}
+		})
+	}
+}
+
+func TestSPARouteEvent(t *testing.T) {
+	tests := []struct {
+		name       string
+		event      string
+		doNotTrack bool
+		want       []string
+		wantAbsent []string
+		wantIssue  string
+	}{
+		{"disabled", "", false, nil, []string{"window.addEventListener("}, ""},
+		{"enabled", "router:change", false, []string{"window.addEventListener('router:change', function () {if (window.umami) window.umami.track();}, true);", "localStorage.getItem('umami.disabled')"}, []string{"navigator.doNotTrack"}, ""},
+		{"with doNotTrack", "routechange", true, []string{"window.addEventListener('routechange'", "navigator.doNotTrack == '1'"}, nil, ""},
+		{"invalid event", "x');alert('", false, nil, []string{"window.addEventListener(", "alert"}, "spaRouteEvent"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.SPARouteEvent = test.event
+			config.DoNotTrack = test.doNotTrack
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			for _, want := range test.want {
+				if !strings.Contains(body, want) {
+					t.Errorf("body %q does not contain %q", body, want)
+				}
+			}
+			for _, absent := range test.wantAbsent {
+				if strings.Contains(body, absent) {
+					t.Errorf("body %q contains %q", body, absent)
+				}
+			}
+			if test.want != nil && strings.Index(body, "window.addEventListener(") < strings.Index(body, "data-website-id") {
+				t.Errorf("helper is injected before the umami script")
+			}
+		})
+	}
+}
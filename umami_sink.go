@@ -0,0 +1,227 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+// TrackingSink delivers server side tracking payloads.
+type TrackingSink interface {
+	Send(payload []byte) error
+}
+
+// sinks that need the client request of a payload, eg. for its headers
+// the plugin sends through the sink returned by forRequest.
+type requestSink interface {
+	TrackingSink
+	forRequest(clientReq *http.Request) TrackingSink
+}
+
+// the sink to send the payload of the client request through.
+func sinkForRequest(sink TrackingSink, clientReq *http.Request) TrackingSink {
+	if bound, ok := sink.(requestSink); ok {
+		return bound.forRequest(clientReq)
+	}
+	return sink
+}
+
+// sends payloads to umami's /api/send
+// honoring Retry-After of an overloaded umami by holding payloads until then
+// payloads are dropped while the circuit is open
+// the headers sent to umami are the ones of clientReq, a copy taken by forRequest.
+type httpSink struct {
+	config    *Config
+	client    *http.Client
+	hosts     *umamiHostPool
+	throttle  *trackingThrottle
+	circuit   *circuitBreaker
+	clientReq *http.Request // nil sends the payload without client headers
+}
+
+// a copy of the sink bound to a copy of the client request, which may be
+// reused once the request is served.
+func (s *httpSink) forRequest(clientReq *http.Request) TrackingSink {
+	bound := *s
+	bound.clientReq = clientReq.Clone(context.Background())
+	return &bound
+}
+
+func (s *httpSink) Send(payload []byte) error {
+	// checked first, so a pause doesn't use up the probe of the circuit
+	if held, err := s.throttle.hold(time.Now(), s, payload); held {
+		return err
+	}
+	if s.circuit != nil && !s.circuit.allow(time.Now()) {
+		return errCircuitOpen
+	}
+	clientReq := s.clientReq
+	if clientReq == nil {
+		clientReq = &http.Request{Header: http.Header{}, URL: &url.URL{Path: "/"}}
+	}
+	err := sendTrackingPayload(s.client, s.hosts, clientReq, s.config, payload)
+	if s.circuit != nil {
+		s.circuit.record(time.Now(), isUmamiFailure(err))
+	}
+	var retryErr *retryAfterError
+	if errors.As(err, &retryErr) {
+		s.throttle.pause(retryErr.delay)
+		// the rejected payload is sent again after the pause too
+		if held, heldErr := s.throttle.hold(time.Now(), s, payload); held {
+			return heldErr
+		}
+	}
+	return err
+}
+
+// FileSink appends payloads as NDJSON lines to a file
+// the file is opened on the first payload and kept open until Close.
+type FileSink struct {
+	mu   sync.Mutex
+	Path string
+	file *os.File
+}
+
+func (s *FileSink) Send(payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		file, err := os.OpenFile(s.Path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return err
+		}
+		s.file = file
+	}
+	// one write per line, so lines of concurrent writers aren't interleaved
+	_, err := s.file.Write(append(payload, '\n'))
+	return err
+}
+
+// Close closes the file, the next payload opens it again.
+func (s *FileSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.file == nil {
+		return nil
+	}
+	err := s.file.Close()
+	s.file = nil
+	return err
+}
+
+// collects payloads and sends them sequentially to the inner sink once
+// size are pending or interval passed since the first one.
+type batchingSink struct {
+	mu       sync.Mutex
+	inner    TrackingSink
+	size     int
+	interval time.Duration
+	onError  func(error)
+	pending  []batchedPayload
+	timer    *time.Timer
+	closed   bool // payloads are sent at once, no timer outlives the middleware
+}
+
+type batchedPayload struct {
+	sink    TrackingSink // the inner sink, bound to the client request if it needs one
+	payload []byte
+}
+
+// collects the payloads of the client request for the inner sink bound to it.
+type boundBatchingSink struct {
+	batch *batchingSink
+	inner TrackingSink
+}
+
+func (s *boundBatchingSink) Send(payload []byte) error {
+	return s.batch.add(batchedPayload{sink: s.inner, payload: payload})
+}
+
+func (s *batchingSink) forRequest(clientReq *http.Request) TrackingSink {
+	return &boundBatchingSink{batch: s, inner: sinkForRequest(s.inner, clientReq)}
+}
+
+func (s *batchingSink) Send(payload []byte) error {
+	return s.add(batchedPayload{sink: s.inner, payload: payload})
+}
+
+func (s *batchingSink) add(batched batchedPayload) error {
+	s.mu.Lock()
+	s.pending = append(s.pending, batched)
+	full := len(s.pending) >= s.size || s.closed
+	if !full && s.timer == nil {
+		s.timer = time.AfterFunc(s.interval, s.flush)
+	}
+	s.mu.Unlock()
+	if full {
+		s.flush()
+	}
+	return nil
+}
+
+// sends all pending payloads, errors are reported to onError.
+func (s *batchingSink) flush() {
+	s.mu.Lock()
+	batch := s.pending
+	s.pending = nil
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.mu.Unlock()
+	for _, batched := range batch {
+		err := batched.sink.Send(batched.payload)
+		if err != nil {
+			s.onError(err)
+		}
+	}
+}
+
+// flushes the pending payloads once the middleware is done, later ones
+// are sent without batching.
+func (s *batchingSink) close() {
+	s.mu.Lock()
+	s.closed = true
+	s.mu.Unlock()
+	s.flush()
+}
+
+// SetTrackingSink replaces the sink selected by trackingSinkType.
+// Meant for Go code embedding the plugin, call it before serving requests.
+func (h *PluginHandler) SetTrackingSink(sink TrackingSink) {
+	h.sink = sink
+}
+
+// SetTrackingClient replaces the client server side tracking sends to umami
+// with, eg. one of an httptest.Server. Forwarding keeps its client.
+// Call it before serving requests.
+func (h *PluginHandler) SetTrackingClient(client *http.Client) {
+	sink := h.sink
+	if batching, ok := sink.(*batchingSink); ok {
+		sink = batching.inner
+	}
+	if umamiSink, ok := sink.(*httpSink); ok {
+		umamiSink.client = client
+	}
+}
+
+// builds the sink selected by trackingSinkType.
+// onError gets the errors of payloads held during a Retry-After pause.
+func newTrackingSink(config *Config, client *http.Client, hosts *umamiHostPool, circuit *circuitBreaker, onError func(error)) TrackingSink {
+	if config.TrackingSinkType == TSTypeFile {
+		return &FileSink{Path: config.TrackingSinkPath}
+	}
+	return &httpSink{
+		config:   config,
+		client:   client,
+		hosts:    hosts,
+		throttle: &trackingThrottle{onError: onError},
+		circuit:  circuit,
+	}
+}
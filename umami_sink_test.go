@@ -0,0 +1,370 @@
+package traefik_umami_plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the lines of the file, failing the test for lines that aren't JSON.
+func readNDJSON(t *testing.T, path string) []map[string]interface{} {
+	t.Helper()
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	lines := []map[string]interface{}{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Fatalf("line %q is not JSON: %v", scanner.Text(), err)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return lines
+}
+
+func TestFileSink(t *testing.T) {
+	tests := []struct {
+		name       string
+		senders    int
+		perSender  int
+		closeAfter bool
+	}{
+		{"single payload", 1, 1, false},
+		{"sequential payloads", 1, 10, false},
+		{"concurrent payloads", 8, 25, false},
+		{"reopened after close", 1, 3, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "events.ndjson")
+			sink := &FileSink{Path: path}
+			defer sink.Close()
+
+			var wg sync.WaitGroup
+			for i := 0; i < test.senders; i++ {
+				wg.Add(1)
+				go func(sender int) {
+					defer wg.Done()
+					for j := 0; j < test.perSender; j++ {
+						if err := sink.Send([]byte(fmt.Sprintf(`{"sender":%d,"n":%d}`, sender, j))); err != nil {
+							t.Error(err)
+						}
+						if test.closeAfter {
+							sink.Close()
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+
+			lines := readNDJSON(t, path)
+			if len(lines) != test.senders*test.perSender {
+				t.Errorf("got %d lines, want %d", len(lines), test.senders*test.perSender)
+			}
+		})
+	}
+}
+
+func TestFileSinkErrors(t *testing.T) {
+	sink := &FileSink{Path: filepath.Join(t.TempDir(), "missing", "events.ndjson")}
+	if err := sink.Send([]byte(`{}`)); err == nil {
+		t.Error("Send to a missing directory succeeded")
+	}
+	if err := sink.Close(); err != nil {
+		t.Errorf("Close of an unopened sink: %v", err)
+	}
+}
+
+func TestTrackingSinkType(t *testing.T) {
+	tests := []struct {
+		name      string
+		sinkType  string
+		path      string
+		wantIssue string
+		wantLines int
+	}{
+		{"file", TSTypeFile, "events.ndjson", "", 2},
+		{"file without path", TSTypeFile, "", "trackingSinkPath", 0},
+		{"unknown", "queue", "", "trackingSinkType", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := t.TempDir()
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			config.TrackingSinkType = test.sinkType
+			if test.path != "" {
+				config.TrackingSinkPath = filepath.Join(dir, test.path)
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			defer h.sink.(*FileSink).Close()
+
+			serve(h, htmlRequest(http.MethodGet, "/first"))
+			serve(h, htmlRequest(http.MethodGet, "/second"))
+			lines := readNDJSON(t, config.TrackingSinkPath)
+			if len(lines) != test.wantLines {
+				t.Fatalf("got %d lines, want %d", len(lines), test.wantLines)
+			}
+			payload, _ := lines[1]["payload"].(map[string]interface{})
+			if lines[1]["type"] != "event" || payload["url"] != "/second" {
+				t.Errorf("line = %v, want the event of /second", lines[1])
+			}
+		})
+	}
+}
+
+func TestBatchingSink(t *testing.T) {
+	interval := 20 * time.Millisecond
+	tests := []struct {
+		name       string
+		sends      int
+		innerErr   error
+		wantBySize int // sent once the last Send returned
+		wantErrors int
+	}{
+		{"flushed by size", 3, nil, 3, 0},
+		{"flushed by interval", 2, nil, 0, 0},
+		{"by size then interval", 7, nil, 6, 0},
+		{"errors reported", 3, errors.New("umami is down"), 3, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			inner := &recordingSink{err: test.innerErr}
+			var mu sync.Mutex
+			errs := 0
+			sink := &batchingSink{inner: inner, size: 3, interval: interval, onError: func(err error) {
+				mu.Lock()
+				errs++
+				mu.Unlock()
+			}}
+			for i := 0; i < test.sends; i++ {
+				if err := sink.Send([]byte(fmt.Sprintf(`{"n":%d}`, i))); err != nil {
+					t.Fatalf("Send: %v", err)
+				}
+			}
+			if sent := len(inner.payloads()); sent != test.wantBySize {
+				t.Errorf("sent %d by size, want %d", sent, test.wantBySize)
+			}
+
+			deadline := time.Now().Add(time.Second)
+			for len(inner.payloads()) < test.sends && time.Now().Before(deadline) {
+				time.Sleep(interval / 4)
+			}
+			payloads := inner.payloads()
+			if len(payloads) != test.sends {
+				t.Fatalf("sent %d after the interval, want %d", len(payloads), test.sends)
+			}
+			for i, payload := range payloads {
+				if want := fmt.Sprintf(`{"n":%d}`, i); string(payload) != want {
+					t.Errorf("payload %d = %s, want %s", i, payload, want)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if errs != test.wantErrors {
+				t.Errorf("reported %d errors, want %d", errs, test.wantErrors)
+			}
+		})
+	}
+}
+
+func TestTrackingBatchConfig(t *testing.T) {
+	tests := []struct {
+		name         string
+		size         int
+		interval     string
+		wantIssue    string
+		wantBatching bool
+	}{
+		{"batched", 10, "1s", "", true},
+		{"single events", 1, "1s", "", false},
+		{"zero interval", 10, "0s", "trackingBatchInterval", false},
+		{"invalid interval", 10, "often", "trackingBatchInterval", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			config.TrackingBatchSize = test.size
+			config.TrackingBatchInterval = test.interval
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Errorf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if _, batching := h.sink.(*batchingSink); batching != test.wantBatching {
+				t.Errorf("batching = %v, want %v", batching, test.wantBatching)
+			}
+		})
+	}
+}
+
+func TestSetTrackingClient(t *testing.T) {
+	tests := []struct {
+		name      string
+		batchSize int
+	}{
+		{"plain", 0},
+		{"batched", 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			received := make(chan *http.Request, 10)
+			bodies := make(chan string, 10)
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				received <- req
+				bodies <- string(body)
+			}))
+			defer umami.Close()
+			// umami.test only resolves through the client
+			client := &http.Client{Transport: &http.Transport{
+				DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, umami.Listener.Addr().String())
+				},
+			}}
+
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			config.TrackingBatchSize = test.batchSize
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			h.SetTrackingClient(client)
+
+			req := htmlRequest(http.MethodGet, "/page")
+			req.Host = "example.com"
+			req.Header.Set("User-Agent", "Mozilla/5.0 (test)")
+			req.RemoteAddr = "198.51.100.7:4000"
+			serve(h, req)
+			if test.batchSize > 1 {
+				serve(h, req)
+			}
+
+			select {
+			case got := <-received:
+				if got.Method != http.MethodPost || got.URL.Path != "/api/send" || got.Host != "umami.test" {
+					t.Errorf("request = %s %s%s, want POST umami.test/api/send", got.Method, got.Host, got.URL.Path)
+				}
+				wantHeaders := map[string]string{
+					"Content-Type":    "application/json",
+					"User-Agent":      "Mozilla/5.0 (test)",
+					"X-Forwarded-For": "198.51.100.7",
+				}
+				for name, want := range wantHeaders {
+					if value := got.Header.Get(name); value != want {
+						t.Errorf("%s = %q, want %q", name, value, want)
+					}
+				}
+			case <-time.After(time.Second):
+				t.Fatal("umami got no tracking request")
+			}
+			want := `{"payload":{"website":"website","hostname":"example.com","language":"","url":"/page","referer":"","name":"traefik","data":{}},"type":"event"}`
+			if body := <-bodies; body != want {
+				t.Errorf("body = %s\nwant %s", body, want)
+			}
+		})
+	}
+}
+
+func TestTrackingBatchFlushedOnDone(t *testing.T) {
+	tests := []struct {
+		name     string
+		sinkType string
+	}{
+		{"file", TSTypeFile},
+		{"umami", TSTypeHttp},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var mu sync.Mutex
+			hits := 0
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				hits++
+				mu.Unlock()
+			}))
+			t.Cleanup(umami.Close)
+			path := filepath.Join(t.TempDir(), "events.ndjson")
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.TrackingSinkType = test.sinkType
+			config.TrackingSinkPath = path
+			config.TrackingBatchSize = 10
+			config.TrackingBatchInterval = "1h"
+			// batched once ServeHTTP returned
+			config.SyncTracking = true
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			handler, err := New(ctx, htmlHandler("text/html", testPage), config, "test")
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := handler.(*PluginHandler)
+			h.LogHandler = nil
+			for i := 0; i < 3; i++ {
+				serve(h, htmlRequest(http.MethodGet, "/"))
+			}
+
+			// the config reload of traefik
+			cancel()
+			batching := h.sink.(*batchingSink)
+			sent := func() int {
+				if test.sinkType == TSTypeFile {
+					if _, err := os.Stat(path); err != nil {
+						return 0
+					}
+					return len(readNDJSON(t, path))
+				}
+				mu.Lock()
+				defer mu.Unlock()
+				return hits
+			}
+			deadline := time.Now().Add(5 * time.Second)
+			for sent() < 3 && time.Now().Before(deadline) {
+				time.Sleep(10 * time.Millisecond)
+			}
+			if got := sent(); got != 3 {
+				t.Fatalf("sent %d of the pending events, want 3", got)
+			}
+			if fileSink, ok := batching.inner.(*FileSink); ok {
+				for deadline := time.Now().Add(time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					fileSink.mu.Lock()
+					closed := fileSink.file == nil
+					fileSink.mu.Unlock()
+					if closed {
+						return
+					}
+				}
+				t.Error("the file is still open")
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package traefik_umami_plugin
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// injection counts are kept for a rolling window of statsBuckets minutes.
+const statsBuckets = 15
+
+// counts of html responses and how many of them were injected.
+type injectionStats struct {
+	mu      sync.Mutex
+	buckets [statsBuckets]statsBucket
+}
+
+type statsBucket struct {
+	minute   int64
+	html     int
+	injected int
+}
+
+// counts an html response intercepted for injection.
+func (s *injectionStats) record(now time.Time, injected bool) {
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	bucket := &s.buckets[minute%statsBuckets]
+	if bucket.minute != minute {
+		*bucket = statsBucket{minute: minute}
+	}
+	bucket.html++
+	if injected {
+		bucket.injected++
+	}
+}
+
+// the counts of the rolling window.
+func (s *injectionStats) totals(now time.Time) (int, int) {
+	minute := now.Unix() / 60
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	html, injected := 0, 0
+	for _, bucket := range s.buckets {
+		if minute-bucket.minute < statsBuckets {
+			html += bucket.html
+			injected += bucket.injected
+		}
+	}
+	return html, injected
+}
+
+// totals since the start, summarized every statsInterval
+// atomic, 64-bit aligned as the first fields of the handler.
+type statsCounters struct {
+	requests uint64
+	html     uint64
+	injected uint64
+	tracked  uint64 // handed to the sink, a batching sink may drop them later
+}
+
+func (c *statsCounters) recordHtml(injected bool) {
+	atomic.AddUint64(&c.html, 1)
+	if injected {
+		atomic.AddUint64(&c.injected, 1)
+	}
+}
+
+// logs the counts of every interval, until the context of the
+// middleware is done.
+func (h *PluginHandler) logStatsPeriodically(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	var last [5]uint64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		current := [5]uint64{
+			atomic.LoadUint64(&h.counters.requests),
+			atomic.LoadUint64(&h.counters.html),
+			atomic.LoadUint64(&h.counters.injected),
+			atomic.LoadUint64(&h.counters.tracked),
+			atomic.LoadUint64(&h.droppedEvents),
+		}
+		h.log(fmt.Sprintf("stats: %d requests, %d of %d html responses injected, %d events tracked, %d dropped in the last %s",
+			current[0]-last[0], current[2]-last[2], current[1]-last[1], current[3]-last[3], current[4]-last[4], interval))
+		last = current
+	}
+}
@@ -0,0 +1,113 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"context"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// a buffer the logger writes to while the test reads it.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// run with -race
+func TestLogStatsPeriodically(t *testing.T) {
+	config := testConfig()
+	config.ServerSideTracking = true
+	pages := []string{testPage, "<head></head><div>", testPage}
+	page := 0
+	h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		rw.Header().Set("Content-Type", "text/html")
+		if page < len(pages) {
+			_, _ = rw.Write([]byte(pages[page]))
+		}
+		page++
+	}))
+	sink := recordTracking(h)
+	sink.err = errTrackingPaused
+	logs := &syncBuffer{}
+	h.LogHandler = log.New(logs, "", 0)
+	for range pages {
+		serve(h, htmlRequest(http.MethodGet, "/"))
+	}
+	// not html
+	serve(h, htmlRequest(http.MethodPost, "/form"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.logStatsPeriodically(ctx, 10*time.Millisecond)
+	}()
+	want := []string{
+		"stats: 4 requests, 2 of 3 html responses injected, 0 events tracked, 3 dropped in the last 10ms",
+		// the counts of the interval, not the totals
+		"stats: 0 requests, 0 of 0 html responses injected, 0 events tracked, 0 dropped in the last 10ms",
+	}
+	deadline := time.Now().Add(time.Second)
+	for strings.Count(logs.String(), "stats: ") < len(want) && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("stats logging did not stop with the context")
+	}
+
+	lines := []string{}
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, "stats: ") {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) < len(want) {
+		t.Fatalf("logged %d summaries, want %d: %s", len(lines), len(want), logs.String())
+	}
+	for i, want := range want {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("summary %d = %q, want %q", i, lines[i], want)
+		}
+	}
+}
+
+func TestStatsIntervalConfig(t *testing.T) {
+	tests := []struct {
+		interval  string
+		wantIssue string
+	}{
+		{"", ""},
+		{"1m", ""},
+		{"0s", "statsInterval"},
+		{"-1s", "statsInterval"},
+		{"hourly", "statsInterval"},
+	}
+	for _, test := range tests {
+		t.Run(test.interval, func(t *testing.T) {
+			config := testConfig()
+			config.StatsInterval = test.interval
+			if field := configIssueField(newTestPlugin(t, config, http.NotFoundHandler())); field != test.wantIssue {
+				t.Errorf("config issue = %q, want %q", field, test.wantIssue)
+			}
+		})
+	}
+}
@@ -4,37 +4,445 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// upper bound for a Retry-After requested by umami.
+const maxRetryAfter = 5 * time.Minute
+
+// returned when umami asks to back off via Retry-After.
+type retryAfterError struct {
+	status int
+	delay  time.Duration
+}
+
+func (e *retryAfterError) Error() string {
+	return fmt.Sprintf("tracking request failed with status %d, retry after %s", e.status, e.delay)
+}
+
+// returned when umami answers a tracking request without a 2xx status.
+type trackingStatusError struct {
+	status int
+}
+
+func (e *trackingStatusError) Error() string {
+	return fmt.Sprintf("tracking request failed with status %d", e.status)
+}
+
+// returned instead of contacting umami while it asked to back off.
+var errTrackingPaused = errors.New("umami asked to retry later")
+
+// upper bound for the events held during a pause, later ones are dropped.
+const maxHeldEvents = 1000
+
+// global backoff of all tracking requests of a handler
+// events during the pause are held and sent once it ends, so no goroutine
+// waits for it.
+type trackingThrottle struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+	held        []heldPayload
+	timer       *time.Timer
+	onError     func(error) // errors of held events sent after the pause
+}
+
+type heldPayload struct {
+	sink    TrackingSink
+	payload []byte
+}
+
+// check if tracking is paused at now.
+func (t *trackingThrottle) paused(now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return now.Before(t.pausedUntil)
+}
+
+// pauses tracking for the delay, capped at maxRetryAfter
+// a pause is only ever extended, never shortened.
+func (t *trackingThrottle) pause(delay time.Duration) {
+	if delay > maxRetryAfter {
+		delay = maxRetryAfter
+	}
+	until := time.Now().Add(delay)
+	t.mu.Lock()
+	if until.After(t.pausedUntil) {
+		t.pausedUntil = until
+	}
+	t.mu.Unlock()
+}
+
+// holds the payload for the sink until the pause at now ends
+// returns false if tracking isn't paused, errTrackingPaused if too many are held.
+func (t *trackingThrottle) hold(now time.Time, sink TrackingSink, payload []byte) (bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !now.Before(t.pausedUntil) {
+		return false, nil
+	}
+	if len(t.held) >= maxHeldEvents {
+		return true, errTrackingPaused
+	}
+	t.held = append(t.held, heldPayload{sink: sink, payload: payload})
+	if t.timer == nil {
+		t.timer = time.AfterFunc(t.pausedUntil.Sub(now), t.release)
+	}
+	return true, nil
+}
+
+// sends the held payloads once the pause ended, it may have been extended.
+func (t *trackingThrottle) release() {
+	t.mu.Lock()
+	if remaining := time.Until(t.pausedUntil); remaining > 0 {
+		t.timer = time.AfterFunc(remaining, t.release)
+		t.mu.Unlock()
+		return
+	}
+	held := t.held
+	t.held = nil
+	t.timer = nil
+	t.mu.Unlock()
+	for _, event := range held {
+		// held again if umami asks to back off once more
+		err := event.sink.Send(event.payload)
+		if err != nil && t.onError != nil {
+			t.onError(err)
+		}
+	}
+}
+
+// parses a Retry-After header value in seconds or as HTTP date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	date, err := http.ParseTime(value)
+	if err != nil {
+		return 0, false
+	}
+	return date.Sub(now), true
+}
+
 type SendPayload struct {
 	Website  string                 `json:"website"`
 	Hostname string                 `json:"hostname"`
 	Language string                 `json:"language"`
 	Url      string                 `json:"url"`
 	Referer  string                 `json:"referer"`
+	Screen   string                 `json:"screen,omitempty"`
+	Tag      string                 `json:"tag,omitempty"`
+	Title    string                 `json:"title,omitempty"`
 	Name     string                 `json:"name"`
 	Data     map[string]interface{} `json:"data"`
 }
 
+// what server side tracking knows about the response to a request.
+type trackedResponse struct {
+	status    int
+	header    http.Header            // nil unless trackUrlHeader is set
+	title     string                 // empty unless extractTitle found one
+	event     string                 // set by the eventHeader of the response
+	eventData map[string]interface{} // set by the eventHeader-Data of the response
+	locale    string                 // empty unless localeFromHeader or localeFromPath found one
+}
+
+// a compiled pathEventRules template.
+type pathEventRule struct {
+	path  *regexp.Regexp
+	event string
+}
+
+const pathParamRegexPattern = `^\{([A-Za-z_][A-Za-z0-9_]*)\}$`
+
+var pathParamRegex = regexp.MustCompile(pathParamRegexPattern)
+
+// compiles a path template, {name} segments match one whole segment
+// a trailing slash of the path is ignored.
+func compilePathEventRule(rule PathEventRule) (pathEventRule, error) {
+	if rule.Event == "" {
+		return pathEventRule{}, fmt.Errorf("has no event")
+	}
+	if !strings.HasPrefix(rule.Pattern, "/") {
+		return pathEventRule{}, fmt.Errorf("does not start with /")
+	}
+	segments := strings.Split(strings.TrimSuffix(rule.Pattern[1:], "/"), "/")
+	pattern := "^"
+	for _, segment := range segments {
+		if param := pathParamRegex.FindStringSubmatch(segment); param != nil {
+			pattern += fmt.Sprintf("/(?P<%s>[^/]+)", param[1])
+		} else if strings.ContainsAny(segment, "{}") {
+			return pathEventRule{}, fmt.Errorf("segment %s is not a valid param", segment)
+		} else {
+			pattern += "/" + regexp.QuoteMeta(segment)
+		}
+	}
+	path, err := regexp.Compile(pattern + "/?$")
+	if err != nil {
+		return pathEventRule{}, err
+	}
+	return pathEventRule{path: path, event: rule.Event}, nil
+}
+
+// the event and params of the first pathEventRules template matching the request path.
+func (h *PluginHandler) matchPathEvent(req *http.Request) (string, map[string]interface{}) {
+	for _, rule := range h.pathEvents {
+		match := rule.path.FindStringSubmatch(req.URL.Path)
+		if match == nil {
+			continue
+		}
+		data := map[string]interface{}{}
+		for i, name := range rule.path.SubexpNames() {
+			if name != "" {
+				data[name] = match[i]
+			}
+		}
+		return rule.event, data
+	}
+	return "", nil
+}
+
+// an event set by the upstream in the eventHeader response headers.
+type responseEvent struct {
+	name string
+	data string // raw JSON
+}
+
+// takes the event out of the response headers, so they aren't sent downstream.
+func takeResponseEvent(header http.Header, name string) responseEvent {
+	if name == "" {
+		return responseEvent{}
+	}
+	event := responseEvent{
+		name: strings.TrimSpace(header.Get(name)),
+		data: strings.TrimSpace(header.Get(name + "-Data")),
+	}
+	removeHeadersFold(header, name, name+"-Data")
+	return event
+}
+
 type SendBody struct {
 	Payload SendPayload `json:"payload"`
 	Type    string      `json:"type"`
 }
 
-func buildSendPayload(req *http.Request, websiteId string) SendPayload {
+// name of the tracked event, as mapped by statusEventMap
+// error responses are named by status (eg. error-404) if enabled.
+func trackingEventName(config *Config, res trackedResponse) string {
+	if res.event != "" {
+		return res.event
+	}
+	status := res.status
+	if name, ok := config.StatusEventMap[status]; ok && name != "" {
+		return name
+	}
+	if config.TrackErrorsAsEvents && status >= 400 && status < 600 {
+		return fmt.Sprintf("error-%d", status)
+	}
+	return "traefik"
+}
+
+func buildSendPayload(req *http.Request, config *Config, res trackedResponse) SendPayload {
+	data := map[string]interface{}{}
+	for key, value := range res.eventData {
+		data[key] = value
+	}
+	if config.EnvironmentTag != "" {
+		data["environment"] = config.EnvironmentTag
+	}
+	if res.locale != "" {
+		data["locale"] = res.locale
+	}
+	if config.CaptureUTM {
+		for key, values := range utmParams(req) {
+			data[key] = values[0]
+		}
+	}
 	return SendPayload{
-		Website:  websiteId,
+		Website:  websiteIdFor(req, config),
 		Hostname: parseDomainFromHost(req.Host),
 		Language: parseAcceptLanguage(req.Header.Get("Accept-Language")),
-		Url:      req.URL.String(),
-		Referer:  req.Referer(),
-		Name:     "traefik",
-		Data:     map[string]interface{}{},
+		Url:      stripQueryParams(trackingUrl(req, config, res.header), config.StripQueryParams),
+		Referer:  trackingReferrer(req, config),
+		Screen:   parseScreenHint(req, config.ScreenFromHeader),
+		Tag:      config.EnvironmentTag,
+		Title:    res.title,
+		Name:     trackingEventName(config, res),
+		Data:     data,
+	}
+}
+
+// the url tracked for the request, the path set by the web service in the
+// trackUrlHeader response header if it is a valid path.
+func trackingUrl(req *http.Request, config *Config, resHeader http.Header) string {
+	if config.TrackUrlHeader != "" && resHeader != nil {
+		if trackUrl := resHeader.Get(config.TrackUrlHeader); isTrackablePath(trackUrl) {
+			if config.CaptureUTM {
+				return withUTMParams(trackUrl, utmParams(req))
+			}
+			return trackUrl
+		}
+	}
+	return req.URL.String()
+}
+
+// the utm_* campaign params of the request url.
+func utmParams(req *http.Request) url.Values {
+	utm := url.Values{}
+	for key, values := range req.URL.Query() {
+		if strings.HasPrefix(key, "utm_") && len(values) > 0 {
+			utm[key] = values
+		}
+	}
+	return utm
+}
+
+// adds the utm params missing in the query of the path.
+func withUTMParams(path string, utm url.Values) string {
+	if len(utm) == 0 {
+		return path
+	}
+	parsed, err := url.Parse(path)
+	if err != nil {
+		return path
+	}
+	query := parsed.Query()
+	for key, values := range utm {
+		if !query.Has(key) {
+			query[key] = values
+		}
+	}
+	parsed.RawQuery = query.Encode()
+	return parsed.String()
+}
+
+// removes the query params with the names, matched ignoring case
+// the order of the remaining params is kept.
+func stripQueryParams(path string, names []string) string {
+	parsed, err := url.Parse(path)
+	if err != nil || parsed.RawQuery == "" || len(names) == 0 {
+		return path
+	}
+	kept := []string{}
+	for _, pair := range strings.Split(parsed.RawQuery, "&") {
+		key := pair
+		if i := strings.Index(pair, "="); i >= 0 {
+			key = pair[:i]
+		}
+		if unescaped, err := url.QueryUnescape(key); err == nil {
+			key = unescaped
+		}
+		if !nameInList(key, names) {
+			kept = append(kept, pair)
+		}
 	}
+	parsed.RawQuery = strings.Join(kept, "&")
+	return parsed.String()
+}
+
+// check if the name is in the list, ignoring case.
+func nameInList(name string, list []string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if the value is an absolute path (and query) without a host.
+func isTrackablePath(value string) bool {
+	if !strings.HasPrefix(value, "/") || strings.HasPrefix(value, "//") {
+		return false
+	}
+	parsed, err := url.ParseRequestURI(value)
+	return err == nil && parsed.Host == ""
+}
+
+// the website id of the envWebsiteMap entry selected by the env header
+// falls back to websiteId for unknown or missing envs.
+func websiteIdFor(req *http.Request, config *Config) string {
+	if config.EnvHeader != "" {
+		if websiteId, ok := config.EnvWebsiteMap[req.Header.Get(config.EnvHeader)]; ok {
+			return websiteId
+		}
+	}
+	return config.WebsiteId
+}
+
+// passes the website id as websiteIdOutHeader, eg. for proxies in front of
+// umami routing by website.
+func writeWebsiteIdHeader(dst http.Header, req *http.Request, config *Config) {
+	if config.WebsiteIdOutHeader != "" {
+		dst.Set(config.WebsiteIdOutHeader, websiteIdFor(req, config))
+	}
+}
+
+// the referrer sent to umami, blank for internal referrers if
+// dropInternalReferrer is set.
+func trackingReferrer(req *http.Request, config *Config) string {
+	referrer := req.Referer()
+	if config.DropInternalReferrer && isInternalReferrer(req, referrer, config.Domains) {
+		return ""
+	}
+	if config.NormalizeReferrer {
+		return normalizeReferrer(referrer)
+	}
+	return referrer
+}
+
+// lowercases the scheme and host, strips www. and trailing slashes
+// so one site is counted as one referrer.
+func normalizeReferrer(referrer string) string {
+	refUrl, err := url.Parse(referrer)
+	if err != nil || refUrl.Host == "" {
+		return referrer
+	}
+	refUrl.Scheme = strings.ToLower(refUrl.Scheme)
+	refUrl.Host = strings.TrimPrefix(strings.ToLower(refUrl.Host), "www.")
+	rawPath := strings.TrimRight(refUrl.EscapedPath(), "/")
+	path, err := url.PathUnescape(rawPath)
+	if err != nil {
+		return referrer
+	}
+	refUrl.Path, refUrl.RawPath = path, rawPath
+	return refUrl.String()
+}
+
+// check if the referrer's host is the requested host or one of the domains.
+func isInternalReferrer(req *http.Request, referrer string, domains []string) bool {
+	if referrer == "" {
+		return false
+	}
+	refUrl, err := url.Parse(referrer)
+	if err != nil || refUrl.Host == "" {
+		return false
+	}
+	refHost := strings.ToLower(refUrl.Hostname())
+	if refHost == strings.ToLower(parseDomainFromHost(req.Host)) {
+		return true
+	}
+	for _, domain := range domains {
+		if strings.EqualFold(domain, refHost) {
+			return true
+		}
+	}
+	return false
 }
 
 const parseAcceptLanguagePattern = `([a-zA-Z\-]+)(?:;q=\d\.\d)?(?:,\s)?`
@@ -49,48 +457,172 @@ func parseAcceptLanguage(acceptLanguage string) string {
 	return matches[0][1]
 }
 
-func buildTrackingRequest(clientReq *http.Request, config *Config) (*http.Request, error) {
-	// build body
+const localeTagPattern = `^[A-Za-z]{2,3}(?:-[A-Za-z0-9]{1,8})*$`
+
+var localeTagRegexp = regexp.MustCompile(localeTagPattern)
+
+// stricter for path segments, so eg. /api/ isn't taken for a locale
+// a language, optionally with a script or region, eg. /de/, /en-US/ or /zh_Hant/.
+const localePathPattern = `^[A-Za-z]{2}(?:[-_](?:[A-Za-z]{2}|[0-9]{3}|[A-Za-z]{4}))?$`
+
+var localePathRegexp = regexp.MustCompile(localePathPattern)
+
+// the locale of the response, the first Content-Language with localeFromHeader
+// the first path segment with localeFromPath, in that order.
+func responseLocale(req *http.Request, header http.Header, config *Config) string {
+	if config.LocaleFromHeader {
+		locale := strings.TrimSpace(strings.Split(header.Get("Content-Language"), ",")[0])
+		if localeTagRegexp.MatchString(locale) {
+			return locale
+		}
+	}
+	if config.LocaleFromPath {
+		segment := strings.SplitN(strings.TrimPrefix(req.URL.Path, "/"), "/", 2)[0]
+		if localePathRegexp.MatchString(segment) {
+			return segment
+		}
+	}
+	return ""
+}
+
+const parseScreenHintPattern = `^\d+(?:x\d+)?$`
+
+var parseScreenHintRegexp = regexp.MustCompile(parseScreenHintPattern)
+
+// reads the screen size from a client hint header (eg. Sec-CH-Viewport-Width)
+// either a width or WIDTHxHEIGHT, anything else is ignored.
+func parseScreenHint(req *http.Request, header string) string {
+	if header == "" {
+		return ""
+	}
+	hint := strings.TrimSpace(req.Header.Get(header))
+	if !parseScreenHintRegexp.MatchString(hint) {
+		return ""
+	}
+	return hint
+}
+
+// builds the json body for umami's /api/send.
+func buildTrackingPayload(req *http.Request, config *Config, res trackedResponse) ([]byte, error) {
 	sendBody := SendBody{
-		Payload: buildSendPayload(clientReq, config.WebsiteId),
+		Payload: buildSendPayload(req, config, res),
 		Type:    "event",
 	}
-	bodyJson, err := json.Marshal(sendBody)
-	if err != nil {
-		return nil, err
-	}
-	bodyReader := bytes.NewReader(bodyJson)
+	return json.Marshal(sendBody)
+}
 
+func buildTrackingRequest(host string, clientReq *http.Request, config *Config, payload []byte) (*http.Request, error) {
 	// build url
-	url := fmt.Sprintf("%s/api/send", config.UmamiHost)
+	url := fmt.Sprintf("%s/api/send", host)
 
 	// build request
-	req, err := http.NewRequestWithContext(context.Background(), http.MethodPost, url, bodyReader)
+	var req *http.Request
+	var err error
+	if config.TrackingMethod == http.MethodGet {
+		query, queryErr := encodeTrackingQuery(payload)
+		if queryErr != nil {
+			return nil, queryErr
+		}
+		req, err = http.NewRequestWithContext(context.Background(), http.MethodGet, url+"?"+query, nil)
+	} else {
+		req, err = http.NewRequestWithContext(context.Background(), http.MethodPost, url, bytes.NewReader(payload))
+	}
 	if err != nil {
 		return nil, err
 	}
 
 	// set headers
-	req.Header.Set("Content-Type", "application/json")
-	copyHeaders(req.Header, clientReq.Header)
+	copyTrackingHeaders(req.Header, clientReq.Header, config)
 	removeHeaders(req.Header, hopHeaders...)
+	// expectations of the client are not ours
+	removeHeaders(req.Header, "Expect")
+	// replaces the content type of the client request
+	if req.Method == http.MethodPost {
+		req.Header.Set("Content-Type", config.CollectContentType)
+	}
 	writeXForwardedHeaders(req.Header, clientReq)
+	writeClientIPHeaders(req.Header, clientReq, config)
+	writeWebsiteIdHeader(req.Header, clientReq, config)
+	req.Header.Set(umamiForwardedHeader, "1")
 
 	return req, nil
 }
 
-// send the tracking request to umami's /api/send.
-func sendTrackingRequest(trackingReq *http.Request) error {
+// copies the client headers onto the tracking request, all of them unless
+// forwardTrackingHeaders limits them to the user agent, language, client ip
+// and the listed ones, the trackingHeaderDenylist is never copied.
+func copyTrackingHeaders(dst, src http.Header, config *Config) {
+	headers := src
+	if len(config.ForwardTrackingHeaders) > 0 {
+		headers = http.Header{}
+		// client ip headers of untrusted peers are removed afterwards
+		names := append([]string{"User-Agent", "Accept-Language"}, clientIPHeaders...)
+		for _, name := range append(names, config.ForwardTrackingHeaders...) {
+			if values := src.Values(name); len(values) > 0 {
+				headers[http.CanonicalHeaderKey(name)] = values
+			}
+		}
+	}
+	copyHeaders(dst, headers)
+	removeHeadersFold(dst, config.TrackingHeaderDenylist...)
+}
+
+// encodes the json body for /api/send as query params for GET beacons
+// named like the json fields, data is passed as json.
+func encodeTrackingQuery(payload []byte) (string, error) {
+	var sendBody SendBody
+	err := json.Unmarshal(payload, &sendBody)
+	if err != nil {
+		return "", err
+	}
+	p := sendBody.Payload
+	query := url.Values{}
+	query.Set("type", sendBody.Type)
+	query.Set("website", p.Website)
+	query.Set("hostname", p.Hostname)
+	query.Set("language", p.Language)
+	query.Set("url", p.Url)
+	query.Set("referer", p.Referer)
+	if p.Screen != "" {
+		query.Set("screen", p.Screen)
+	}
+	if p.Tag != "" {
+		query.Set("tag", p.Tag)
+	}
+	if p.Title != "" {
+		query.Set("title", p.Title)
+	}
+	query.Set("name", p.Name)
+	if len(p.Data) > 0 {
+		data, err := json.Marshal(p.Data)
+		if err != nil {
+			return "", err
+		}
+		query.Set("data", string(data))
+	}
+	return query.Encode(), nil
+}
+
+// send the payload to umami's /api/send
+// on behalf of the client request.
+func sendTrackingPayload(client *http.Client, hosts *umamiHostPool, clientReq *http.Request, config *Config, payload []byte) error {
 	// make request
-	client := &http.Client{}
-	trackingRes, err := client.Do(trackingReq)
+	trackingRes, err := hosts.do(client, func(host string) (*http.Request, error) {
+		return buildTrackingRequest(host, clientReq, config, payload)
+	})
 	if err != nil {
 		return err
 	}
+	defer trackingRes.Body.Close()
 
 	status := trackingRes.StatusCode
+	if status == http.StatusTooManyRequests || status == http.StatusServiceUnavailable {
+		if delay, ok := parseRetryAfter(trackingRes.Header.Get("Retry-After"), time.Now()); ok {
+			return &retryAfterError{status: status, delay: delay}
+		}
+	}
 	if status < 200 || status >= 300 {
-		return fmt.Errorf("tracking request failed with status %d", status)
+		return &trackingStatusError{status: status}
 	}
 
 	return nil
@@ -120,10 +652,42 @@ func hostnameInDomains(req *http.Request, domains []string) bool {
 	return false
 }
 
-// check if server side tracking should be done.
+// check if the request method is in the list of methods
+// if the list is empty, return true.
+func methodInList(req *http.Request, methods []string) bool {
+	if len(methods) == 0 {
+		return true
+	}
+	for _, method := range methods {
+		if strings.EqualFold(method, req.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// check if server side tracking should be done
+// cors preflights are never tracked, other OPTIONS only if listed
+// explicitly in trackMethods.
 func shouldServerSideTrack(req *http.Request, config *Config, injected bool, h *PluginHandler) bool {
-	if config.ServerSideTracking && hostnameInDomains(req, config.Domains) {
-		if config.ServerSideTrackingMode == SSTModeNotinjected {
+	if req.Method == http.MethodOptions && (isCorsPreflight(req) || len(config.TrackMethods) == 0) {
+		return false
+	}
+	mode, byPath := sstModeByPathFor(req, config)
+	// with injection, the requests of the page besides the document aren't
+	// tracked either, the script tracks the page itself
+	// unless an sstModeByPath prefix tracks all of them, eg. of an api
+	if config.ScriptInjection && methodInList(req, config.InjectMethods) && !acceptsHtmlDocument(req) && !(byPath && mode == SSTModeAll) {
+		return false
+	}
+	if config.TrackNavigationsOnly && !isDocumentNavigation(req) {
+		return false
+	}
+	if config.SkipUserAgentsTracking && h.isSkippedUserAgent(req) {
+		return false
+	}
+	if config.ServerSideTracking && hostnameInDomains(req, config.Domains) && methodInList(req, config.TrackMethods) {
+		if mode == SSTModeNotinjected {
 			return !injected
 		}
 		return true
@@ -131,18 +695,106 @@ func shouldServerSideTrack(req *http.Request, config *Config, injected bool, h *
 	return false
 }
 
-func buildAndSendTrackingRequest(req *http.Request, config *Config) error {
-	// build tracking request
-	trackingReq, err := buildTrackingRequest(req, config)
+// check if the browser navigates to a document, rather than fetching or
+// prefetching it. Clients without fetch metadata count as navigations.
+func isDocumentNavigation(req *http.Request) bool {
+	for _, name := range []string{"Sec-Purpose", "Purpose"} {
+		if strings.Contains(strings.ToLower(req.Header.Get(name)), "prefetch") {
+			return false
+		}
+	}
+	mode := req.Header.Get("Sec-Fetch-Mode")
+	if mode != "" && !strings.EqualFold(mode, "navigate") {
+		return false
+	}
+	dest := req.Header.Get("Sec-Fetch-Dest")
+	return dest == "" || strings.EqualFold(dest, "document")
+}
+
+// the mode of the longest sstModeByPath prefix of the request path
+// falls back to serverSideTrackingMode.
+func serverSideTrackingModeFor(req *http.Request, config *Config) string {
+	mode, _ := sstModeByPathFor(req, config)
+	return mode
+}
+
+// like serverSideTrackingModeFor, also returns whether a prefix matched.
+func sstModeByPathFor(req *http.Request, config *Config) (string, bool) {
+	mode := config.ServerSideTrackingMode
+	longest := -1
+	for prefix, prefixMode := range config.SSTModeByPath {
+		if strings.HasPrefix(req.URL.Path, prefix) && len(prefix) > longest {
+			mode = prefixMode
+			longest = len(prefix)
+		}
+	}
+	return mode, longest >= 0
+}
+
+// a tracking payload with the sink bound to its request, sent without
+// reading the request again.
+type trackingEvent struct {
+	path    string // of the request, for logging
+	sink    TrackingSink
+	payload []byte
+}
+
+// builds the tracking event of the request, failures and panics are logged
+// and the event is dropped, they never reach traefik.
+func (h *PluginHandler) buildTrackingEvent(req *http.Request, res trackedResponse) (event trackingEvent, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.dropTrackingEvent(fmt.Errorf("panic: %v", r))
+			ok = false
+		}
+	}()
+	payload, err := buildTrackingPayload(req, &h.config, res)
 	if err != nil {
-		return err
+		h.dropTrackingEvent(fmt.Errorf("could not marshal tracking payload: %w", err))
+		return trackingEvent{}, false
 	}
+	return trackingEvent{path: req.URL.EscapedPath(), sink: sinkForRequest(h.sink, req), payload: payload}, true
+}
 
-	// send tracking request
-	err = sendTrackingRequest(trackingReq)
+// sends the event in the background, failures and panics are logged
+// and the event is dropped, they never reach traefik.
+func (h *PluginHandler) trackInBackground(event trackingEvent) {
+	defer func() {
+		if r := recover(); r != nil {
+			h.dropTrackingEvent(fmt.Errorf("panic: %v", r))
+		}
+	}()
+	err := event.sink.Send(event.payload)
 	if err != nil {
-		return err
+		h.dropTrackingEvent(err)
+		return
 	}
+	atomic.AddUint64(&h.counters.tracked, 1)
+}
 
-	return nil
+// sends the event before returning, for syncTracking
+// sends taking longer than the timeout are left to finish in the background.
+func (h *PluginHandler) trackWithin(event trackingEvent, timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.trackInBackground(event)
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-timer.C:
+		h.warn(fmt.Sprintf("tracking %s exceeded syncTrackingTimeout, sending it in the background", event.path))
+	}
+}
+
+// counts and logs a tracking event that could not be sent
+// events dropped by the open circuit or a Retry-After pause are only counted.
+func (h *PluginHandler) dropTrackingEvent(err error) {
+	dropped := atomic.AddUint64(&h.droppedEvents, 1)
+	if err == errCircuitOpen || err == errTrackingPaused {
+		return
+	}
+	h.warn(fmt.Sprintf("dropped tracking event (%d so far): %s", dropped, err.Error()))
 }
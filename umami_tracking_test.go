@@ -0,0 +1,1451 @@
+package traefik_umami_plugin
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBuildTrackingPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		headers map[string]string
+		res     trackedResponse
+		want    string
+	}{
+		{
+			name:   "root",
+			target: "/",
+			res:    trackedResponse{status: http.StatusOK},
+			want:   `{"payload":{"website":"website","hostname":"example.com","language":"","url":"/","referer":"","name":"traefik","data":{}},"type":"event"}`,
+		},
+		{
+			name:    "query and referrer",
+			target:  "/blog/post?page=2",
+			headers: map[string]string{"Referer": "https://search.test/?q=post", "Accept-Language": "de-DE,de;q=0.9"},
+			res:     trackedResponse{status: http.StatusOK},
+			want:    `{"payload":{"website":"website","hostname":"example.com","language":"de-DE","url":"/blog/post?page=2","referer":"https://search.test/?q=post","name":"traefik","data":{}},"type":"event"}`,
+		},
+		{
+			name:   "stripped query param",
+			target: "/account?token=secret&tab=1",
+			res:    trackedResponse{status: http.StatusOK},
+			want:   `{"payload":{"website":"website","hostname":"example.com","language":"","url":"/account?tab=1","referer":"","name":"traefik","data":{}},"type":"event"}`,
+		},
+		{
+			name:   "event with data and title",
+			target: "/checkout",
+			res:    trackedResponse{status: http.StatusOK, title: "Checkout", event: "purchase", eventData: map[string]interface{}{"amount": 42}},
+			want:   `{"payload":{"website":"website","hostname":"example.com","language":"","url":"/checkout","referer":"","title":"Checkout","name":"purchase","data":{"amount":42}},"type":"event"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, test.target, nil)
+			req.Host = "example.com:8080"
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			payload, err := buildTrackingPayload(req, testConfig(), test.res)
+			if err != nil {
+				t.Fatalf("buildTrackingPayload: %v", err)
+			}
+			if string(payload) != test.want {
+				t.Errorf("payload = %s\nwant %s", payload, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		value  string
+		want   time.Duration
+		wantOk bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 5 ", 5 * time.Second, true},
+		{"-1", 0, false},
+		{"soon", 0, false},
+		{"Mon, 01 Jan 2024 12:00:30 GMT", 30 * time.Second, true},
+	}
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			got, ok := parseRetryAfter(test.value, now)
+			if got != test.want || ok != test.wantOk {
+				t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", test.value, got, ok, test.want, test.wantOk)
+			}
+		})
+	}
+}
+
+func TestTrackingRetryAfter(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int // of the first tracking request, the others succeed
+		retryAfter  string
+		wantHits    uint64 // once ServeHTTP returned
+		wantDropped uint64
+		wantDelayed bool // the events are sent after the pause
+	}{
+		{"429 pauses", http.StatusTooManyRequests, "1", 1, 0, true},
+		{"503 pauses", http.StatusServiceUnavailable, "1", 1, 0, true},
+		{"429 without Retry-After", http.StatusTooManyRequests, "", 3, 1, false},
+		{"500 ignores Retry-After", http.StatusInternalServerError, "1", 3, 1, false},
+		{"elapsed pause", http.StatusTooManyRequests, "0", 3, 1, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var hits uint64
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if atomic.AddUint64(&hits, 1) > 1 {
+					return
+				}
+				if test.retryAfter != "" {
+					rw.Header().Set("Retry-After", test.retryAfter)
+				}
+				rw.WriteHeader(test.status)
+			}))
+			defer umami.Close()
+
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			start := time.Now()
+			for i := 0; i < 3; i++ {
+				serve(h, htmlRequest(http.MethodGet, "/"))
+			}
+			if got := atomic.LoadUint64(&hits); got != test.wantHits {
+				t.Errorf("umami got %d tracking requests, want %d", got, test.wantHits)
+			}
+			if test.wantDelayed {
+				// the rejected event and the two held ones
+				for atomic.LoadUint64(&hits) < 4 && time.Since(start) < 5*time.Second {
+					time.Sleep(10 * time.Millisecond)
+				}
+				if got := atomic.LoadUint64(&hits); got != 4 {
+					t.Fatalf("umami got %d tracking requests after the pause, want 4", got)
+				}
+				if elapsed := time.Since(start); elapsed < time.Second {
+					t.Errorf("held events were sent after %s, want them to wait for the pause", elapsed)
+				}
+			}
+			if got := atomic.LoadUint64(&h.droppedEvents); got != test.wantDropped {
+				t.Errorf("dropped %d events, want %d", got, test.wantDropped)
+			}
+		})
+	}
+}
+
+func TestTrackingThrottleHold(t *testing.T) {
+	throttle := &trackingThrottle{}
+	sink := &recordingSink{}
+	now := time.Now()
+	if held, _ := throttle.hold(now, sink, []byte("early")); held {
+		t.Fatal("held a payload without a pause")
+	}
+	throttle.pause(50 * time.Millisecond)
+	for i := 0; i < maxHeldEvents; i++ {
+		if held, err := throttle.hold(time.Now(), sink, []byte("held")); !held || err != nil {
+			t.Fatalf("hold %d = %v, %v, want it held", i, held, err)
+		}
+	}
+	if held, err := throttle.hold(time.Now(), sink, []byte("dropped")); !held || err != errTrackingPaused {
+		t.Errorf("hold above maxHeldEvents = %v, %v, want errTrackingPaused", held, err)
+	}
+	if len(sink.payloads()) != 0 {
+		t.Fatal("sent payloads during the pause")
+	}
+	// extended while held, so the release waits for the new end
+	throttle.pause(150 * time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	if len(sink.payloads()) != 0 {
+		t.Fatal("sent payloads before the extended pause ended")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(sink.payloads()) < maxHeldEvents && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := len(sink.payloads()); got != maxHeldEvents {
+		t.Errorf("sent %d payloads after the pause, want %d", got, maxHeldEvents)
+	}
+}
+
+func TestTrackingThrottlePause(t *testing.T) {
+	tests := []struct {
+		name       string
+		delays     []time.Duration
+		wantPaused time.Duration // from now, rounded to the second
+	}{
+		{"delay", []time.Duration{time.Minute}, time.Minute},
+		{"capped", []time.Duration{time.Hour}, maxRetryAfter},
+		{"extended", []time.Duration{time.Second, time.Minute}, time.Minute},
+		{"not shortened", []time.Duration{time.Minute, time.Second}, time.Minute},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			throttle := &trackingThrottle{}
+			for _, delay := range test.delays {
+				throttle.pause(delay)
+			}
+			now := time.Now()
+			if !throttle.paused(now) {
+				t.Fatal("not paused")
+			}
+			if got := throttle.pausedUntil.Sub(now).Round(time.Second); got != test.wantPaused {
+				t.Errorf("paused for %s, want %s", got, test.wantPaused)
+			}
+			if throttle.paused(now.Add(test.wantPaused + time.Second)) {
+				t.Error("still paused after the delay")
+			}
+		})
+	}
+}
+
+func TestScreenFromHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		hint   string
+		want   string
+	}{
+		{"width", "Sec-CH-Viewport-Width", "1280", "1280"},
+		{"width and height", "Sec-CH-Viewport-Width", "1280x720", "1280x720"},
+		{"trimmed", "Sec-CH-Viewport-Width", " 1280 ", "1280"},
+		{"missing hint", "Sec-CH-Viewport-Width", "", ""},
+		{"invalid hint", "Sec-CH-Viewport-Width", "wide", ""},
+		{"negative hint", "Sec-CH-Viewport-Width", "-1280", ""},
+		{"not configured", "", "1280", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.ScreenFromHeader = test.header
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			if test.hint != "" {
+				req.Header.Set("Sec-CH-Viewport-Width", test.hint)
+			}
+			rw := serve(h, req)
+			if acceptCH := rw.Header().Get("Accept-CH"); acceptCH != test.header {
+				t.Errorf("Accept-CH = %q, want %q", acceptCH, test.header)
+			}
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Screen != test.want {
+				t.Errorf("screen = %q, want %q", events[0].Screen, test.want)
+			}
+		})
+	}
+}
+
+func TestTrackErrorsAsEvents(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		status  int
+		want    string
+	}{
+		{"404", true, http.StatusNotFound, "error-404"},
+		{"500", true, http.StatusInternalServerError, "error-500"},
+		{"200", true, http.StatusOK, "traefik"},
+		{"301", true, http.StatusMovedPermanently, "traefik"},
+		{"404 disabled", false, http.StatusNotFound, "traefik"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.TrackErrorsAsEvents = test.enabled
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.WriteHeader(test.status)
+			}))
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, "/missing"))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Name != test.want {
+				t.Errorf("event = %q, want %q", events[0].Name, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvironmentTag(t *testing.T) {
+	tests := []struct {
+		name      string
+		tag       string
+		evade     bool
+		wantIssue string
+		wantHtml  string
+	}{
+		{"tag", "staging", false, "", " data-tag='staging'"},
+		{"tag evade", "staging", true, "", "el.setAttribute('data-tag', 'staging');"},
+		{"invalid tag", "stag'ing", false, "environmentTag", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.EnvironmentTag = test.tag
+			config.EvadeGoogleTagManager = test.evade
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+			sink := recordTracking(h)
+
+			body := serve(h, htmlRequest(http.MethodGet, "/")).Body.String()
+			if !strings.Contains(body, test.wantHtml) {
+				t.Errorf("body %q does not contain %q", body, test.wantHtml)
+			}
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Tag != test.tag || events[0].Data["environment"] != test.tag {
+				t.Errorf("tag = %q, data = %v, want %q in both", events[0].Tag, events[0].Data, test.tag)
+			}
+		})
+	}
+}
+
+func TestDropInternalReferrer(t *testing.T) {
+	tests := []struct {
+		name     string
+		drop     bool
+		domains  []string
+		referrer string
+		want     string
+	}{
+		{"same host", true, nil, "https://example.com/blog", ""},
+		{"same host other port", true, nil, "http://example.com:3000/", ""},
+		{"same host uppercase", true, nil, "https://EXAMPLE.com/", ""},
+		{"configured domain", true, []string{"example.com", "www.example.com"}, "https://www.example.com/", ""},
+		{"external", true, nil, "https://search.test/?q=example", "https://search.test/?q=example"},
+		{"subdomain", true, nil, "https://blog.example.com/", "https://blog.example.com/"},
+		{"no referrer", true, nil, "", ""},
+		{"not dropped", false, nil, "https://example.com/blog", "https://example.com/blog"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.DropInternalReferrer = test.drop
+			config.Domains = test.domains
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Host = "example.com"
+			if test.referrer != "" {
+				req.Header.Set("Referer", test.referrer)
+			}
+			if got := buildSendPayload(req, config, trackedResponse{status: http.StatusOK}).Referer; got != test.want {
+				t.Errorf("referrer = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// a tracking request as umami received it.
+type receivedTracking struct {
+	method      string
+	query       url.Values
+	contentType string
+	body        string
+}
+
+// an umami recording the tracking requests it receives.
+func newTrackingStub(t *testing.T) (*httptest.Server, chan receivedTracking) {
+	t.Helper()
+	received := make(chan receivedTracking, 100)
+	umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		received <- receivedTracking{method: req.Method, query: req.URL.Query(), contentType: req.Header.Get("Content-Type"), body: string(body)}
+	}))
+	t.Cleanup(umami.Close)
+	return umami, received
+}
+
+func TestTrackingMethod(t *testing.T) {
+	tests := []struct {
+		name         string
+		method       string
+		extractTitle bool
+		wantMethod   string
+		wantQuery    url.Values
+		wantBody     string
+		wantIssue    string
+	}{
+		{
+			name:       "POST",
+			method:     http.MethodPost,
+			wantMethod: http.MethodPost,
+			wantQuery:  url.Values{},
+			wantBody:   `{"payload":{"website":"website","hostname":"example.com","language":"","url":"/page?x=1","referer":"","name":"traefik","data":{}},"type":"event"}`,
+		},
+		{
+			name:       "GET",
+			method:     http.MethodGet,
+			wantMethod: http.MethodGet,
+			wantQuery: url.Values{
+				"type":     {"event"},
+				"website":  {"website"},
+				"hostname": {"example.com"},
+				"language": {""},
+				"url":      {"/page?x=1"},
+				"referer":  {""},
+				"name":     {"traefik"},
+			},
+		},
+		{
+			name:         "GET with title",
+			method:       http.MethodGet,
+			extractTitle: true,
+			wantMethod:   http.MethodGet,
+			wantQuery: url.Values{
+				"type":     {"event"},
+				"website":  {"website"},
+				"hostname": {"example.com"},
+				"language": {""},
+				"url":      {"/page?x=1"},
+				"referer":  {""},
+				"title":    {"Test"},
+				"name":     {"traefik"},
+			},
+		},
+		{name: "invalid", method: http.MethodPut, wantIssue: "trackingMethod"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, received := newTrackingStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			config.TrackingMethod = test.method
+			config.ExtractTitle = test.extractTitle
+			// the title is read from the body buffered for the injection
+			config.ScriptInjection = test.extractTitle
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+
+			req := htmlRequest(http.MethodGet, "/page?x=1")
+			req.Host = "example.com"
+			serve(h, req)
+			got := <-received
+			if got.method != test.wantMethod {
+				t.Errorf("method = %s, want %s", got.method, test.wantMethod)
+			}
+			if !reflect.DeepEqual(got.query, test.wantQuery) {
+				t.Errorf("query = %v, want %v", got.query, test.wantQuery)
+			}
+			if got.body != test.wantBody {
+				t.Errorf("body = %q, want %q", got.body, test.wantBody)
+			}
+			if test.method == http.MethodPost && got.contentType != "application/json" {
+				t.Errorf("Content-Type = %q, want application/json", got.contentType)
+			}
+		})
+	}
+}
+
+func TestEnvWebsiteMap(t *testing.T) {
+	tests := []struct {
+		name string
+		env  string
+		want string
+	}{
+		{"prod", "prod", "prod-website"},
+		{"staging", "staging", "staging-website"},
+		{"unknown", "dev", "website"},
+		{"missing", "", "website"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.EnvHeader = "X-Env"
+			config.EnvWebsiteMap = map[string]string{"prod": "prod-website", "staging": "staging-website"}
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			if test.env != "" {
+				req.Header.Set("X-Env", test.env)
+			}
+			body := serve(h, req).Body.String()
+			if !strings.Contains(body, " data-website-id='"+test.want+"'") {
+				t.Errorf("body %q does not inject website %q", body, test.want)
+			}
+			events := sink.events(t)
+			if len(events) != 1 || events[0].Website != test.want {
+				t.Errorf("tracked %+v, want website %q", events, test.want)
+			}
+		})
+	}
+}
+
+func TestEnvHeaderRequired(t *testing.T) {
+	config := testConfig()
+	config.EnvWebsiteMap = map[string]string{"prod": "prod-website"}
+	if field := configIssueField(newTestPlugin(t, config, http.NotFoundHandler())); field != "envHeader" {
+		t.Errorf("config issue = %q, want envHeader", field)
+	}
+}
+
+func TestTrackUrlHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		value   string
+		inject  bool
+		wantUrl string
+	}{
+		{"virtual path", "X-Umami-Url", "/virtual/path?tab=2", false, "/virtual/path?tab=2"},
+		{"injected page", "X-Umami-Url", "/virtual/path", true, "/virtual/path"},
+		{"without the header", "X-Umami-Url", "", false, "/app?view=list"},
+		{"absolute url", "X-Umami-Url", "https://evil.test/path", false, "/app?view=list"},
+		{"protocol relative", "X-Umami-Url", "//evil.test/path", false, "/app?view=list"},
+		{"relative path", "X-Umami-Url", "virtual", false, "/app?view=list"},
+		{"not configured", "", "/virtual/path", false, "/app?view=list"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = test.inject
+			config.ServerSideTracking = true
+			config.TrackUrlHeader = test.header
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", "text/html")
+				if test.value != "" {
+					rw.Header().Set("X-Umami-Url", test.value)
+				}
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, "/app?view=list"))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Url != test.wantUrl {
+				t.Errorf("url = %q, want %q", events[0].Url, test.wantUrl)
+			}
+		})
+	}
+}
+
+func TestStatusEventMap(t *testing.T) {
+	statusEvents := map[int]string{
+		http.StatusPaymentRequired: "payment-required",
+		http.StatusTeapot:          "teapot",
+		http.StatusNotFound:        "",
+	}
+	tests := []struct {
+		name        string
+		trackErrors bool
+		status      int
+		header      string
+		want        string
+	}{
+		{"mapped", false, http.StatusPaymentRequired, "", "payment-required"},
+		{"mapped other", false, http.StatusTeapot, "", "teapot"},
+		{"mapped before errors", true, http.StatusPaymentRequired, "", "payment-required"},
+		{"unmapped", false, http.StatusOK, "", "traefik"},
+		{"empty name", false, http.StatusNotFound, "", "traefik"},
+		{"empty name with errors", true, http.StatusNotFound, "", "error-404"},
+		{"response event first", false, http.StatusPaymentRequired, "paywall", "paywall"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.TrackErrorsAsEvents = test.trackErrors
+			config.StatusEventMap = statusEvents
+			config.EventHeader = "X-Umami-Event"
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.header != "" {
+					rw.Header().Set("X-Umami-Event", test.header)
+				}
+				rw.WriteHeader(test.status)
+			}))
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, "/"))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Name != test.want {
+				t.Errorf("event = %q, want %q", events[0].Name, test.want)
+			}
+		})
+	}
+}
+
+// a sink panicking on every send.
+type panickingSink struct{}
+
+func (panickingSink) Send(payload []byte) error {
+	panic("sink broke")
+}
+
+func TestTrackingFailuresDropped(t *testing.T) {
+	tests := []struct {
+		name    string
+		sink    TrackingSink
+		data    map[string]interface{}
+		wantLog string
+	}{
+		{"unmarshalable data", &recordingSink{}, map[string]interface{}{"callback": func() {}}, "could not marshal tracking payload"},
+		{"unmarshalable number", &recordingSink{}, map[string]interface{}{"ratio": math.NaN()}, "could not marshal tracking payload"},
+		{"panicking sink", panickingSink{}, nil, "panic: sink broke"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			h := newTestPlugin(t, config, http.NotFoundHandler())
+			var logs bytes.Buffer
+			h.LogHandler = log.New(&logs, "", 0)
+			h.SetTrackingSink(test.sink)
+
+			// must not panic
+			if event, ok := h.buildTrackingEvent(htmlRequest(http.MethodGet, "/"), trackedResponse{status: http.StatusOK, eventData: test.data}); ok {
+				h.trackInBackground(event)
+			}
+			if dropped := atomic.LoadUint64(&h.droppedEvents); dropped != 1 {
+				t.Errorf("dropped %d events, want 1", dropped)
+			}
+			if tracked := atomic.LoadUint64(&h.counters.tracked); tracked != 0 {
+				t.Errorf("tracked %d events, want 0", tracked)
+			}
+			if !strings.Contains(logs.String(), test.wantLog) {
+				t.Errorf("log %q does not contain %q", logs.String(), test.wantLog)
+			}
+		})
+	}
+}
+
+func TestCaptureUTM(t *testing.T) {
+	tests := []struct {
+		name     string
+		enabled  bool
+		target   string
+		trackUrl string
+		wantUrl  string
+		wantData map[string]interface{}
+	}{
+		{"in url and data", true, "/landing?utm_source=news&utm_medium=email&page=2", "", "/landing?utm_source=news&utm_medium=email&page=2", map[string]interface{}{"utm_source": "news", "utm_medium": "email"}},
+		{"no utm params", true, "/landing?page=2", "", "/landing?page=2", map[string]interface{}{}},
+		{"kept on the tracked url", true, "/p/123?utm_campaign=spring", "/product", "/product?utm_campaign=spring", map[string]interface{}{"utm_campaign": "spring"}},
+		{"tracked url params first", true, "/p/123?utm_campaign=spring", "/product?utm_campaign=own", "/product?utm_campaign=own", map[string]interface{}{"utm_campaign": "spring"}},
+		{"disabled", false, "/landing?utm_source=news", "/product", "/product", map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.CaptureUTM = test.enabled
+			config.TrackUrlHeader = "X-Track-Url"
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.trackUrl != "" {
+					rw.Header().Set("X-Track-Url", test.trackUrl)
+				}
+			}))
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, test.target))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Url != test.wantUrl {
+				t.Errorf("url = %q, want %q", events[0].Url, test.wantUrl)
+			}
+			if !reflect.DeepEqual(events[0].Data, test.wantData) {
+				t.Errorf("data = %v, want %v", events[0].Data, test.wantData)
+			}
+		})
+	}
+}
+
+func TestStripQueryParams(t *testing.T) {
+	defaults := CreateConfig().StripQueryParams
+	tests := []struct {
+		name  string
+		path  string
+		names []string
+		want  string
+	}{
+		{"defaults", "/a?token=1&tab=2&auth=3&session=4", defaults, "/a?tab=2"},
+		{"order kept", "/a?z=1&token=2&b=3&a=4", defaults, "/a?z=1&b=3&a=4"},
+		{"ignoring case", "/a?Token=1&tab=2", defaults, "/a?tab=2"},
+		{"escaped name", "/a?to%6Ben=1&tab=2", defaults, "/a?tab=2"},
+		{"without value", "/a?token&tab=2", defaults, "/a?tab=2"},
+		{"repeated", "/a?token=1&token=2&tab=3", defaults, "/a?tab=3"},
+		{"all stripped", "/a?token=1", defaults, "/a"},
+		{"values kept escaped", "/a?q=a%20b&token=1", defaults, "/a?q=a%20b"},
+		{"no query", "/a", defaults, "/a"},
+		{"configured", "/a?token=1&key=2", []string{"key"}, "/a?token=1"},
+		{"none", "/a?token=1", []string{}, "/a?token=1"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := stripQueryParams(test.path, test.names); got != test.want {
+				t.Errorf("stripQueryParams(%q) = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestStripQueryParamsPayload(t *testing.T) {
+	config := testConfig()
+	config.ScriptInjection = false
+	config.ServerSideTracking = true
+	config.CaptureUTM = true
+	h := newTestPlugin(t, config, http.NotFoundHandler())
+	sink := recordTracking(h)
+
+	serve(h, htmlRequest(http.MethodGet, "/reset?token=secret&utm_source=mail&step=2"))
+	events := sink.events(t)
+	if len(events) != 1 {
+		t.Fatalf("tracked %d events, want 1", len(events))
+	}
+	if want := "/reset?utm_source=mail&step=2"; events[0].Url != want {
+		t.Errorf("url = %q, want %q", events[0].Url, want)
+	}
+}
+
+func TestWebsiteIdOutHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		env    string
+		target string
+		want   string // of the header on the request to umami
+	}{
+		{"forwarded", "X-Umami-Website", "", "/_umami/api/send", "website"},
+		{"tracked", "X-Umami-Website", "", "/page", "website"},
+		{"tracked env website", "X-Umami-Website", "prod", "/page", "prod-website"},
+		{"forwarded env website", "X-Umami-Website", "prod", "/_umami/api/send", "prod-website"},
+		{"not configured", "", "", "/page", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			config.WebsiteIdOutHeader = test.header
+			config.EnvHeader = "X-Env"
+			config.EnvWebsiteMap = map[string]string{"prod": "prod-website"}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			req := htmlRequest(http.MethodGet, test.target)
+			if test.env != "" {
+				req.Header.Set("X-Env", test.env)
+			}
+			serve(h, req)
+			var upstream *http.Request
+			select {
+			case upstream = <-requests:
+			case <-time.After(time.Second):
+				t.Fatal("umami got no request")
+			}
+			if got := upstream.Header.Get("X-Umami-Website"); got != test.want {
+				t.Errorf("X-Umami-Website = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCollectContentType(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		clientType  string // of the client request, replaced
+		want        string
+		wantIssue   string
+	}{
+		{"default", "", "", "application/json", ""},
+		{"text/plain", "text/plain", "", "text/plain", ""},
+		{"with charset", "text/plain; charset=utf-8", "application/x-www-form-urlencoded", "text/plain; charset=utf-8", ""},
+		{"client type replaced", "", "multipart/form-data; boundary=x", "application/json", ""},
+		{"invalid", "text/plain;;", "", "", "collectContentType"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, received := newTrackingStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			if test.contentType != "" {
+				config.CollectContentType = test.contentType
+			}
+			config.TrackMethods = append(config.TrackMethods, http.MethodPost)
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				return
+			}
+
+			req := htmlRequest(http.MethodPost, "/form")
+			if test.clientType != "" {
+				req.Header.Set("Content-Type", test.clientType)
+			}
+			serve(h, req)
+			select {
+			case got := <-received:
+				if got.contentType != test.want {
+					t.Errorf("Content-Type = %q, want %q", got.contentType, test.want)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("umami got no tracking request")
+			}
+		})
+	}
+}
+
+func TestSSTModeByPath(t *testing.T) {
+	modes := map[string]string{
+		"/api/":      SSTModeAll,
+		"/api/html/": SSTModeNotinjected,
+		"/docs":      SSTModeNotinjected,
+	}
+	tests := []struct {
+		name        string
+		defaultMode string
+		path        string
+		want        string
+	}{
+		{"default", SSTModeAll, "/", SSTModeAll},
+		{"prefix", SSTModeNotinjected, "/api/users", SSTModeAll},
+		{"longest prefix", SSTModeAll, "/api/html/page", SSTModeNotinjected},
+		{"prefix without slash", SSTModeAll, "/docs-v2", SSTModeNotinjected},
+		{"not a prefix", SSTModeNotinjected, "/apiv2", SSTModeNotinjected},
+		{"default notinjected", SSTModeNotinjected, "/blog", SSTModeNotinjected},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTrackingMode = test.defaultMode
+			config.SSTModeByPath = modes
+			if got := serverSideTrackingModeFor(httptest.NewRequest(http.MethodGet, test.path, nil), config); got != test.want {
+				t.Errorf("mode of %s = %q, want %q", test.path, got, test.want)
+			}
+		})
+	}
+}
+
+func TestSSTModeByPathTracking(t *testing.T) {
+	tests := []struct {
+		name        string
+		path        string
+		accept      string
+		contentType string
+		wantTracked bool
+	}{
+		{"injected html route", "/page", "text/html", "text/html", false},
+		{"not injected html route", "/page", "text/html", "text/plain", true},
+		{"api route", "/api/page", "text/html", "text/html", true},
+		{"api json call", "/api/users", "application/json", "application/json", true},
+		{"json call outside the api", "/users", "application/json", "application/json", false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			config.ServerSideTrackingMode = SSTModeNotinjected
+			config.SSTModeByPath = map[string]string{"/api/": SSTModeAll}
+			h := newTestPlugin(t, config, htmlHandler(test.contentType, testPage))
+			sink := recordTracking(h)
+
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			req.Header.Set("Accept", test.accept)
+			serve(h, req)
+			if tracked := len(sink.payloads()) == 1; tracked != test.wantTracked {
+				t.Errorf("tracked = %v, want %v", tracked, test.wantTracked)
+			}
+		})
+	}
+}
+
+func TestSSTModeByPathConfig(t *testing.T) {
+	config := testConfig()
+	config.ServerSideTracking = true
+	config.SSTModeByPath = map[string]string{"/api/": "sometimes"}
+	h := newTestPlugin(t, config, http.NotFoundHandler())
+	if field := configIssueField(h); field != "sstModeByPath" {
+		t.Errorf("config issue = %q, want sstModeByPath", field)
+	}
+	if h.config.ServerSideTracking {
+		t.Error("server side tracking is enabled with an invalid mode")
+	}
+}
+
+func TestTrackMethods(t *testing.T) {
+	tests := []struct {
+		name      string
+		methods   []string // nil for the defaults
+		method    string
+		preflight bool
+		want      bool
+	}{
+		{"GET by default", nil, http.MethodGet, false, true},
+		{"OPTIONS by default", nil, http.MethodOptions, false, false},
+		{"preflight by default", nil, http.MethodOptions, true, false},
+		{"POST by default", nil, http.MethodPost, false, false},
+		{"HEAD by default", nil, http.MethodHead, false, false},
+		{"OPTIONS listed", []string{http.MethodGet, http.MethodOptions}, http.MethodOptions, false, true},
+		{"preflight listed", []string{http.MethodOptions}, http.MethodOptions, true, false},
+		{"all methods", []string{}, http.MethodPost, false, true},
+		{"OPTIONS with all methods", []string{}, http.MethodOptions, false, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			if test.methods != nil {
+				config.TrackMethods = test.methods
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(test.method, "/app/route")
+			if test.preflight {
+				req.Header.Set("Origin", "https://app.test")
+				req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+			}
+			serve(h, req)
+			if tracked := len(sink.payloads()) == 1; tracked != test.want {
+				t.Errorf("tracked = %v, want %v", tracked, test.want)
+			}
+		})
+	}
+}
+
+func TestTrackNavigationsOnly(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		headers map[string]string
+		want    bool
+	}{
+		{"navigation", true, map[string]string{"Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "document"}, true},
+		{"no fetch metadata", true, nil, true},
+		{"no-cors fetch", true, map[string]string{"Sec-Fetch-Mode": "no-cors", "Sec-Fetch-Dest": "image"}, false},
+		{"cors fetch", true, map[string]string{"Sec-Fetch-Mode": "cors", "Sec-Fetch-Dest": "empty"}, false},
+		{"iframe navigation", true, map[string]string{"Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "iframe"}, false},
+		{"prefetch", true, map[string]string{"Sec-Fetch-Mode": "navigate", "Sec-Fetch-Dest": "document", "Sec-Purpose": "prefetch"}, false},
+		{"legacy prefetch", true, map[string]string{"Purpose": "prefetch"}, false},
+		{"uppercase values", true, map[string]string{"Sec-Fetch-Mode": "NAVIGATE", "Sec-Fetch-Dest": "Document"}, true},
+		{"no-cors fetch disabled", false, map[string]string{"Sec-Fetch-Mode": "no-cors", "Sec-Fetch-Dest": "image"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.TrackNavigationsOnly = test.enabled
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			for name, value := range test.headers {
+				req.Header.Set(name, value)
+			}
+			serve(h, req)
+			if tracked := len(sink.payloads()) == 1; tracked != test.want {
+				t.Errorf("tracked = %v, want %v", tracked, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeReferrer(t *testing.T) {
+	tests := []struct {
+		referrer string
+		want     string
+	}{
+		{"https://WWW.Example.COM/", "https://example.com"},
+		{"https://www.example.com/blog///", "https://example.com/blog"},
+		{"HTTPS://example.com/Blog/", "https://example.com/Blog"},
+		{"https://www.example.com/search/?q=Go", "https://example.com/search?q=Go"},
+		{"https://example.com/a%2Fb/", "https://example.com/a%2Fb"},
+		{"https://example.com:8443/", "https://example.com:8443"},
+		{"https://wwwexample.com/", "https://wwwexample.com"},
+		{"android-app://com.example/", "android-app://com.example"},
+		{"", ""},
+		{"not a url/", "not a url/"},
+	}
+	for _, test := range tests {
+		t.Run(test.referrer, func(t *testing.T) {
+			if got := normalizeReferrer(test.referrer); got != test.want {
+				t.Errorf("normalizeReferrer(%q) = %q, want %q", test.referrer, got, test.want)
+			}
+		})
+	}
+}
+
+func TestNormalizeReferrerPayload(t *testing.T) {
+	tests := []struct {
+		name    string
+		enabled bool
+		want    string
+	}{
+		{"normalized", true, "https://news.test/item"},
+		{"disabled", false, "https://WWW.News.test/item/"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.NormalizeReferrer = test.enabled
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			sink := recordTracking(h)
+
+			req := htmlRequest(http.MethodGet, "/")
+			req.Header.Set("Referer", "https://WWW.News.test/item/")
+			serve(h, req)
+			events := sink.events(t)
+			if len(events) != 1 || events[0].Referer != test.want {
+				t.Errorf("tracked %+v, want referrer %q", events, test.want)
+			}
+		})
+	}
+}
+
+func TestForwardTrackingHeaders(t *testing.T) {
+	client := map[string]string{
+		"User-Agent":      "Mozilla/5.0 (test)",
+		"Accept-Language": "de",
+		"Cf-Ipcountry":    "DE",
+		"Cookie":          "session=secret",
+		"X-Custom":        "1",
+	}
+	tests := []struct {
+		name       string
+		forward    []string
+		denylist   []string
+		want       []string
+		wantAbsent []string
+	}{
+		{"all by default", nil, nil, []string{"User-Agent", "Accept-Language", "Cf-Ipcountry", "Cookie", "X-Custom"}, nil},
+		{"listed", []string{"Cf-Ipcountry"}, nil, []string{"User-Agent", "Accept-Language", "Cf-Ipcountry"}, []string{"Cookie", "X-Custom"}},
+		{"listed lowercase", []string{"cf-ipcountry"}, nil, []string{"Cf-Ipcountry"}, []string{"Cookie"}},
+		{"denied", nil, []string{"cookie"}, []string{"User-Agent", "Cf-Ipcountry", "X-Custom"}, []string{"Cookie"}},
+		{"denied over listed", []string{"Cf-Ipcountry", "X-Custom"}, []string{"Cf-Ipcountry"}, []string{"User-Agent", "X-Custom"}, []string{"Cf-Ipcountry"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			umami, requests := newUmamiStub(t)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = true
+			if test.forward != nil {
+				config.ForwardTrackingHeaders = test.forward
+			}
+			if test.denylist != nil {
+				config.TrackingHeaderDenylist = test.denylist
+			}
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			req := htmlRequest(http.MethodGet, "/")
+			for name, value := range client {
+				req.Header.Set(name, value)
+			}
+			serve(h, req)
+			var upstream *http.Request
+			select {
+			case upstream = <-requests:
+			case <-time.After(time.Second):
+				t.Fatal("umami got no tracking request")
+			}
+			for _, name := range test.want {
+				if value := upstream.Header.Get(name); value != client[name] {
+					t.Errorf("%s = %q, want %q", name, value, client[name])
+				}
+			}
+			for _, name := range test.wantAbsent {
+				if value := upstream.Header.Get(name); value != "" {
+					t.Errorf("%s = %q, want it absent", name, value)
+				}
+			}
+		})
+	}
+}
+
+func TestEventHeader(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		method      string
+		event       string
+		data        string
+		wantEvents  int
+		wantName    string
+		wantData    map[string]interface{}
+	}{
+		{"injected page", "text/html", http.MethodGet, "signup", "", 1, "signup", map[string]interface{}{}},
+		{"api response", "application/json", http.MethodPost, "purchase", `{"amount": 42, "currency": "EUR"}`, 1, "purchase", map[string]interface{}{"amount": float64(42), "currency": "EUR"}},
+		{"invalid data", "application/json", http.MethodPost, "purchase", `[1, 2]`, 1, "purchase", map[string]interface{}{}},
+		{"no event", "application/json", http.MethodPost, "", `{"amount": 42}`, 0, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.EventHeader = "X-Umami-Event"
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				rw.Header().Set("Content-Type", test.contentType)
+				if test.event != "" {
+					rw.Header().Set("X-Umami-Event", test.event)
+				}
+				if test.data != "" {
+					rw.Header().Set("X-Umami-Event-Data", test.data)
+				}
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			sink := recordTracking(h)
+
+			rw := serve(h, htmlRequest(test.method, "/checkout"))
+			for _, name := range []string{"X-Umami-Event", "X-Umami-Event-Data"} {
+				if value := rw.Header().Get(name); value != "" {
+					t.Errorf("%s = %q sent downstream", name, value)
+				}
+			}
+			events := sink.events(t)
+			if len(events) != test.wantEvents {
+				t.Fatalf("tracked %d events, want %d", len(events), test.wantEvents)
+			}
+			if test.wantEvents == 0 {
+				return
+			}
+			if events[0].Name != test.wantName || events[0].Url != "/checkout" {
+				t.Errorf("event = %q of %q, want %q of /checkout", events[0].Name, events[0].Url, test.wantName)
+			}
+			if !reflect.DeepEqual(events[0].Data, test.wantData) {
+				t.Errorf("data = %v, want %v", events[0].Data, test.wantData)
+			}
+		})
+	}
+}
+
+func TestSyncTracking(t *testing.T) {
+	tests := []struct {
+		name      string
+		sync      bool
+		timeout   string
+		delay     time.Duration // the umami response is delayed by
+		wantSent  bool          // sent once ServeHTTP returned
+		wantIssue string
+	}{
+		{name: "sync", sync: true, timeout: "5s", wantSent: true},
+		{name: "sync waits for a slow umami", sync: true, timeout: "5s", delay: 100 * time.Millisecond, wantSent: true},
+		{name: "sync timeout", sync: true, timeout: "20ms", delay: 500 * time.Millisecond},
+		{name: "async", sync: false, delay: 100 * time.Millisecond},
+		{name: "invalid timeout", sync: true, timeout: "soon", wantIssue: "syncTrackingTimeout"},
+		{name: "negative timeout", sync: true, timeout: "-1s", wantIssue: "syncTrackingTimeout"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sent := make(chan struct{}, 1)
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				time.Sleep(test.delay)
+				sent <- struct{}{}
+			}))
+			t.Cleanup(umami.Close)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = test.sync
+			config.SyncTrackingTimeout = test.timeout
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+			if field := configIssueField(h); field != test.wantIssue {
+				t.Fatalf("config issue = %q, want %q", field, test.wantIssue)
+			}
+			if test.wantIssue != "" {
+				if h.config.SyncTracking {
+					t.Error("syncTracking is still enabled")
+				}
+				return
+			}
+
+			start := time.Now()
+			serve(h, htmlRequest(http.MethodGet, "/"))
+			elapsed := time.Since(start)
+			select {
+			case <-sent:
+				if !test.wantSent {
+					t.Error("tracking was sent before ServeHTTP returned")
+				}
+			default:
+				if test.wantSent {
+					t.Fatal("tracking was not sent before ServeHTTP returned")
+				}
+				// sent in the background anyway
+				select {
+				case <-sent:
+				case <-time.After(5 * time.Second):
+					t.Fatal("tracking was not sent")
+				}
+			}
+			if !test.wantSent && elapsed >= test.delay {
+				t.Errorf("ServeHTTP took %v, want it not to wait for umami", elapsed)
+			}
+		})
+	}
+}
+
+func TestPathEventRules(t *testing.T) {
+	rules := []PathEventRule{
+		{Pattern: "/product/{id}", Event: "product-view"},
+		{Pattern: "/shop/{shop}/item/{item}", Event: "item-view"},
+		{Pattern: "/product/{id}/reviews", Event: "reviews-view"},
+	}
+	tests := []struct {
+		name          string
+		path          string
+		responseEvent string // set by the upstream in the eventHeader
+		wantEvent     string
+		wantData      map[string]interface{}
+	}{
+		{"param", "/product/123", "", "product-view", map[string]interface{}{"id": "123"}},
+		{"trailing slash", "/product/123/", "", "product-view", map[string]interface{}{"id": "123"}},
+		{"params", "/shop/acme/item/42", "", "item-view", map[string]interface{}{"shop": "acme", "item": "42"}},
+		{"literal segment", "/product/123/reviews", "", "reviews-view", map[string]interface{}{"id": "123"}},
+		{"query ignored", "/product/123?ref=ad", "", "product-view", map[string]interface{}{"id": "123"}},
+		{"no match", "/product", "", "traefik", map[string]interface{}{}},
+		{"segment not matched across slashes", "/product/1/2", "", "traefik", map[string]interface{}{}},
+		{"response event takes precedence", "/product/123", "checkout", "checkout", map[string]interface{}{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.EventHeader = "X-Umami-Event"
+			config.PathEventRules = rules
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.responseEvent != "" {
+					rw.Header().Set("X-Umami-Event", test.responseEvent)
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			sink := recordTracking(h)
+
+			serve(h, htmlRequest(http.MethodGet, test.path))
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if events[0].Name != test.wantEvent {
+				t.Errorf("event = %q, want %q", events[0].Name, test.wantEvent)
+			}
+			if !reflect.DeepEqual(events[0].Data, test.wantData) {
+				t.Errorf("data = %v, want %v", events[0].Data, test.wantData)
+			}
+		})
+	}
+}
+
+func TestCompilePathEventRule(t *testing.T) {
+	tests := []struct {
+		name    string
+		rule    PathEventRule
+		wantErr bool
+	}{
+		{"template", PathEventRule{Pattern: "/product/{id}", Event: "product-view"}, false},
+		{"literal", PathEventRule{Pattern: "/pricing/", Event: "pricing-view"}, false},
+		{"regexp chars quoted", PathEventRule{Pattern: "/v1.0/{id}", Event: "view"}, false},
+		{"no event", PathEventRule{Pattern: "/product/{id}"}, true},
+		{"relative", PathEventRule{Pattern: "product/{id}", Event: "product-view"}, true},
+		{"unclosed param", PathEventRule{Pattern: "/product/{id", Event: "product-view"}, true},
+		{"param in a segment", PathEventRule{Pattern: "/product/id-{id}", Event: "product-view"}, true},
+		{"invalid param name", PathEventRule{Pattern: "/product/{1d}", Event: "product-view"}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := compilePathEventRule(test.rule)
+			if (err != nil) != test.wantErr {
+				t.Errorf("compilePathEventRule(%+v) error = %v, want error %v", test.rule, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestResponseLocale(t *testing.T) {
+	tests := []struct {
+		name            string
+		fromHeader      bool
+		fromPath        bool
+		path            string
+		contentLanguage string
+		want            string
+	}{
+		{"disabled", false, false, "/de/page", "de-DE", ""},
+		{"header", true, false, "/page", "de-DE", "de-DE"},
+		{"first of the header", true, false, "/page", " fr-CA, en", "fr-CA"},
+		{"invalid header", true, false, "/page", "de'DE", ""},
+		{"path", false, true, "/de/page", "", "de"},
+		{"path with region", false, true, "/en-US/page", "", "en-US"},
+		{"path with script", false, true, "/zh_Hant/", "", "zh_Hant"},
+		{"path not a locale", false, true, "/api/page", "", ""},
+		{"root path", false, true, "/", "", ""},
+		{"header before path", true, true, "/de/page", "fr", "fr"},
+		{"path without header", true, true, "/de/page", "", "de"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.LocaleFromHeader = test.fromHeader
+			config.LocaleFromPath = test.fromPath
+			header := http.Header{}
+			if test.contentLanguage != "" {
+				header.Set("Content-Language", test.contentLanguage)
+			}
+			req := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if got := responseLocale(req, header, config); got != test.want {
+				t.Errorf("responseLocale() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestLocaleAttached(t *testing.T) {
+	tests := []struct {
+		name            string
+		fromHeader      bool
+		fromPath        bool
+		path            string
+		contentLanguage string
+		wantLocale      string
+	}{
+		{"from header", true, false, "/page", "de-DE", "de-DE"},
+		{"from path", false, true, "/fr/page", "", "fr"},
+		{"none", true, true, "/page", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config := testConfig()
+			config.ServerSideTracking = true
+			config.LocaleFromHeader = test.fromHeader
+			config.LocaleFromPath = test.fromPath
+			h := newTestPlugin(t, config, http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				if test.contentLanguage != "" {
+					rw.Header().Set("Content-Language", test.contentLanguage)
+				}
+				rw.Header().Set("Content-Type", "text/html")
+				_, _ = io.WriteString(rw, testPage)
+			}))
+			sink := recordTracking(h)
+
+			body := serve(h, htmlRequest(http.MethodGet, test.path)).Body.String()
+			attribute := " data-locale='" + test.wantLocale + "'"
+			if test.wantLocale == "" && strings.Contains(body, "data-locale") || test.wantLocale != "" && !strings.Contains(body, attribute) {
+				t.Errorf("body = %q, want the locale %q in the script", body, test.wantLocale)
+			}
+			events := sink.events(t)
+			if len(events) != 1 {
+				t.Fatalf("tracked %d events, want 1", len(events))
+			}
+			if locale, _ := events[0].Data["locale"].(string); locale != test.wantLocale {
+				t.Errorf("data = %v, want the locale %q", events[0].Data, test.wantLocale)
+			}
+		})
+	}
+}
+
+func TestTrackingRequestReused(t *testing.T) {
+	tests := []struct {
+		name string
+		sync bool
+	}{
+		{"async", false},
+		{"sync", true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			userAgents := make(chan string, 1)
+			bodies := make(chan string, 1)
+			umami := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+				body, _ := io.ReadAll(req.Body)
+				userAgents <- req.Header.Get("User-Agent")
+				bodies <- string(body)
+			}))
+			t.Cleanup(umami.Close)
+			config := testConfig()
+			config.UmamiHost = umami.URL
+			config.ScriptInjection = false
+			config.ServerSideTracking = true
+			config.SyncTracking = test.sync
+			h := newTestPlugin(t, config, htmlHandler("text/html", testPage))
+
+			req := htmlRequest(http.MethodGet, "/page")
+			req.Header.Set("User-Agent", "Mozilla/5.0 (test)")
+			serve(h, req)
+			// traefik may reuse the request once it is served
+			req.URL.Path = "/reused"
+			req.Header.Set("User-Agent", "reused")
+
+			select {
+			case userAgent := <-userAgents:
+				if userAgent != "Mozilla/5.0 (test)" {
+					t.Errorf("User-Agent = %q, want the one of the served request", userAgent)
+				}
+				if body := <-bodies; !strings.Contains(body, `"url":"/page"`) {
+					t.Errorf("body = %q, want the url of the served request", body)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("tracking was not sent")
+			}
+		})
+	}
+}